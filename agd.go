@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Arcade Game Designer (AGD) and Multi-Platform AGD export. Both read sprites and blocks from
+// text definitions in their source files: DEFINESPRITE followed by 32 bytes (16 rows of two
+// bytes) per 16×16 frame, and DEFINEBLOCK followed by 8 bitmap bytes and an attribute byte.
+
+// agdBlockType is the block type written for every exported block.
+var agdBlockType = "EMPTYBLOCK"
+
+// agdBlockTypes lists the block types AGD understands.
+var agdBlockTypes = map[string]bool{
+	"EMPTYBLOCK":    true,
+	"PLATFORMBLOCK": true,
+	"WALLBLOCK":     true,
+	"LADDERBLOCK":   true,
+	"FODDERBLOCK":   true,
+	"DEADLYBLOCK":   true,
+	"CUSTOMBLOCK":   true,
+}
+
+// agdBytes formats bytes as space-separated decimal values on an indented line.
+func agdBytes(data []byte) string {
+	values := make([]string, len(data))
+	for i, b := range data {
+		values[i] = strconv.Itoa(int(b))
+	}
+	return "    " + strings.Join(values, " ") + "\n"
+}
+
+// agdSprites converts an image made of 16×16 frames, read left to right and top to bottom, into a
+// single AGD sprite definition.
+func agdSprites(m *indexedImage) (string, error) {
+	if m.width%16 != 0 || m.height%16 != 0 {
+		return "", fmt.Errorf("%w: AGD sprites are made of 16x16 frames, image is %dx%d", ErrWidthMismatch, m.width, m.height)
+	}
+	data, bytesPerRow := packBitmap(m)
+	frames := (m.width / 16) * (m.height / 16)
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("DEFINESPRITE %d\n", frames))
+	for fy := 0; fy < m.height; fy += 16 {
+		for fx := 0; fx < m.width; fx += 16 {
+			frame := make([]byte, 0, 32)
+			for y := fy; y < fy+16; y++ {
+				frame = append(frame, data[y*bytesPerRow+fx/8], data[y*bytesPerRow+fx/8+1])
+			}
+			sb.WriteString(agdBytes(frame))
+		}
+	}
+	return sb.String(), nil
+}
+
+// agdBlocks converts an image into one AGD block definition per 8×8 cell, read left to right and
+// top to bottom, each with its bitmap and attribute byte.
+func agdBlocks(m *indexedImage) (string, error) {
+	if m.width%8 != 0 || m.height%8 != 0 {
+		return "", fmt.Errorf("%w: AGD blocks are 8x8 cells, image is %dx%d", ErrWidthMismatch, m.width, m.height)
+	}
+	if !agdBlockTypes[agdBlockType] {
+		return "", fmt.Errorf("unknown AGD block type %q", agdBlockType)
+	}
+	data, bytesPerRow := packBitmap(m)
+	attrs, cols := attributeBytes(m)
+	var sb strings.Builder
+	for i, attr := range attrs {
+		cx, cy := i%cols, i/cols
+		block := make([]byte, 0, 9)
+		for y := cy * 8; y < cy*8+8; y++ {
+			block = append(block, data[y*bytesPerRow+cx])
+		}
+		if i > 0 {
+			sb.WriteRune('\n')
+		}
+		sb.WriteString("DEFINEBLOCK " + agdBlockType + "\n")
+		sb.WriteString(agdBytes(block))
+		sb.WriteString(agdBytes([]byte{attr}))
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"strconv"
+	"strings"
+)
+
+// Animations: a multi-frame hex file has the usual header, followed by one section per frame,
+// each starting with a "# frame: N" line and holding the rows of that frame. Every frame has the
+// width and height given in the header. Converted as a single image, such a file gives the frames
+// stacked top to bottom, since the frame lines are comments.
+
+// defaultFrameDuration is the time each frame is shown for, in milliseconds, when the file does
+// not record one.
+const defaultFrameDuration = 100
+
+// animation is a decoded multi-frame hex file.
+type animation struct {
+	frames         []*indexedImage
+	meta           map[string]string // Header metadata.
+	duration       int               // Time each frame is shown for, in milliseconds.
+	frameDurations []int             // Per-frame times, overriding duration; 0 for frames without one.
+}
+
+// Frame timing settings, applied to animations as they are loaded.
+var (
+	animDuration   int    // Time each frame is shown for, in milliseconds; 0 keeps the recorded timing.
+	frameDurations string // Comma-separated per-frame times in milliseconds; empty keeps the recorded timing.
+)
+
+// parseDuration parses a frame duration in milliseconds.
+func parseDuration(s string) (int, error) {
+	ms, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || ms < 1 {
+		return 0, fmt.Errorf("invalid frame duration %q (expected milliseconds)", s)
+	}
+	return ms, nil
+}
+
+// parseFrameDurations parses the --frame-durations list.
+func parseFrameDurations() ([]int, error) {
+	if frameDurations == "" {
+		return nil, nil
+	}
+	var list []int
+	for _, field := range strings.Split(frameDurations, ",") {
+		ms, err := parseDuration(field)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ms)
+	}
+	return list, nil
+}
+
+// checkDurationSettings validates the frame timing settings.
+func checkDurationSettings() error {
+	if animDuration < 0 {
+		return fmt.Errorf("frame duration must not be negative")
+	}
+	_, err := parseFrameDurations()
+	return err
+}
+
+// applyDurations overrides an animation's recorded timing with the frame timing settings.
+func applyDurations(anim *animation) error {
+	if animDuration > 0 {
+		anim.duration = animDuration
+	}
+	list, err := parseFrameDurations()
+	if err != nil || list == nil {
+		return err
+	}
+	if len(list) != len(anim.frames) {
+		return fmt.Errorf("%d frame durations given for %d frames", len(list), len(anim.frames))
+	}
+	anim.frameDurations = list
+	return nil
+}
+
+// frameDuration returns the time frame i is shown for, in milliseconds.
+func (anim *animation) frameDuration(i int) int {
+	if i < len(anim.frameDurations) && anim.frameDurations[i] > 0 {
+		return anim.frameDurations[i]
+	}
+	return anim.duration
+}
+
+// headerFields collects the "# key: value" fields of some hex text, keeping the first occurrence
+// of each key.
+func headerFields(text string) map[string]string {
+	fields := map[string]string{}
+	scanner := hexScanner(text)
+	for scanner.Scan() {
+		if key, value, ok := headerField(scanner.Text()); ok {
+			if _, seen := fields[key]; !seen {
+				fields[key] = value
+			}
+		}
+	}
+	return fields
+}
+
+// hasFrames reports whether hex text has frame sections.
+func hasFrames(content string) bool {
+	scanner := hexScanner(content)
+	for scanner.Scan() {
+		if isFrameLine(scanner.Text()) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFrameLine reports whether a line starts a frame section.
+func isFrameLine(line string) bool {
+	key, _, ok := headerField(line)
+	return ok && key == "frame"
+}
+
+// splitFrames splits hex text into its header and frame sections. Text without frame lines is a
+// single frame. Each section starts with blank lines standing in for the frames before it, so
+// that the header followed by a section has the line numbers of the whole file.
+func splitFrames(content string) (string, []string) {
+	var header strings.Builder
+	var sections []string
+	var section *strings.Builder
+	headerLines, lineNo := 0, 0
+	scanner := hexScanner(content)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isFrameLine(line) {
+			if section != nil {
+				sections = append(sections, section.String())
+			} else {
+				headerLines = lineNo
+			}
+			section = &strings.Builder{}
+			section.WriteString(strings.Repeat("\n", lineNo-headerLines))
+		}
+		lineNo++
+		if section == nil {
+			header.WriteString(line + "\n")
+		} else {
+			section.WriteString(line + "\n")
+		}
+	}
+	if section == nil {
+		return "", []string{header.String()}
+	}
+	return header.String(), append(sections, section.String())
+}
+
+// parseAnimation parses a multi-frame hex file; a file without frame sections is a single frame.
+// A "# duration:" field in the header gives the time each frame is shown for, in milliseconds,
+// and one in a frame section overrides it for that frame.
+func parseAnimation(ctx context.Context, content string) (*animation, error) {
+	header, sections := splitFrames(content)
+	anim := &animation{duration: defaultFrameDuration}
+	// Without frame sections the whole file is the header.
+	headerText := header
+	if header == "" {
+		headerText = content
+	}
+	if d, ok := headerFields(headerText)["duration"]; ok {
+		ms, err := parseDuration(d)
+		if err != nil {
+			return nil, err
+		}
+		anim.duration = ms
+	}
+	for i, section := range sections {
+		// Parsing the header with each frame checks its rows against the header width.
+		hexData, width, meta, err := parseHexText(ctx, header+section)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		m, err := hexToIndexed(ctx, hexData, width)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		if i == 0 {
+			anim.meta = meta
+		} else if first := anim.frames[0]; m.width != first.width || m.height != first.height {
+			return nil, fmt.Errorf("%w: frame %d is %dx%d, frame 0 is %dx%d", ErrWidthMismatch, i, m.width, m.height, first.width, first.height)
+		}
+		anim.frames = append(anim.frames, m)
+		ms := 0
+		if d, ok := headerFields(section)["duration"]; ok && header != "" { // Single frames have no section of their own.
+			if ms, err = parseDuration(d); err != nil {
+				return nil, fmt.Errorf("frame %d: %w", i, err)
+			}
+		}
+		anim.frameDurations = append(anim.frameDurations, ms)
+	}
+	return anim, nil
+}
+
+// animationToHex formats an animation as a multi-frame hex file. Frame durations are recorded in
+// the frame sections where they differ from the animation's, as are bounding boxes when enabled.
+func animationToHex(anim *animation, filename string, extra ...string) string {
+	extra = append([]string{fmt.Sprintf("frames: %d", len(anim.frames)), fmt.Sprintf("duration: %d", anim.duration)}, extra...)
+	var sb strings.Builder
+	sb.WriteString(hexHeader(anim.frames[0], filename, extra...))
+	for i, frame := range anim.frames {
+		sb.WriteString(fmt.Sprintf("# frame: %d\n", i))
+		if d := anim.frameDuration(i); d != anim.duration {
+			sb.WriteString(fmt.Sprintf("# duration: %d\n", d))
+		}
+		if recordBBox {
+			sb.WriteString("# " + bboxField(frame) + "\n")
+		}
+		if recordPivot || alignPivot {
+			sb.WriteString("# " + pivotField(frame) + "\n")
+		}
+		sb.WriteString(hexRows(frame))
+	}
+	return sb.String()
+}
+
+// animationToGIF encodes frames as an animated GIF that loops forever, showing frame i for
+// durations[i] milliseconds. GIF delays are in hundredths of a second.
+func animationToGIF(frames []*indexedImage, durations []int) ([]byte, error) {
+	// The palette is the Spectrum colours, in index order, and a transparent entry.
+	pal := make(color.Palette, 0, len(ZXPalette)+1)
+	for _, c := range ZXPalette {
+		pal = append(pal, c)
+	}
+	clearIndex := len(pal)
+	pal = append(pal, color.RGBA{})
+	g := &gif.GIF{}
+	for i, m := range frames {
+		img := image.NewPaletted(image.Rect(0, 0, m.width, m.height), pal)
+		for j, idx := range m.pix {
+			if idx == transparentIndex {
+				idx = clearIndex
+			}
+			img.Pix[j] = uint8(idx)
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, (durations[i]+5)/10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ansiFrame draws an indexed image for a terminal with 24-bit colour, two pixel rows per line of
+// text: each character is an upper half block in the top pixel's colour on the bottom pixel's.
+// Transparent pixels show the terminal background.
+func ansiFrame(m *indexedImage) string {
+	var sb strings.Builder
+	pixel := func(x, y int) int {
+		if y >= m.height {
+			return transparentIndex
+		}
+		return m.at(x, y)
+	}
+	for y := 0; y < m.height; y += 2 {
+		for x := 0; x < m.width; x++ {
+			top, bottom := pixel(x, y), pixel(x, y+1)
+			switch {
+			case top == transparentIndex && bottom == transparentIndex:
+				sb.WriteString("\x1b[0m ")
+			case top == transparentIndex:
+				c := ZXPalette[bottom]
+				sb.WriteString(fmt.Sprintf("\x1b[0;38;2;%d;%d;%dm▄", c.R, c.G, c.B))
+			default:
+				c := ZXPalette[top]
+				sb.WriteString(fmt.Sprintf("\x1b[0;38;2;%d;%d;%dm", c.R, c.G, c.B))
+				if bottom != transparentIndex {
+					c = ZXPalette[bottom]
+					sb.WriteString(fmt.Sprintf("\x1b[48;2;%d;%d;%dm", c.R, c.G, c.B))
+				}
+				sb.WriteString("▀")
+			}
+		}
+		sb.WriteString("\x1b[0m\n")
+	}
+	return sb.String()
+}
+
+// gifDelayDuration converts a GIF frame delay, in hundredths of a second, to a frame duration.
+// Browsers show frames with no delay for 100 ms, and so does zxtex.
+func gifDelayDuration(delay int) int {
+	if delay <= 0 {
+		return defaultFrameDuration
+	}
+	return delay * 10
+}
+
+// composeGIF draws the frames of a GIF on its logical screen in turn, each in the colours of its
+// own local or global palette, and returns the screen as it stands after each frame. Before the
+// next frame is drawn, a frame is left in place, cleared to transparent or replaced with the screen
+// from before it, as its disposal method says, so optimized GIFs that only store the pixels that
+// change come out whole.
+func composeGIF(g *gif.GIF) []*image.RGBA {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	var screens []*image.RGBA
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		screen := image.NewRGBA(bounds)
+		draw.Draw(screen, bounds, canvas, image.Point{}, draw.Src)
+		screens = append(screens, screen)
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return screens
+}
+
+// decodeGIF decodes the first frame of a GIF as it appears on the logical screen, so a frame
+// smaller than the screen, or placed away from its corner, keeps the screen's size and position.
+func decodeGIF(data []byte) (image.Image, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	g.Image, g.Disposal = g.Image[:1], g.Disposal[:1]
+	return composeGIF(g)[0], nil
+}
+
+// decodeGIFAnimation decodes an animated GIF into an animation, quantizing each frame as it is
+// composed on the canvas, like a still image (see quantizeSource). Each frame keeps its delay as
+// its duration. It returns nil for a GIF with a single frame.
+func decodeGIFAnimation(ctx context.Context, data []byte, chunky bool) (*animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+	anim := &animation{duration: gifDelayDuration(g.Delay[0])}
+	for i, screen := range composeGIF(g) {
+		cropped, err := cropImage(screen)
+		if err != nil {
+			return nil, err
+		}
+		m, _, err := quantizeSource(ctx, cropped, chunky)
+		if err != nil {
+			return nil, err
+		}
+		anim.frames = append(anim.frames, m)
+		anim.frameDurations = append(anim.frameDurations, gifDelayDuration(g.Delay[i]))
+	}
+	return anim, nil
+}
+
+// stackFrames joins the frames of an animation top to bottom into a single image.
+func stackFrames(frames []*indexedImage) *indexedImage {
+	out := newIndexedImage(frames[0].width, frames[0].height*len(frames))
+	for i, frame := range frames {
+		copy(out.pix[i*len(frame.pix):], frame.pix)
+	}
+	return out
+}
+
+// Onion skin review images, for spotting jitter between frames: every frame is drawn in its own
+// colours over ghosts of the frames either side of it, the previous one tinted red and the next
+// one blue, on a grey background. Frames are laid out left to right and enlarged.
+var (
+	onionBackground = color.RGBA{96, 96, 96, 255}
+	onionPrevious   = color.RGBA{255, 64, 64, 255}
+	onionNext       = color.RGBA{64, 160, 255, 255}
+)
+
+// onionScale is the enlargement of onion skin frames.
+const onionScale = 4
+
+// blend mixes colour c into dst at half strength.
+func blend(dst, c color.RGBA) color.RGBA {
+	return color.RGBA{uint8((int(dst.R) + int(c.R)) / 2), uint8((int(dst.G) + int(c.G)) / 2), uint8((int(dst.B) + int(c.B)) / 2), 255}
+}
+
+// onionSkin draws the onion skin review image of an animation's frames.
+func onionSkin(frames []*indexedImage) *image.RGBA {
+	w, h := frames[0].width, frames[0].height
+	gap := onionScale
+	img := image.NewRGBA(image.Rect(0, 0, len(frames)*(w*onionScale+gap)-gap, h*onionScale))
+	for i, frame := range frames {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := onionBackground
+				if idx := frame.at(x, y); idx != transparentIndex {
+					c = ZXPalette[idx]
+				} else {
+					if i > 0 && frames[i-1].at(x, y) != transparentIndex {
+						c = blend(c, onionPrevious)
+					}
+					if i+1 < len(frames) && frames[i+1].at(x, y) != transparentIndex {
+						c = blend(c, onionNext)
+					}
+				}
+				left := i*(w*onionScale+gap) + x*onionScale
+				draw.Draw(img, image.Rect(left, y*onionScale, left+onionScale, (y+1)*onionScale), image.NewUniform(c), image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Sprite atlases: sprites of any size are packed into a single sheet, and a manifest records
+// where each one went. Packing is first-fit decreasing height on shelves, trying every sheet
+// width and keeping the smallest sheet.
+
+// atlasEntry describes one sprite in an atlas manifest.
+type atlasEntry struct {
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	BBox   *bbox  `json:"bbox"` // Bounding box of the solid pixels, relative to the sprite; null when empty.
+}
+
+// atlasManifest is the manifest written alongside an atlas sheet.
+type atlasManifest struct {
+	Width     int          `json:"width"`
+	Height    int          `json:"height"`
+	Sprites   []atlasEntry `json:"sprites"`
+	Generator string       `json:"generator"`
+}
+
+// Atlas packing constraints.
+var (
+	atlasCellAlign bool // Place sprites on 8×8 cell boundaries, so each keeps its own attribute cells.
+	atlasPow2      bool // Round the sheet up to power-of-two dimensions.
+)
+
+// roundUp rounds n up to a multiple of unit.
+func roundUp(n, unit int) int {
+	return (n + unit - 1) / unit * unit
+}
+
+// nextPow2 returns the smallest power of two that is at least n.
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// shelfPack places rectangles on shelves of the given width, tallest first, each on the first
+// shelf with room for it, and returns their positions and the height used.
+func shelfPack(sizes [][2]int, order []int, width int) ([][2]int, int) {
+	type shelf struct{ y, used int }
+	var shelves []shelf
+	pos := make([][2]int, len(sizes))
+	height := 0
+	for _, i := range order {
+		w, h := sizes[i][0], sizes[i][1]
+		placed := false
+		for s := range shelves {
+			// Rectangles come tallest first, so any shelf is tall enough.
+			if shelves[s].used+w <= width {
+				pos[i] = [2]int{shelves[s].used, shelves[s].y}
+				shelves[s].used += w
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			shelves = append(shelves, shelf{y: height, used: w})
+			pos[i] = [2]int{0, height}
+			height += h
+		}
+	}
+	return pos, height
+}
+
+// packAtlas packs sprites into a sheet, honouring the packing constraints, and returns the
+// position of each sprite and the sheet size.
+func packAtlas(sprites []*indexedImage) ([][2]int, int, int) {
+	unit := 1
+	if atlasCellAlign {
+		unit = 8
+	}
+	sizes := make([][2]int, len(sprites))
+	order := make([]int, len(sprites))
+	minWidth, maxWidth := 0, 0
+	for i, m := range sprites {
+		sizes[i] = [2]int{roundUp(m.width, unit), roundUp(m.height, unit)}
+		order[i] = i
+		if sizes[i][0] > minWidth {
+			minWidth = sizes[i][0]
+		}
+		maxWidth += sizes[i][0]
+	}
+	sort.SliceStable(order, func(a, b int) bool { return sizes[order[a]][1] > sizes[order[b]][1] })
+	var best [][2]int
+	bestW, bestH := 0, 0
+	for width := minWidth; width <= maxWidth; width += unit {
+		pos, height := shelfPack(sizes, order, width)
+		w, h := width, height
+		if atlasPow2 {
+			w, h = nextPow2(w), nextPow2(h)
+		}
+		// Prefer the smaller sheet, then the squarer one.
+		if best == nil || w*h < bestW*bestH || w*h == bestW*bestH && abs(w-h) < abs(bestW-bestH) {
+			best, bestW, bestH = pos, w, h
+		}
+	}
+	return best, bestW, bestH
+}
+
+// abs returns the absolute value of n.
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// buildAtlas packs named sprites into a sheet and returns it with its manifest.
+func buildAtlas(names []string, sprites []*indexedImage) (*indexedImage, atlasManifest, error) {
+	if len(sprites) == 0 {
+		return nil, atlasManifest{}, fmt.Errorf("%w: no sprites for the atlas", ErrEmptyData)
+	}
+	pos, w, h := packAtlas(sprites)
+	sheet := newIndexedImage(w, h)
+	manifest := atlasManifest{Width: w, Height: h, Generator: "zxtex"}
+	for i, m := range sprites {
+		for y := 0; y < m.height; y++ {
+			for x := 0; x < m.width; x++ {
+				sheet.set(pos[i][0]+x, pos[i][1]+y, m.at(x, y))
+			}
+		}
+		manifest.Sprites = append(manifest.Sprites, atlasEntry{Name: names[i], X: pos[i][0], Y: pos[i][1], Width: m.width, Height: m.height, BBox: boundingBox(m)})
+	}
+	return sheet, manifest, nil
+}
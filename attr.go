@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ZX Spectrum attribute handling: every 8×8 character cell can show only two colours, INK and PAPER,
+// which share a single BRIGHT bit.
+
+// Attribute settings.
+var (
+	paperColour = 0      // PAPER for transparent pixels and cells without a second colour.
+	brightMode  = "auto" // BRIGHT selection: "auto" (same as "majority"), "majority", "coverage", "on" or "off".
+	flashCells  = false  // Set FLASH in every attribute.
+)
+
+// attrCell describes the colours chosen for one attribute cell.
+type attrCell struct {
+	ink, paper int // Colour numbers 0-7.
+	bright     bool
+	flash      bool
+}
+
+// attrByte returns the cell's attribute byte: FLASH, BRIGHT, PAPER (3 bits), INK (3 bits).
+func (c attrCell) attrByte() byte {
+	b := byte(c.paper<<3 | c.ink)
+	if c.bright {
+		b |= 0x40
+	}
+	if c.flash {
+		b |= 0x80
+	}
+	return b
+}
+
+// index returns the palette index of a cell colour, taking BRIGHT into account.
+func (c attrCell) index(colour int) int {
+	if c.bright {
+		return colour | 8
+	}
+	return colour
+}
+
+// inkIndex returns the palette index of the cell's INK.
+func (c attrCell) inkIndex() int {
+	return c.index(c.ink)
+}
+
+// paperIndex returns the palette index of the cell's PAPER.
+func (c attrCell) paperIndex() int {
+	return c.index(c.paper)
+}
+
+// chooseCellColours picks INK, PAPER and BRIGHT for a cell from its palette indices.
+// Transparent pixels count as defaultPaper. The default paper is kept as PAPER whenever it is
+// one of the two most common colours; otherwise the most common colour becomes PAPER.
+// BRIGHT is chosen according to the bright mode.
+func chooseCellColours(pixels []int, defaultPaper int) attrCell {
+	var counts [8]int
+	for _, idx := range pixels {
+		if idx == transparentIndex {
+			counts[defaultPaper]++
+			continue
+		}
+		counts[idx&7]++
+	}
+
+	// Find the two most common colours; ties go to the lower colour number.
+	first, second := -1, -1
+	for c := 0; c < 8; c++ {
+		if counts[c] == 0 {
+			continue
+		}
+		if first == -1 || counts[c] > counts[first] {
+			first, second = c, first
+		} else if second == -1 || counts[c] > counts[second] {
+			second = c
+		}
+	}
+
+	var cell attrCell
+	switch {
+	case first == -1 || (first == defaultPaper && second == -1):
+		cell.paper = defaultPaper
+		cell.ink = defaultInk(defaultPaper)
+	case second == -1:
+		cell.paper = defaultPaper
+		cell.ink = first
+	case second == defaultPaper:
+		cell.paper = defaultPaper
+		cell.ink = first
+	default:
+		cell.paper = first
+		cell.ink = second
+	}
+	cell.bright, _, _ = chooseBright(pixels, cell)
+	return cell
+}
+
+// brightVotes counts the non-black opaque pixels of a cell that are BRIGHT and that are not.
+// Black looks the same either way, so it does not vote.
+func brightVotes(pixels []int) (bright, normal int) {
+	for _, idx := range pixels {
+		if idx == transparentIndex || idx&7 == 0 {
+			continue
+		}
+		if idx&8 != 0 {
+			bright++
+		} else {
+			normal++
+		}
+	}
+	return bright, normal
+}
+
+// brightCoverage counts the pixels of a cell that would keep their exact colour with the cell's
+// INK and PAPER shown with the given BRIGHT setting. Transparent and black pixels always count.
+func brightCoverage(pixels []int, cell attrCell, bright bool) int {
+	cell.bright = bright
+	covered := 0
+	for _, idx := range pixels {
+		switch {
+		case idx == transparentIndex, idx&7 == 0 && (cell.ink == 0 || cell.paper == 0):
+			covered++
+		case idx == cell.inkIndex(), idx == cell.paperIndex():
+			covered++
+		}
+	}
+	return covered
+}
+
+// chooseBright decides a cell's BRIGHT bit according to the bright mode. It also returns the
+// scores behind the decision for BRIGHT on and off: pixel votes for "majority", preserved
+// pixels for "coverage", and votes for the forced modes. Ties fall back to majority voting,
+// then to BRIGHT off.
+func chooseBright(pixels []int, cell attrCell) (bright bool, onScore, offScore int) {
+	switch brightMode {
+	case "on", "off":
+		onScore, offScore = brightVotes(pixels)
+		return brightMode == "on", onScore, offScore
+	case "coverage":
+		onScore = brightCoverage(pixels, cell, true)
+		offScore = brightCoverage(pixels, cell, false)
+		if onScore == offScore {
+			votesOn, votesOff := brightVotes(pixels)
+			return votesOn > votesOff, onScore, offScore
+		}
+		return onScore > offScore, onScore, offScore
+	default:
+		onScore, offScore = brightVotes(pixels)
+		return onScore > offScore, onScore, offScore
+	}
+}
+
+// defaultInk returns the INK used for cells that contain nothing but paper.
+func defaultInk(paper int) int {
+	if paper == 7 {
+		return 0
+	}
+	return 7
+}
+
+// resolveInCell maps a palette index onto the cell's INK or PAPER, whichever is nearer in RGB space.
+// It reports whether the pixel became INK. Transparent pixels are always PAPER.
+func resolveInCell(idx int, cell attrCell) (int, bool) {
+	if idx == transparentIndex {
+		return cell.paperIndex(), false
+	}
+	ink, paper := cell.inkIndex(), cell.paperIndex()
+	if idx&7 == cell.ink && idx&7 != cell.paper {
+		return ink, true
+	}
+	if idx&7 == cell.paper {
+		return paper, false
+	}
+	pal := ZXPalette[idx]
+	if colourDistance(pal, ZXPalette[ink]) < colourDistance(pal, ZXPalette[paper]) {
+		return ink, true
+	}
+	return paper, false
+}
+
+// cellPixels returns the palette indices of the cell whose top-left corner is (cx, cy),
+// clipped to the image bounds.
+func cellPixels(m *indexedImage, cx, cy, cellW, cellH int) []int {
+	var pixels []int
+	for y := cy; y < cy+cellH && y < m.height; y++ {
+		for x := cx; x < cx+cellW && x < m.width; x++ {
+			pixels = append(pixels, m.at(x, y))
+		}
+	}
+	return pixels
+}
+
+// checkAttributeSettings validates the attribute settings.
+func checkAttributeSettings() error {
+	if paperColour < 0 || paperColour > 7 {
+		return fmt.Errorf("invalid paper colour %d (expected 0-7)", paperColour)
+	}
+	switch brightMode {
+	case "auto", "majority", "coverage", "on", "off":
+		return nil
+	}
+	return fmt.Errorf("unknown bright mode %q (expected majority, coverage, on or off)", brightMode)
+}
+
+// imageAttributes chooses the attribute of every 8×8 cell of an image, row by row, applying the
+// PAPER, BRIGHT and FLASH settings. It returns the cells and the number of cell columns.
+func imageAttributes(m *indexedImage) ([]attrCell, int) {
+	cols := (m.width + 7) / 8
+	var cells []attrCell
+	for cy := 0; cy < m.height; cy += 8 {
+		for cx := 0; cx < m.width; cx += 8 {
+			cell := chooseCellColours(cellPixels(m, cx, cy, 8, 8), paperColour)
+			cell.flash = flashCells
+			cells = append(cells, cell)
+		}
+	}
+	return cells, cols
+}
+
+// writeBrightReport lists the 8×8 cells whose BRIGHT choice was ambiguous: cells mixing BRIGHT and
+// normal pixels, where either setting changes some of them.
+func writeBrightReport(w io.Writer, m *indexedImage) {
+	cols := (m.width + 7) / 8
+	for cy := 0; cy < m.height; cy += 8 {
+		for cx := 0; cx < m.width; cx += 8 {
+			pixels := cellPixels(m, cx, cy, 8, 8)
+			votesOn, votesOff := brightVotes(pixels)
+			if votesOn == 0 || votesOff == 0 {
+				continue
+			}
+			cell := chooseCellColours(pixels, paperColour)
+			_, onScore, offScore := chooseBright(pixels, cell)
+			choice := "off"
+			if cell.bright {
+				choice = "on"
+			}
+			reason := fmt.Sprintf("%s score: on %d, off %d", brightModeName(), onScore, offScore)
+			if brightMode == "on" || brightMode == "off" {
+				reason = "forced"
+			}
+			fmt.Fprintf(w, "cell %d (column %d, row %d): BRIGHT %s (%s; %d bright and %d normal pixels)\n",
+				(cy/8)*cols+cx/8, cx/8, cy/8, choice, reason, votesOn, votesOff)
+		}
+	}
+}
+
+// brightModeName returns the canonical name of the bright mode.
+func brightModeName() string {
+	if brightMode == "auto" {
+		return "majority"
+	}
+	return brightMode
+}
+
+// attributeBytes returns the attribute bytes of an image, one per 8×8 cell in row-major order,
+// and the number of cell columns.
+func attributeBytes(m *indexedImage) ([]byte, int) {
+	cells, cols := imageAttributes(m)
+	data := make([]byte, len(cells))
+	for i, cell := range cells {
+		data[i] = cell.attrByte()
+	}
+	return data, cols
+}
+
+// attributeGrid draws the attributes of an image without its bitmap, for reviewing colour layout:
+// every 8×8 cell filled with its PAPER, with its INK in a 3×3 square in the bottom right corner,
+// and 2×2 markers in the top left corner for BRIGHT and the top right for FLASH. The markers are
+// bright white, or black on light PAPER.
+func attributeGrid(m *indexedImage) *indexedImage {
+	cells, cols := imageAttributes(m)
+	grid := newIndexedImage(cols*8, len(cells)/cols*8)
+	for i, cell := range cells {
+		cx, cy := i%cols*8, i/cols*8
+		marker := 15
+		if cell.paper >= 4 {
+			marker = 0
+		}
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				idx := cell.paperIndex()
+				switch {
+				case x >= 5 && y >= 5:
+					idx = cell.inkIndex()
+				case cell.bright && x < 2 && y < 2, cell.flash && x >= 6 && y < 2:
+					idx = marker
+				}
+				grid.set(cx+x, cy+y, idx)
+			}
+		}
+	}
+	return grid
+}
+
+// attributesToHex formats attribute bytes as text: a header, then one line of two-digit hex bytes
+// per row of cells.
+func attributesToHex(data []byte, cols int, filename string) string {
+	return byteRowsToHex(data, cols, filename)
+}
+
+// byteRowsToHex formats bytes as text: a header, with any extra lines after the dimensions, then
+// one line of two-digit hex bytes per row of cols bytes.
+func byteRowsToHex(data []byte, cols int, filename string, extra ...string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# file: %s\n", filename))
+	sb.WriteString(fmt.Sprintf("# columns: %d\n", cols))
+	sb.WriteString(fmt.Sprintf("# rows: %d\n", len(data)/cols))
+	for _, line := range extra {
+		sb.WriteString("# " + line + "\n")
+	}
+	sb.WriteString("# generator: zxtex\n")
+	for i, b := range data {
+		if lowercaseHex {
+			sb.WriteString(fmt.Sprintf("%02x", b))
+		} else {
+			sb.WriteString(fmt.Sprintf("%02X", b))
+		}
+		if (i+1)%cols == 0 {
+			sb.WriteRune('\n')
+		}
+	}
+	return sb.String()
+}
+
+// clampAttributes restricts each cellW×cellH cell of the image to its chosen INK and PAPER,
+// leaving transparent pixels untouched. It returns the chosen cells in row-major order.
+func clampAttributes(m *indexedImage, cellW, cellH, defaultPaper int) []attrCell {
+	var cells []attrCell
+	for cy := 0; cy < m.height; cy += cellH {
+		for cx := 0; cx < m.width; cx += cellW {
+			cell := chooseCellColours(cellPixels(m, cx, cy, cellW, cellH), defaultPaper)
+			for y := cy; y < cy+cellH && y < m.height; y++ {
+				for x := cx; x < cx+cellW && x < m.width; x++ {
+					if idx := m.at(x, y); idx != transparentIndex {
+						resolved, _ := resolveInCell(idx, cell)
+						m.set(x, y, resolved)
+					}
+				}
+			}
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
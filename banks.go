@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Splitting into banks: binary outputs too large for one 16K bank of the 128K models (or one 8K
+// page of the Next) can be chopped into fixed-size chunks, each written with a _bN suffix, with a
+// JSON index recording where each chunk starts. Every chunk keeps the format's load address, as
+// banks are paged into the same window of memory one at a time. Outputs can also be padded to a
+// multiple of a page or bank size first.
+
+// Bank layout settings.
+var (
+	splitBytes int // Size of the chunks binary outputs are split into; 0 writes them whole.
+	alignBytes int // Pad binary outputs to a multiple of this many bytes; 0 for no padding.
+	padByte    int // Value of the padding bytes added by alignment.
+)
+
+// bankIndex is the index written alongside the chunks of a split output.
+type bankIndex struct {
+	File      string     `json:"file"`
+	Size      int        `json:"size"`
+	BankSize  int        `json:"bank_size"`
+	Banks     []bankFile `json:"banks"`
+	Generator string     `json:"generator"`
+}
+
+// bankFile describes one chunk of a split output.
+type bankFile struct {
+	Index  int    `json:"index"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	File   string `json:"file"`
+}
+
+// checkBankSettings validates the bank layout settings.
+func checkBankSettings() error {
+	if splitBytes < 0 || splitBytes > 0xFFFF {
+		return fmt.Errorf("--split-bytes must be a chunk size from 1 to 65535 bytes, got %d", splitBytes)
+	}
+	if alignBytes < 0 || alignBytes > 0xFFFF {
+		return fmt.Errorf("--align must be a boundary from 1 to 65535 bytes, got %d", alignBytes)
+	}
+	if padByte < 0 || padByte > 0xFF {
+		return fmt.Errorf("--pad-byte must be a byte value from 0 to 255, got %d", padByte)
+	}
+	return nil
+}
+
+// alignData pads data with the pad byte to the next multiple of the alignment.
+func alignData(data []byte) []byte {
+	if alignBytes <= 1 || len(data)%alignBytes == 0 {
+		return data
+	}
+	padded := append([]byte(nil), data...)
+	for len(padded)%alignBytes != 0 {
+		padded = append(padded, byte(padByte))
+	}
+	return padded
+}
+
+// writeBanks writes binary data as chunks of splitBytes bytes (the last may be shorter), each in
+// the way writeBinaryOutput writes whole outputs, then the index.
+func writeBanks(data []byte, output, format, what string) error {
+	index := bankIndex{File: filepath.Base(output), Size: len(data), BankSize: splitBytes, Generator: "zxtex"}
+	for i, offset := 0, 0; offset < len(data) || i == 0; i, offset = i+1, offset+splitBytes {
+		chunk := data[offset:min(offset+splitBytes, len(data))]
+		bankOutput := withSuffix(output, fmt.Sprintf("_b%d", i))
+		if err := writeBinaryFile(chunk, bankOutput, format, fmt.Sprintf("%s (bank %d)", what, i)); err != nil {
+			return err
+		}
+		index.Banks = append(index.Banks, bankFile{Index: i, Offset: offset, Length: len(chunk), File: filepath.Base(bankOutput)})
+	}
+	text, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(output)
+	indexFile := strings.TrimSuffix(output, ext) + "_banks.json"
+	if err := writeOutputFile(indexFile, append(text, '\n')); err != nil {
+		return fmt.Errorf("writing bank index: %w", err)
+	}
+	statusf("Bank index written to %s\n", indexFile)
+	return nil
+}
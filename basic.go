@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Sinclair BASIC program encoding, for the loaders written alongside screens and code files.
+// Keywords are single-byte tokens, and numbers are stored as their digits followed by a hidden
+// five-byte binary form.
+
+// BASIC keyword tokens.
+const (
+	tokenCODE      = 0xAF
+	tokenUSR       = 0xC0
+	tokenBORDER    = 0xE7
+	tokenREM       = 0xEA
+	tokenLOAD      = 0xEF
+	tokenPAUSE     = 0xF2
+	tokenRANDOMIZE = 0xF9
+	tokenCLEAR     = 0xFD
+)
+
+// Loader customisation settings. Each adds a statement to the generated loader; by default it
+// only loads the files and waits for a key.
+var (
+	loaderBorder = -1 // BORDER colour set before loading, or -1 for none.
+	loaderClear  = 0  // Address given to CLEAR before loading, or 0 for none.
+	loaderUSR    = -1 // Address called with RANDOMIZE USR once loaded, instead of waiting for a key; -1 for none.
+	loaderREM    = "" // Banner kept in a REM line at the top of the loader.
+)
+
+// checkLoaderSettings validates the loader customisation settings.
+func checkLoaderSettings() error {
+	custom := loaderBorder >= 0 || loaderClear != 0 || loaderUSR >= 0 || loaderREM != ""
+	if custom && !writeLoader {
+		return fmt.Errorf("--loader-border, --loader-clear, --loader-usr and --loader-rem need --loader")
+	}
+	if loaderBorder < -1 || loaderBorder > 7 {
+		return fmt.Errorf("--loader-border must be a colour from 0 to 7, got %d", loaderBorder)
+	}
+	if loaderClear < 0 || loaderClear > 0xFFFF {
+		return fmt.Errorf("--loader-clear must be an address from 0 to 65535, got %d", loaderClear)
+	}
+	if loaderUSR < -1 || loaderUSR > 0xFFFF {
+		return fmt.Errorf("--loader-usr must be an address from 0 to 65535, got %d", loaderUSR)
+	}
+	for _, r := range loaderREM {
+		if r < 0x20 || r > 0x7E {
+			return fmt.Errorf("--loader-rem must be printable ASCII text")
+		}
+	}
+	return nil
+}
+
+// basicNumber encodes a small non-negative integer literal.
+func basicNumber(n int) []byte {
+	b := append([]byte(strconv.Itoa(n)), 0x0E, 0x00, 0x00, 0x00, 0x00, 0x00)
+	binary.LittleEndian.PutUint16(b[len(b)-3:], uint16(n))
+	return b
+}
+
+// basicString encodes a string literal.
+func basicString(s string) []byte {
+	return append(append([]byte{'"'}, s...), '"')
+}
+
+// basicLine encodes a program line from its tokens and literals.
+func basicLine(number int, parts ...[]byte) []byte {
+	var body []byte
+	for _, part := range parts {
+		body = append(body, part...)
+	}
+	body = append(body, 0x0D)
+	line := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(line, uint16(number)) // Line numbers are stored big-endian.
+	binary.LittleEndian.PutUint16(line[2:], uint16(len(body)))
+	return append(line, body...)
+}
+
+// loaderProgram returns a program that loads each named CODE file in turn, then waits for a key,
+// so a loaded screen stays on display. The loader settings add a REM banner, set the border (as
+// --border does, unless --loader-border is given) and CLEAR before loading, and call machine
+// code instead of waiting.
+func loaderProgram(names []string) []byte {
+	var prog []byte
+	line := 10
+	add := func(parts ...[]byte) {
+		prog = append(prog, basicLine(line, parts...)...)
+		line += 10
+	}
+	if loaderREM != "" {
+		add([]byte{tokenREM}, []byte(loaderREM))
+	}
+	if border := loaderBorder; border >= 0 || borderColour >= 0 {
+		if border < 0 {
+			border = borderColour
+		}
+		add([]byte{tokenBORDER}, basicNumber(border))
+	}
+	if loaderClear != 0 {
+		add([]byte{tokenCLEAR}, basicNumber(loaderClear))
+	}
+	for _, name := range names {
+		add([]byte{tokenLOAD}, basicString(name), []byte{tokenCODE})
+	}
+	if loaderUSR >= 0 {
+		add([]byte{tokenRANDOMIZE, tokenUSR}, basicNumber(loaderUSR))
+	} else {
+		add([]byte{tokenPAUSE}, basicNumber(0))
+	}
+	return prog
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Batch conversion: several inputs, or whole directories of them, converted one after another.
+// Inputs are processed in a fixed order so repeated runs produce identical results.
+
+// isDir reports whether the path names a directory.
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// batchExtensions lists the file types picked up when a directory is given as input.
+var batchExtensions = map[string]bool{
+	".png":  true,
+	".gif":  true,
+	".bmp":  true,
+	".pcx":  true,
+	".iff":  true,
+	".ilbm": true,
+	".lbm":  true,
+	".tga":  true,
+	".scr":  true,
+	".hex":  true,
+	".txt":  true,
+}
+
+// expandInputs replaces directory and zip archive arguments with the convertible files they
+// contain, sorted by name. Other arguments are kept in command-line order.
+func expandInputs(args []string) ([]string, error) {
+	var inputs []string
+	for _, arg := range args {
+		if isZip(arg) {
+			names, err := readArchive(arg)
+			if err != nil {
+				return nil, err
+			}
+			inputs = append(inputs, names...)
+			continue
+		}
+		if !isDir(arg) {
+			inputs = append(inputs, arg)
+			continue
+		}
+		// os.ReadDir returns entries sorted by filename, independent of the filesystem.
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !batchExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+				continue
+			}
+			inputs = append(inputs, filepath.Join(arg, entry.Name()))
+		}
+	}
+	return inputs, nil
+}
+
+// runBatch converts every input to a file in outDir (the current directory when empty),
+// reporting failures as it goes, and duplicate outputs at the end. It returns the number of
+// failed conversions; once ctx is cancelled the remaining inputs are skipped and counted as
+// failed.
+func runBatch(ctx context.Context, inputs []string, outDir string) int {
+	if outDir != "" && zipOutput == "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return len(inputs)
+		}
+	}
+	failed := 0
+	for i, input := range inputs {
+		if err := ctx.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v (skipping %d remaining inputs)\n", err, len(inputs)-i)
+			return failed + len(inputs) - i
+		}
+		err := convertCached(ctx, input, "", outDir, true)
+		if err == nil && duplicateMode != "" {
+			err = recordDuplicates(writtenFiles)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", input, err)
+			failed++
+			writtenFiles = nil
+			continue
+		}
+		recordDeps(input)
+	}
+	reportDuplicates()
+	return failed
+}
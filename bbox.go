@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Bounding boxes: the tight box around the solid (non-transparent) pixels of a sprite or frame,
+// which engines use for cheap broad-phase collision tests and for centring sprites.
+
+// recordBBox adds bounding boxes to the headers of hex and source outputs.
+var recordBBox bool
+
+// bbox is a bounding box, in pixels from the top-left corner of the image.
+type bbox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// boundingBox returns the bounding box of the solid pixels of an image, or nil when it has none.
+func boundingBox(m *indexedImage) *bbox {
+	minX, minY, maxX, maxY := m.width, m.height, -1, -1
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			if m.at(x, y) == transparentIndex {
+				continue
+			}
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+			if y < minY {
+				minY = y
+			}
+			maxY = y
+		}
+	}
+	if maxX < 0 {
+		return nil
+	}
+	return &bbox{X: minX, Y: minY, Width: maxX - minX + 1, Height: maxY - minY + 1}
+}
+
+// bboxField formats a bounding box as a header field: "bbox: x,y,width,height", or "bbox: empty"
+// for an image with no solid pixels.
+func bboxField(m *indexedImage) string {
+	b := boundingBox(m)
+	if b == nil {
+		return "bbox: empty"
+	}
+	return fmt.Sprintf("bbox: %d,%d,%d,%d", b.X, b.Y, b.Width, b.Height)
+}
+
+// bboxReport is the JSON bounding box report of an image or animation.
+type bboxReport struct {
+	Source    string  `json:"source"`
+	Width     int     `json:"width"`
+	Height    int     `json:"height"`
+	BBox      *bbox   `json:"bbox"`             // Of the image, or of all frames together; null when empty.
+	Frames    []*bbox `json:"frames,omitempty"` // Of each frame of an animation.
+	Generator string  `json:"generator"`
+}
+
+// bboxJSON reports the bounding boxes of an image, or, given the frames of an animation, of each
+// frame and of all of them together.
+func bboxJSON(m *indexedImage, frames []*indexedImage, filename string) (string, error) {
+	report := bboxReport{Source: filename, Width: m.width, Height: m.height, BBox: boundingBox(m), Generator: "zxtex"}
+	if frames != nil {
+		first := frames[0]
+		union := newIndexedImage(first.width, first.height)
+		for _, frame := range frames {
+			report.Frames = append(report.Frames, boundingBox(frame))
+			for i, idx := range frame.pix {
+				if idx != transparentIndex {
+					union.pix[i] = idx
+				}
+			}
+		}
+		report.Width, report.Height, report.BBox = first.width, first.height, boundingBox(union)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"math/bits"
+)
+
+// 32-bit BMPs: the x/image decoder only takes the fourth byte of each pixel as alpha when the file
+// has a V4 or V5 header with the standard channel masks, so the alpha channel Windows tools write
+// with the short BITMAPINFOHEADER is lost, files with other channel masks are refused, and V4 or V5
+// files whose fourth byte is unused padding (left at zero) come out fully transparent. zxtex reads
+// these files itself: alpha is taken from the alpha mask, or from the fourth byte when the file
+// has no masks, unless it is zero for every pixel, in which case it is padding and the image is
+// opaque. Other BMPs are left to x/image.
+
+// BMP compression methods.
+const (
+	bmpRGB            = 0
+	bmpBitfields      = 3
+	bmpAlphaBitfields = 6
+)
+
+// BMP colour space types, in the CSType field of V4 and V5 headers.
+const (
+	bmpCalibratedRGB = 0
+	bmpSRGB          = 0x73524742 // 'sRGB'
+	bmpWindowsSpace  = 0x57696e20 // 'Win '
+	bmpLinkedProfile = 0x4c494e4b // 'LINK'
+	bmpEmbedded      = 0x4d424544 // 'MBED'
+)
+
+// bmpHeader holds the fields of a BMP file header and its info header that zxtex uses.
+type bmpHeader struct {
+	offset      int // Of the pixel data, from the start of the file.
+	size        int // Of the info header.
+	width       int
+	height      int
+	topDown     bool
+	bpp         int
+	compression uint32
+	masks       [4]uint32 // Red, green, blue and alpha; alpha is 0 when the file has none.
+}
+
+// parseBMPHeader reads the headers of a BMP file.
+func parseBMPHeader(data []byte) (*bmpHeader, error) {
+	if len(data) < 18 || string(data[:2]) != "BM" {
+		return nil, fmt.Errorf("%w: not a BMP file", ErrUnsupportedFormat)
+	}
+	h := &bmpHeader{offset: int(binary.LittleEndian.Uint32(data[10:])), size: int(binary.LittleEndian.Uint32(data[14:]))}
+	if h.size < 40 || len(data) < 14+h.size {
+		return nil, fmt.Errorf("%w: BMP info header of %d bytes", ErrUnsupportedFormat, h.size)
+	}
+	h.width = int(int32(binary.LittleEndian.Uint32(data[18:])))
+	h.height = int(int32(binary.LittleEndian.Uint32(data[22:])))
+	if h.height < 0 {
+		h.height, h.topDown = -h.height, true
+	}
+	h.bpp = int(binary.LittleEndian.Uint16(data[28:]))
+	h.compression = binary.LittleEndian.Uint32(data[30:])
+	switch {
+	case h.compression == bmpRGB:
+		h.masks = [4]uint32{0xff0000, 0xff00, 0xff, 0xff000000}
+	case h.compression == bmpBitfields || h.compression == bmpAlphaBitfields:
+		// Masks are part of V2 and later headers, and follow a BITMAPINFOHEADER.
+		n := 3
+		if h.compression == bmpAlphaBitfields || h.size >= 56 {
+			n = 4
+		}
+		if len(data) < 54+4*n {
+			return nil, fmt.Errorf("%w: truncated BMP channel masks", ErrUnsupportedFormat)
+		}
+		for i := 0; i < n; i++ {
+			h.masks[i] = binary.LittleEndian.Uint32(data[54+4*i:])
+		}
+	}
+	return h, nil
+}
+
+// isAlphaBMP reports whether zxtex decodes a BMP file itself: one with 32 bits per pixel,
+// uncompressed or described by channel masks.
+func isAlphaBMP(data []byte) bool {
+	h, err := parseBMPHeader(data)
+	return err == nil && h.bpp == 32 && (h.compression == bmpRGB || h.compression == bmpBitfields || h.compression == bmpAlphaBitfields)
+}
+
+// maskChannel extracts the channel a mask selects from a pixel, scaled to 8 bits.
+func maskChannel(v, mask uint32) uint8 {
+	if mask == 0 {
+		return 0
+	}
+	shift := bits.TrailingZeros32(mask)
+	max := mask >> shift
+	return uint8((uint64((v&mask)>>shift)*255 + uint64(max)/2) / uint64(max))
+}
+
+// decodeAlphaBMP decodes a 32-bit BMP file, keeping its alpha channel.
+func decodeAlphaBMP(data []byte) (image.Image, error) {
+	h, err := parseBMPHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImageSize("BMP", h.width, h.height); err != nil {
+		return nil, err
+	}
+	stride := h.width * 4
+	if h.offset < 0 || h.offset > len(data) || h.height > (len(data)-h.offset)/stride {
+		return nil, fmt.Errorf("%w: truncated BMP pixel data", ErrUnsupportedFormat)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, h.width, h.height))
+	hasAlpha := false
+	for y := 0; y < h.height; y++ {
+		row := data[h.offset+y*stride:]
+		if !h.topDown {
+			row = data[h.offset+(h.height-1-y)*stride:]
+		}
+		p := img.Pix[y*img.Stride:]
+		for x := 0; x < h.width; x++ {
+			v := binary.LittleEndian.Uint32(row[4*x:])
+			p[4*x] = maskChannel(v, h.masks[0])
+			p[4*x+1] = maskChannel(v, h.masks[1])
+			p[4*x+2] = maskChannel(v, h.masks[2])
+			p[4*x+3] = maskChannel(v, h.masks[3])
+			hasAlpha = hasAlpha || p[4*x+3] != 0
+		}
+	}
+	if !hasAlpha {
+		// No alpha mask, or an alpha channel left at zero throughout: the fourth byte is padding.
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img, nil
+}
+
+// bmpColourProfile returns the colour profile a BMP file declares, or nil when its values are
+// sRGB. Only V4 and V5 headers declare one; embedded ICC profiles are read like those of PNG files,
+// and calibrated or linked colour spaces are reported as not understood.
+func bmpColourProfile(data []byte) (*colourProfile, error) {
+	h, err := parseBMPHeader(data)
+	if err != nil || h.size < 108 {
+		return nil, nil
+	}
+	switch binary.LittleEndian.Uint32(data[70:]) {
+	case bmpSRGB, bmpWindowsSpace:
+		return nil, nil
+	case bmpEmbedded:
+		if h.size < 124 {
+			break
+		}
+		// The profile's offset is counted from the start of the info header.
+		offset := 14 + int(binary.LittleEndian.Uint32(data[126:]))
+		size := int(binary.LittleEndian.Uint32(data[130:]))
+		if offset+size > len(data) || size <= 0 {
+			return nil, fmt.Errorf("%w: truncated embedded ICC profile", ErrUnsupportedFormat)
+		}
+		return parseICC(data[offset : offset+size])
+	case bmpCalibratedRGB:
+		return nil, fmt.Errorf("%w: calibrated BMP colour spaces are not understood", ErrUnsupportedFormat)
+	case bmpLinkedProfile:
+		return nil, fmt.Errorf("%w: linked BMP colour profiles are not read", ErrUnsupportedFormat)
+	}
+	return nil, fmt.Errorf("%w: unknown BMP colour space", ErrUnsupportedFormat)
+}
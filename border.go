@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Border colour: a loading screen shown with the wrong border looks wrong, so --border N records
+// the border colour meant for an image as a "# border: N" field in hex headers, and the outputs
+// that can set a border use it: sna and z80 snapshots store it in their headers, Interface 2 ROMs
+// set it at boot, and the tape and disk loader sets it with BORDER before loading, when
+// --loader-border does not say otherwise, so the border returns to it once the loading stripes
+// stop. Hex inputs with a recorded border keep it when --border is not given. SCR files have no
+// room for a border.
+
+// borderColour is the --border setting, or -1 for none.
+var borderColour = -1
+
+// checkBorderSettings validates --border.
+func checkBorderSettings() error {
+	if borderColour < -1 || borderColour > 7 {
+		return fmt.Errorf("--border must be a colour from 0 to 7, got %d", borderColour)
+	}
+	return nil
+}
+
+// sourceBorder returns the border colour of a source: the --border setting, else the one recorded
+// in its header, else -1.
+func sourceBorder(src *source) int {
+	if borderColour >= 0 {
+		return borderColour
+	}
+	if n, err := strconv.Atoi(src.meta["border"]); err == nil && n >= 0 && n <= 7 {
+		return n
+	}
+	return -1
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Byte report: --byte-report describes every binary output on standard error, to predict how well
+// it will compress and to spot conversions that came out noisier than intended: its Shannon
+// entropy in bits per byte (0 for a single repeated value, 8 for data no packer can shrink), how
+// many distinct values it holds, a histogram of the most common ones and its longest runs of one
+// value, with their offsets.
+
+// byteReport enables the byte report.
+var byteReport bool
+
+// Byte report sizes.
+const (
+	reportValues = 16 // Values shown in the histogram.
+	reportRuns   = 5  // Runs listed.
+	reportBar    = 40 // Width of the longest histogram bar.
+)
+
+// byteRun is a run of one byte value.
+type byteRun struct {
+	value          byte
+	offset, length int
+}
+
+// byteEntropy returns the Shannon entropy of byte counts totalling n, in bits per byte.
+func byteEntropy(counts [256]int, n int) float64 {
+	var h float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(n)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// longestRuns returns the longest runs of one value in data, longest first and, among runs of
+// the same length, first first.
+func longestRuns(data []byte, max int) []byteRun {
+	var runs []byteRun
+	for i := 0; i < len(data); {
+		j := i + 1
+		for j < len(data) && data[j] == data[i] {
+			j++
+		}
+		if j-i > 1 {
+			runs = append(runs, byteRun{data[i], i, j - i})
+		}
+		i = j
+	}
+	sort.SliceStable(runs, func(a, b int) bool { return runs[a].length > runs[b].length })
+	if len(runs) > max {
+		runs = runs[:max]
+	}
+	return runs
+}
+
+// writeByteReport prints the byte report of data written to name.
+func writeByteReport(w io.Writer, name string, data []byte) {
+	fmt.Fprintf(w, "Bytes of %s (%d bytes):\n", name, len(data))
+	if len(data) == 0 {
+		return
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	values := make([]int, 0, 256)
+	for v, c := range counts {
+		if c > 0 {
+			values = append(values, v)
+		}
+	}
+	sort.SliceStable(values, func(a, b int) bool { return counts[values[a]] > counts[values[b]] })
+	h := byteEntropy(counts, len(data))
+	fmt.Fprintf(w, "  entropy %.2f bits per byte (%.1f%%), %d distinct values\n", h, 100*h/8, len(values))
+	if len(values) > reportValues {
+		fmt.Fprintf(w, "  most common %d values:\n", reportValues)
+		values = values[:reportValues]
+	}
+	top := counts[values[0]]
+	for _, v := range values {
+		bar := (counts[v]*reportBar + top - 1) / top
+		fmt.Fprintf(w, "  $%02X %6d %5.1f%% %s\n", v, counts[v], 100*float64(counts[v])/float64(len(data)), strings.Repeat("#", bar))
+	}
+	runs := longestRuns(data, reportRuns)
+	if len(runs) == 0 {
+		fmt.Fprintf(w, "  no byte is repeated in a row\n")
+		return
+	}
+	fmt.Fprintf(w, "  longest runs:\n")
+	for _, r := range runs {
+		fmt.Fprintf(w, "  $%02X x %d at offset %d\n", r.value, r.length, r.offset)
+	}
+}
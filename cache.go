@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Incremental conversion: with --cache, each conversion is recorded in a cache file under a hash
+// of everything it depends on (the input's content, the conversion settings, any palette file or
+// snapshot template, and the zxtex binary itself), with a hash of every file it wrote. A later
+// run skips inputs whose hash is unchanged and whose outputs are still as written, so rebuilding
+// a large project only converts what changed.
+
+// cacheFile is the cache of conversions; empty for none.
+var cacheFile string
+
+// cacheSettings are the conversion settings, as set from the command line, that go into every
+// conversion's hash.
+var cacheSettings []string
+
+// cacheEntry records a conversion of an input.
+type cacheEntry struct {
+	Key     string            `json:"key"`
+	Outputs map[string]string `json:"outputs"` // Digest of each file written.
+	Launch  string            `json:"launch,omitempty"`
+}
+
+// conversionCache is the contents of a cache file, by input.
+type conversionCache struct {
+	Inputs map[string]cacheEntry `json:"inputs"`
+}
+
+var (
+	cache       *conversionCache // The cache, once loaded.
+	cacheDirty  bool             // Whether the cache has changed since it was loaded.
+	toolDigest  string           // Digest of the running executable.
+	cacheHits   int              // Conversions skipped as up to date.
+	cacheMisses int              // Conversions run.
+)
+
+// checkCacheSettings rejects --cache with outputs that do not go to files.
+func checkCacheSettings() error {
+	if cacheFile == "" {
+		return nil
+	}
+	if outputToStdout || zipOutput != "" {
+		return fmt.Errorf("--cache needs output files; it cannot be used with --output - or --zip")
+	}
+	return nil
+}
+
+// fileDigest returns the SHA-256 digest of a file.
+func fileDigest(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// loadCache reads the cache file, starting an empty cache when there is none yet.
+func loadCache() error {
+	cache = &conversionCache{Inputs: map[string]cacheEntry{}}
+	exe, err := os.Executable()
+	if err == nil {
+		toolDigest, err = fileDigest(exe)
+	}
+	if err != nil {
+		return fmt.Errorf("reading the zxtex executable for --cache: %w", err)
+	}
+	data, err := os.ReadFile(cacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		return fmt.Errorf("reading cache %s: %w", cacheFile, err)
+	}
+	if cache.Inputs == nil {
+		cache.Inputs = map[string]cacheEntry{}
+	}
+	return nil
+}
+
+// conversionKey hashes everything a conversion of input depends on. Inputs that are not files,
+// such as standard input and direct strings, have no key and are never cached.
+func conversionKey(input, output, outDir string) (string, bool) {
+	data, err := readInput(input)
+	if input == stdinName || err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "zxtex %s\noutput %q %q\n", toolDigest, output, outDir)
+	for _, setting := range cacheSettings {
+		fmt.Fprintf(h, "%s\n", setting)
+	}
+	for _, file := range []string{paletteName, snapshotTemplate, attrFile, constraintMaskFile, sliceFile} {
+		if file == "" || !fileExists(file) {
+			continue // A built-in palette, or a file setting left unset.
+		}
+		digest, err := fileDigest(file)
+		if err != nil {
+			return "", false
+		}
+		fmt.Fprintf(h, "file %s\n", digest)
+	}
+	fmt.Fprintf(h, "input %x\n", sha256.Sum256(data))
+	return fmt.Sprintf("%x", h.Sum(nil)), true
+}
+
+// upToDate reports whether the outputs recorded for a conversion are all still as written.
+func (e cacheEntry) upToDate() bool {
+	if len(e.Outputs) == 0 {
+		return false
+	}
+	for file, digest := range e.Outputs {
+		if got, err := fileDigest(file); err != nil || got != digest {
+			return false
+		}
+	}
+	return true
+}
+
+// convertCached converts an input as convertWithHooks does, unless the cache shows that its
+// outputs are already up to date. Skipped conversions still count their outputs as written, for
+// dependency rules and duplicate detection.
+func convertCached(ctx context.Context, input, output, outDir string, toFile bool) error {
+	if cacheFile == "" {
+		return convertWithHooks(ctx, input, output, outDir, toFile)
+	}
+	key, cacheable := conversionKey(input, output, outDir)
+	if e, ok := cache.Inputs[input]; cacheable && ok && e.Key == key && e.upToDate() {
+		outputs := make([]string, 0, len(e.Outputs))
+		for file := range e.Outputs {
+			outputs = append(outputs, file)
+		}
+		sort.Strings(outputs)
+		writtenFiles = append(writtenFiles, outputs...)
+		if e.Launch != "" {
+			launchFile = e.Launch
+		}
+		statusf("%s is up to date\n", input)
+		cacheHits++
+		return nil
+	}
+	cacheMisses++
+	if _, ok := cache.Inputs[input]; ok {
+		delete(cache.Inputs, input)
+		cacheDirty = true
+	}
+	first, previousLaunch := len(writtenFiles), launchFile
+	launchFile = ""
+	err := convertWithHooks(ctx, input, output, outDir, toFile)
+	launch := launchFile
+	if launch == "" {
+		launchFile = previousLaunch
+	}
+	if err != nil {
+		return err
+	}
+	if !cacheable || len(writtenFiles) == first {
+		return nil
+	}
+	e := cacheEntry{Key: key, Outputs: map[string]string{}, Launch: launch}
+	for _, file := range writtenFiles[first:] {
+		digest, err := fileDigest(file)
+		if err != nil {
+			return fmt.Errorf("recording %s in the cache: %w", file, err)
+		}
+		e.Outputs[file] = digest
+	}
+	cache.Inputs[input] = e
+	cacheDirty = true
+	return nil
+}
+
+// saveCache writes the cache file, when it has changed, and reports how many conversions were
+// skipped.
+func saveCache() error {
+	if cacheFile == "" {
+		return nil
+	}
+	if cacheHits > 0 {
+		statusf("%d of %d conversions were up to date\n", cacheHits, cacheHits+cacheMisses)
+	}
+	if !cacheDirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	files := writtenFiles
+	err = writeFileAtomic(cacheFile, append(data, '\n'))
+	writtenFiles = files // The cache is not an output of any conversion.
+	if err != nil {
+		return fmt.Errorf("writing cache: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sprite catalogues: a single self-contained HTML page showing every hex file of a project, with
+// a preview (animated, for animations) and the figures that matter when budgeting memory, for
+// reviewing a whole asset set at a glance.
+
+// catalogEntry is one file of a catalogue.
+type catalogEntry struct {
+	name          string
+	width, height int    // Size of a frame, in pixels.
+	frames        int    // Number of frames; 1 for still images.
+	fileSize      int64  // Size of the hex file, in bytes.
+	preview       string // Data URI of the preview image.
+	err           error  // Why the file could not be read, if it could not.
+}
+
+// bitmapBytes is the size of the entry's bitmap data, as the bin format packs it.
+func (e catalogEntry) bitmapBytes() int {
+	return (e.width + 7) / 8 * e.height * e.frames
+}
+
+// attributeBytes is the size of the entry's attribute data, one byte per 8×8 cell.
+func (e catalogEntry) attributeBytes() int {
+	return (e.width + 7) / 8 * ((e.height + 7) / 8) * e.frames
+}
+
+// newCatalogEntry describes a loaded hex file, with a PNG preview, or a GIF for animations.
+func newCatalogEntry(name string, src *source, fileSize int64) (catalogEntry, error) {
+	e := catalogEntry{name: name, fileSize: fileSize, frames: 1}
+	if src.anim != nil {
+		frames := screenFrames(src)
+		var durations []int
+		for i := range frames {
+			durations = append(durations, src.anim.frameDuration(i))
+		}
+		data, err := animationToGIF(frames, durations)
+		if err != nil {
+			return e, err
+		}
+		e.width, e.height, e.frames = frames[0].width, frames[0].height, len(frames)
+		e.preview = "data:image/gif;base64," + base64.StdEncoding.EncodeToString(data)
+		return e, nil
+	}
+	m := src.image
+	if src.chunky {
+		m = chunkyToScreen(m)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderIndexed(m)); err != nil {
+		return e, err
+	}
+	e.width, e.height = m.width, m.height
+	e.preview = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	return e, nil
+}
+
+// catalogInputs lists the hex files under the given files and directories, which are searched
+// recursively, in filename order.
+func catalogInputs(args []string) ([]string, error) {
+	var inputs []string
+	for _, arg := range args {
+		if !isDir(arg) {
+			inputs = append(inputs, arg)
+			continue
+		}
+		// filepath.WalkDir visits entries in lexical order.
+		err := filepath.WalkDir(arg, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".hex", ".txt":
+				if !d.IsDir() {
+					inputs = append(inputs, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return inputs, nil
+}
+
+// catalogHTML renders a catalogue page with previews enlarged scale times.
+func catalogHTML(title string, entries []catalogEntry, scale int) string {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	sb.WriteString(fmt.Sprintf("<title>%s</title>\n", html.EscapeString(title)))
+	sb.WriteString(`<style>
+body { font-family: sans-serif; background: #202020; color: #e0e0e0; margin: 2em; }
+.grid { display: flex; flex-wrap: wrap; gap: 1em; align-items: flex-start; }
+.card { background: #303030; padding: 0.75em; border-radius: 4px; max-width: 100%; }
+.card img { display: block; image-rendering: pixelated; max-width: 100%; height: auto; margin-bottom: 0.5em;
+  background: repeating-conic-gradient(#505050 0% 25%, #404040 0% 50%) 0 0 / 16px 16px; }
+.name { font-weight: bold; word-break: break-all; }
+.info { font-size: 0.85em; color: #a0a0a0; }
+.error { color: #ff6060; }
+</style>
+</head>
+<body>
+`)
+	total := 0
+	for _, e := range entries {
+		if e.err == nil {
+			total += e.bitmapBytes() + e.attributeBytes()
+		}
+	}
+	noun := "files"
+	if len(entries) == 1 {
+		noun = "file"
+	}
+	sb.WriteString(fmt.Sprintf("<h1>%s</h1>\n<p>%d %s, %d bytes of bitmap and attribute data.</p>\n<div class=\"grid\">\n", html.EscapeString(title), len(entries), noun, total))
+	for _, e := range entries {
+		sb.WriteString("<div class=\"card\">\n")
+		if e.err != nil {
+			sb.WriteString(fmt.Sprintf("<div class=\"name\">%s</div>\n<div class=\"error\">%s</div>\n", html.EscapeString(e.name), html.EscapeString(e.err.Error())))
+			sb.WriteString("</div>\n")
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("<img src=\"%s\" width=\"%d\" height=\"%d\" alt=\"%s\">\n", e.preview, e.width*scale, e.height*scale, html.EscapeString(e.name)))
+		sb.WriteString(fmt.Sprintf("<div class=\"name\">%s</div>\n", html.EscapeString(e.name)))
+		frames := "1 frame"
+		if e.frames > 1 {
+			frames = fmt.Sprintf("%d frames", e.frames)
+		}
+		sb.WriteString(fmt.Sprintf("<div class=\"info\">%d×%d, %s<br>%d bytes bitmap, %d bytes attributes<br>%d bytes on disk</div>\n",
+			e.width, e.height, frames, e.bitmapBytes(), e.attributeBytes(), e.fileSize))
+		sb.WriteString("</div>\n")
+	}
+	sb.WriteString("</div>\n</body>\n</html>\n")
+	return sb.String()
+}
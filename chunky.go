@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/draw"
+)
+
+// Chunky "low-res" mode: the screen is treated as 128×96 chunky pixels, each one a 2×2 block of
+// screen pixels, so every 8×8 attribute cell holds 4×4 chunky pixels sharing one INK and PAPER.
+
+// chunkySize is the size, in screen pixels, of one chunky pixel.
+const chunkySize = 2
+
+// chunkyCell is the size, in chunky pixels, of one attribute cell.
+const chunkyCell = 8 / chunkySize
+
+// downsampleChunky averages each 2×2 block of an image into a single palette index.
+// A block is transparent when at least half of its pixels are.
+func downsampleChunky(ctx context.Context, img image.Image) (*indexedImage, error) {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	w := (bounds.Dx() + chunkySize - 1) / chunkySize
+	h := (bounds.Dy() + chunkySize - 1) / chunkySize
+	m := newIndexedImage(w, h)
+	for cy := 0; cy < h; cy++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for cx := 0; cx < w; cx++ {
+			var sumR, sumG, sumB uint32
+			opaque, total := uint32(0), 0
+			for y := cy * chunkySize; y < (cy+1)*chunkySize && y < bounds.Dy(); y++ {
+				for x := cx * chunkySize; x < (cx+1)*chunkySize && x < bounds.Dx(); x++ {
+					total++
+					r, g, b, a := rgba.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					if shouldBeTransparent(r, g, b, a) {
+						continue
+					}
+					sumR += r
+					sumG += g
+					sumB += b
+					opaque++
+				}
+			}
+			if int(opaque)*2 <= total {
+				continue
+			}
+			m.set(cx, cy, nearestColor(sumR/opaque, sumG/opaque, sumB/opaque))
+		}
+	}
+	return m, nil
+}
+
+// imageToChunky converts an image into chunky pixels constrained to two colours per attribute cell.
+func imageToChunky(ctx context.Context, img image.Image) (*indexedImage, error) {
+	m, err := downsampleChunky(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	clampAttributes(m, chunkyCell, chunkyCell, paperColour)
+	return m, nil
+}
+
+// chunkyToScreen expands chunky pixel data to full screen resolution.
+func chunkyToScreen(m *indexedImage) *indexedImage {
+	return scaleIndexed(m, chunkySize)
+}
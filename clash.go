@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Attribute clash: a cell that shows more than two colours, or mixes BRIGHT and normal colours,
+// cannot be displayed as drawn. The clash report suggests the attribute that keeps the most of
+// each such cell, and how many pixels fixing it would change.
+
+// clashReport enables the attribute clash report on standard error.
+var clashReport bool
+
+// bestCellPair returns the INK, PAPER and BRIGHT combination that keeps the most pixels of a cell
+// at their exact colour, and the number of pixels it would change. Ties go to BRIGHT off, then to
+// the lower PAPER and INK.
+func bestCellPair(pixels []int) (attrCell, int) {
+	var best attrCell
+	bestKept := -1
+	for _, bright := range []bool{false, true} {
+		for paper := 0; paper < 8; paper++ {
+			for ink := 0; ink < 8; ink++ {
+				if ink == paper {
+					continue
+				}
+				cell := attrCell{ink: ink, paper: paper}
+				if kept := brightCoverage(pixels, cell, bright); kept > bestKept {
+					cell.bright = bright
+					best, bestKept = cell, kept
+				}
+			}
+		}
+	}
+	return best, len(pixels) - bestKept
+}
+
+// writeClashReport lists the 8×8 cells that cannot be shown as drawn, with the best INK, PAPER
+// and BRIGHT for each and the number of pixels that would change, followed by a summary.
+func writeClashReport(w io.Writer, m *indexedImage) {
+	cols := (m.width + 7) / 8
+	clashes, changed := 0, 0
+	for cy := 0; cy < m.height; cy += 8 {
+		for cx := 0; cx < m.width; cx += 8 {
+			pixels := cellPixels(m, cx, cy, 8, 8)
+			cell, n := bestCellPair(pixels)
+			if n == 0 {
+				continue
+			}
+			bright := "off"
+			if cell.bright {
+				bright = "on"
+			}
+			fmt.Fprintf(w, "cell %d (column %d, row %d): INK %d PAPER %d BRIGHT %s changes %d of %d pixels\n",
+				(cy/8)*cols+cx/8, cx/8, cy/8, cell.ink, cell.paper, bright, n, len(pixels))
+			clashes++
+			changed += n
+		}
+	}
+	fmt.Fprintf(w, "%d cells clash; fixing them changes %d pixels\n", clashes, changed)
+}
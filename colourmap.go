@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// Colour mapping: artists often paint with off-palette working colours that stand for a precise
+// palette entry, such as an orange meant as bright red. --map "#ff8800>A,#404040>0" names them:
+// every pixel of exactly that colour becomes that index (a hex digit, as in hex data), whatever
+// the nearest colour would be. Mapped pixels are given their index's colour before levels,
+// k-means and quantization see them, and are set to the index once the image is quantized, so
+// neither dithering nor attribute cells move them. Images resampled with --fit-screen or read as
+// chunky pixels only get the recolouring, as their pixels no longer line up with the source's.
+
+// colourMapStr is the --map setting; colourMap is parsed from it.
+var (
+	colourMapStr string
+	colourMap    map[color.RGBA]int
+)
+
+// checkColourMapSettings parses --map.
+func checkColourMapSettings() error {
+	colourMap = nil
+	if colourMapStr == "" {
+		return nil
+	}
+	colourMap = map[color.RGBA]int{}
+	for _, entry := range strings.Split(colourMapStr, ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(entry), ">")
+		if !ok {
+			return fmt.Errorf("invalid --map entry %q (expected #rrggbb>N, e.g. #ff8800>A)", entry)
+		}
+		c, err := parseWebColor(strings.TrimSpace(from))
+		if err != nil {
+			return fmt.Errorf("invalid --map entry %q: %v", entry, err)
+		}
+		idx, err := strconv.ParseUint(strings.TrimSpace(to), 16, 8)
+		if err != nil || int(idx) >= len(ZXPalette) {
+			return fmt.Errorf("invalid --map entry %q: %q is not a palette index (0 to F)", entry, to)
+		}
+		colourMap[c] = int(idx)
+	}
+	return nil
+}
+
+// mapColours recolours the mapped pixels of an image to their indices' colours. It returns the
+// new image and the index each pixel is mapped to, row by row, or transparentIndex for pixels
+// --map does not name; with no pixel mapped, the image is returned as it is, with no indices.
+func mapColours(img image.Image) (image.Image, []int) {
+	if colourMap == nil {
+		return img, nil
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	var forced []int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := nrgba.NRGBAAt(x, y)
+			idx, ok := colourMap[color.RGBA{c.R, c.G, c.B, 255}]
+			if !ok || c.A == 0 {
+				continue
+			}
+			if forced == nil {
+				forced = make([]int, bounds.Dx()*bounds.Dy())
+				for i := range forced {
+					forced[i] = transparentIndex
+				}
+			}
+			forced[(y-bounds.Min.Y)*bounds.Dx()+x-bounds.Min.X] = idx
+			p := ZXPalette[idx]
+			nrgba.SetNRGBA(x, y, color.NRGBA{p.R, p.G, p.B, c.A})
+		}
+	}
+	if forced == nil {
+		return img, nil
+	}
+	return nrgba, forced
+}
+
+// forceMapped sets the mapped pixels of a quantized image to their indices; transparent pixels
+// stay transparent.
+func forceMapped(m *indexedImage, forced []int) {
+	if len(forced) != len(m.pix) {
+		return
+	}
+	for i, idx := range forced {
+		if idx != transparentIndex && m.pix[i] != transparentIndex {
+			m.pix[i] = idx
+		}
+	}
+}
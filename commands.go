@@ -0,0 +1,550 @@
+//go:build !js
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subcommands: tools run as "zxtex <command> [flags]" instead of converting inputs. Each parses
+// its own flags.
+
+// commands maps subcommand names to their implementations.
+var commands = map[string]func(args []string) error{
+	"palette-chart": paletteChartCommand,
+	"pattern":       patternCommand,
+	"random":        randomCommand,
+	"play":          playCommand,
+	"atlas":         atlasCommand,
+	"blocks":        blocksCommand,
+	"build":         buildCommand,
+	"catalog":       catalogCommand,
+	"fmt":           fmtCommand,
+	"unpack":        unpackCommand,
+}
+
+// outputFlags adds the overwrite protection flags to a command that writes files.
+func outputFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&forceOverwrite, "force", false, "Overwrite existing output files, including hex text files")
+	fs.BoolVar(&noClobber, "no-clobber", false, "Never overwrite an existing output file")
+}
+
+// paletteChartCommand renders the selected palette as a labelled swatch image and prints the
+// index to RGB mapping.
+func paletteChartCommand(args []string) error {
+	fs := flag.NewFlagSet("palette-chart", flag.ExitOnError)
+	outputFlags(fs)
+	fs.StringVar(&paletteName, "palette", paletteName, "Palette: spectrum, ulaplus, next or a palette file")
+	output := fs.String("output", "palette.png", "Chart image filename (- for standard output)")
+	if len(parseArgs(fs, args)) > 0 {
+		return fmt.Errorf("palette-chart takes no inputs")
+	}
+	pal, err := loadPalette(paletteName)
+	if err != nil {
+		return err
+	}
+	outputToStdout = *output == stdoutName
+	if err := saveImage(paletteChart(pal), *output); err != nil {
+		return fmt.Errorf("saving chart: %w", err)
+	}
+	statusf("%s", paletteListing(pal))
+	if !outputToStdout {
+		statusf("Chart saved as %s\n", *output)
+	}
+	return nil
+}
+
+// patternCommand generates a test pattern, written as hex data and a PNG image by default.
+func patternCommand(args []string) error {
+	fs := flag.NewFlagSet("pattern", flag.ExitOnError)
+	outputFlags(fs)
+	size := fs.String("size", "256x192", "Pattern size in pixels, as WxH")
+	format := fs.String("format", "hex,png", "Output formats, separated by commas")
+	output := fs.String("output", "", "Output filename; each format gets its own extension")
+	outDir := fs.String("outdir", "", "Directory for output files")
+	names := parseArgs(fs, args)
+	if len(names) != 1 {
+		return fmt.Errorf("usage: zxtex pattern %s [--size WxH]", strings.Join(patternNames, "|"))
+	}
+	name := names[0]
+	w, h, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	m, err := generatePattern(name, w, h)
+	if err != nil {
+		return err
+	}
+	outputFormat = *format
+	formats, err := outputFormats()
+	if err != nil {
+		return err
+	}
+	outputToStdout = *output == stdoutName
+	// The pattern is written as if it had been converted from an image named after it.
+	src := &source{image: m, meta: map[string]string{"file": name + ".png"}, fromImage: true}
+	return writeSource(src, formats, *output, *outDir, true)
+}
+
+// randomCommand generates seeded random sprites or noise. Each image is named after its style and
+// seed, so any one of a run can be regenerated on its own.
+func randomCommand(args []string) error {
+	fs := flag.NewFlagSet("random", flag.ExitOnError)
+	outputFlags(fs)
+	size := fs.String("size", "16x16", "Image size in pixels, as WxH")
+	seed := fs.Int64("seed", 0, "Random seed; 0 picks one from the clock")
+	count := fs.Int("count", 1, "Number of images, with consecutive seeds")
+	format := fs.String("format", "hex,png", "Output formats, separated by commas")
+	output := fs.String("output", "", "Output filename, for a single image; each format gets its own extension")
+	outDir := fs.String("outdir", "", "Directory for output files")
+	styles := parseArgs(fs, args)
+	if len(styles) != 1 {
+		return fmt.Errorf("usage: zxtex random %s [--size WxH] [--seed N] [--count N]", strings.Join(randomStyles, "|"))
+	}
+	w, h, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	if *count < 1 {
+		return fmt.Errorf("count must be at least 1")
+	}
+	if *output != "" && *count > 1 {
+		return fmt.Errorf("--output names a single file; use --outdir when generating several images")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	outputFormat = *format
+	formats, err := outputFormats()
+	if err != nil {
+		return err
+	}
+	outputToStdout = *output == stdoutName
+	for i := int64(0); i < int64(*count); i++ {
+		m, err := randomImage(styles[0], w, h, *seed+i)
+		if err != nil {
+			return err
+		}
+		src := &source{image: m, meta: map[string]string{"file": fmt.Sprintf("%s_%d.png", styles[0], *seed+i)}, fromImage: true}
+		if err := writeSource(src, formats, *output, *outDir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// playCommand loops a multi-frame hex animation in the terminal, with the frame timing recorded in
+// the file, until it is interrupted or has played the requested number of times.
+func playCommand(args []string) error {
+	fs := flag.NewFlagSet("play", flag.ExitOnError)
+	fps := fs.Int("fps", 0, "Frames per second; 0 uses the timing recorded in the file")
+	loops := fs.Int("loops", 0, "Number of times to play the animation; 0 loops until interrupted")
+	inputs := parseArgs(fs, args)
+	if len(inputs) != 1 {
+		return fmt.Errorf("usage: zxtex play anim.hex [--fps N] [--loops N]")
+	}
+	data, err := readInput(inputs[0])
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	anim, err := parseAnimation(ctx, string(data))
+	if err != nil {
+		return fmt.Errorf("reading animation: %w", err)
+	}
+	lines := (anim.frames[0].height + 1) / 2
+	fmt.Print("\x1b[?25l") // Hide the cursor while playing.
+	defer fmt.Print("\x1b[?25h")
+	for loop := 0; *loops == 0 || loop < *loops; loop++ {
+		for i, frame := range anim.frames {
+			if loop > 0 || i > 0 {
+				fmt.Printf("\x1b[%dA", lines) // Draw over the previous frame.
+			}
+			fmt.Print(ansiFrame(frame))
+			delay := time.Duration(anim.frameDuration(i)) * time.Millisecond
+			if *fps > 0 {
+				delay = time.Second / time.Duration(*fps)
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(delay):
+			}
+		}
+	}
+	return nil
+}
+
+// atlasCommand packs sprites of any size into a single sheet, written as hex data and a PNG image
+// by default, with a JSON manifest of where each sprite went.
+func atlasCommand(args []string) error {
+	fs := flag.NewFlagSet("atlas", flag.ExitOnError)
+	outputFlags(fs)
+	fs.BoolVar(&atlasCellAlign, "cell-align", false, "Place sprites on 8x8 cell boundaries")
+	fs.BoolVar(&atlasPow2, "pow2", false, "Round the sheet up to power-of-two dimensions")
+	format := fs.String("format", "hex,png", "Sheet formats, separated by commas")
+	output := fs.String("output", "", "Sheet filename (default atlas); each format gets its own extension")
+	outDir := fs.String("outdir", "", "Directory for output files")
+	inputs, err := expandInputs(parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("usage: zxtex atlas <sprite>... [--cell-align] [--pow2]")
+	}
+	outputFormat = *format
+	all, err := outputFormats()
+	if err != nil {
+		return err
+	}
+	// Engine metadata describes the packing, so it is written from the manifest, not the sheet.
+	var formats, engineFormats []string
+	for _, f := range all {
+		if isEngineFormat(f) {
+			engineFormats = append(engineFormats, f)
+		} else {
+			formats = append(formats, f)
+		}
+	}
+	if formats == nil && engineFormats != nil {
+		formats = []string{"png"} // The sheet the metadata describes.
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var names []string
+	var sprites []*indexedImage
+	for _, input := range inputs {
+		src, err := loadSource(ctx, input, 0, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", input, err)
+		}
+		m := src.image
+		if src.chunky {
+			m = chunkyToScreen(m)
+		}
+		base := filepath.Base(input)
+		names = append(names, strings.TrimSuffix(base, filepath.Ext(base)))
+		sprites = append(sprites, m)
+	}
+	sheet, manifest, err := buildAtlas(names, sprites)
+	if err != nil {
+		return err
+	}
+	src := &source{image: sheet, meta: map[string]string{"file": "atlas.png"}, fromImage: true}
+	if err := writeSource(src, formats, *output, *outDir, true); err != nil {
+		return err
+	}
+	manifestName := filepath.Join(*outDir, "atlas.json")
+	if *output != "" {
+		manifestName = strings.TrimSuffix(*output, filepath.Ext(*output)) + ".json"
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeOutputFile(manifestName, append(data, '\n')); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	statusf("Manifest written to %s\n", manifestName)
+	// The TexturePacker description sits beside the manifest and names the PNG sheet.
+	base := strings.TrimSuffix(manifestName, ".json")
+	data, err = texturePackerJSON(manifest, filepath.Base(base)+".png")
+	if err != nil {
+		return err
+	}
+	tpName := base + "_texturepacker.json"
+	if err := writeOutputFile(tpName, append(data, '\n')); err != nil {
+		return fmt.Errorf("writing TexturePacker atlas: %w", err)
+	}
+	statusf("TexturePacker atlas written to %s\n", tpName)
+	for _, f := range engineFormats {
+		text, err := engineText(atlasSheet(manifest, filepath.Base(base)+".png"), f)
+		if err != nil {
+			return err
+		}
+		if err := writeTextOutput(text, base+outputExtension(f), "Engine metadata"); err != nil {
+			return fmt.Errorf("writing engine metadata: %w", err)
+		}
+	}
+	return nil
+}
+
+// unpackCommand converts every frame of TexturePacker JSON atlases into a sprite of its own.
+func unpackCommand(args []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	outputFlags(fs)
+	format := fs.String("format", "hex", "Sprite formats, separated by commas")
+	outDir := fs.String("outdir", "", "Directory for output files")
+	inputs := parseArgs(fs, args)
+	if len(inputs) == 0 {
+		return fmt.Errorf("usage: zxtex unpack <atlas.json>... [--format hex] [--outdir dir]")
+	}
+	outputFormat = *format
+	formats, err := outputFormats()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for _, input := range inputs {
+		atlas, err := readTexturePacker(input)
+		if err != nil {
+			return err
+		}
+		sheet, err := loadSource(ctx, atlas.image, 0, false)
+		if err != nil {
+			return fmt.Errorf("%s: %w", atlas.image, err)
+		}
+		m := sheet.image
+		if sheet.chunky {
+			m = chunkyToScreen(m)
+		}
+		for _, f := range atlas.frames {
+			sprite, err := f.cut(m)
+			if err != nil {
+				return fmt.Errorf("%s: %w", input, err)
+			}
+			name := f.name()
+			src := &source{name: input, image: sprite, meta: map[string]string{"file": name}, fromImage: true, header: f.header()}
+			if err := writeSource(src, formats, "", *outDir, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// catalogCommand writes an HTML gallery of the hex files in the given directories.
+func catalogCommand(args []string) error {
+	fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+	outputFlags(fs)
+	output := fs.String("output", "catalog.html", "Catalogue filename")
+	title := fs.String("title", "Sprite catalogue", "Page title")
+	scale := fs.Int("scale", 3, "Enlargement of the previews")
+	inputs, err := catalogInputs(parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("usage: zxtex catalog <dir|file>... [--output catalog.html] [--title T] [--scale N]")
+	}
+	if *scale < 1 {
+		return fmt.Errorf("--scale must be at least 1")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	var entries []catalogEntry
+	failed := 0
+	for _, input := range inputs {
+		// Files that cannot be read are listed with the reason, so one bad file does not hide
+		// the rest of the project.
+		entry := catalogEntry{name: input}
+		info, err := os.Stat(input)
+		if err == nil {
+			var src *source
+			if src, err = loadSource(ctx, input, 0, false); err == nil {
+				entry, err = newCatalogEntry(input, src, info.Size())
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			entry.err = err
+			failed++
+		}
+		entries = append(entries, entry)
+	}
+	if err := writeOutputFile(*output, []byte(catalogHTML(*title, entries, *scale))); err != nil {
+		return fmt.Errorf("writing catalogue: %w", err)
+	}
+	statusf("Catalogue of %d files written to %s\n", len(entries), *output)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be read", failed, len(entries))
+	}
+	return nil
+}
+
+// fmtCommand rewrites hex files in canonical form: printed to standard output by default, written
+// back with --write, or only checked with --check, which lists the files that are not canonical.
+func fmtCommand(args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := fs.Bool("write", false, "Write the result back to each file instead of printing it")
+	check := fs.Bool("check", false, "List the files that are not in canonical form, and fail if there are any")
+	width := fs.Int("width", 0, "Row width, for files without a header width or to change it")
+	fs.IntVar(&hexGroup, "group", 0, "Insert a space every N digits of each row")
+	fs.BoolVar(&lowercaseHex, "lowercase", false, "Write hex digits in lowercase")
+	fs.BoolVar(&annotateHex, "annotate", false, "Add a column ruler and row number comments")
+	inputs := parseArgs(fs, args)
+	if len(inputs) == 0 {
+		return fmt.Errorf("usage: zxtex fmt <file.hex>... [--write|--check] [--width N] [--group N] [--lowercase] [--annotate]")
+	}
+	if *write && *check {
+		return fmt.Errorf("--write and --check cannot be combined")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	failed, unformatted := 0, 0
+	for _, input := range inputs {
+		formatted, err := formatHex(ctx, input, *width)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", input, err)
+			failed++
+			continue
+		}
+		switch {
+		case *check || *write:
+			data, err := readInput(input)
+			if err != nil {
+				return err
+			}
+			if string(data) == formatted {
+				continue
+			}
+			unformatted++
+			if *check {
+				fmt.Println(input)
+				continue
+			}
+			if err := writeFileAtomic(input, []byte(formatted)); err != nil {
+				return fmt.Errorf("writing %s: %w", input, err)
+			}
+			statusf("Formatted %s\n", input)
+		default:
+			fmt.Print(formatted)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files could not be formatted", failed, len(inputs))
+	}
+	if *check && unformatted > 0 {
+		return fmt.Errorf("%d of %d files are not in canonical form", unformatted, len(inputs))
+	}
+	return nil
+}
+
+// blocksCommand lists the blocks of tape images.
+func blocksCommand(args []string) error {
+	fs := flag.NewFlagSet("blocks", flag.ExitOnError)
+	inputs := parseArgs(fs, args)
+	if len(inputs) == 0 {
+		return fmt.Errorf("usage: zxtex blocks <tape>...")
+	}
+	for _, input := range inputs {
+		data, err := readInput(input)
+		if err != nil {
+			return err
+		}
+		blocks, err := parseTape(data)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", input, err)
+		}
+		if len(inputs) > 1 {
+			fmt.Printf("%s:\n", input)
+		}
+		fmt.Print(tapeListing(blocks))
+	}
+	return nil
+}
+
+// buildCommand runs every conversion declared in a recipe file. Each runs as a separate zxtex
+// process, since conversion settings are global, several at a time; relative paths are taken
+// from the recipe's directory. The output of each is printed in recipe order.
+func buildCommand(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	jobs := fs.Int("jobs", runtime.NumCPU(), "Number of conversions to run at once")
+	dryRun := fs.Bool("dry-run", false, "Print the conversions without running them")
+	inputs := parseArgs(fs, args)
+	if len(inputs) != 1 {
+		return fmt.Errorf("usage: zxtex build <recipe> [--jobs N] [--dry-run]")
+	}
+	if *jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
+	data, err := ioutil.ReadFile(inputs[0])
+	if err != nil {
+		return err
+	}
+	assets, err := parseRecipe(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", inputs[0], err)
+	}
+	if *dryRun {
+		for _, asset := range assets {
+			fmt.Println("zxtex " + strings.Join(asset.args, " "))
+		}
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	type result struct {
+		output []byte
+		err    error
+		done   chan struct{}
+	}
+	results := make([]result, len(assets))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+	for w := 0; w < *jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				cmd := exec.CommandContext(ctx, exe, assets[i].args...)
+				cmd.Dir = filepath.Dir(inputs[0])
+				results[i].output, results[i].err = cmd.CombinedOutput()
+				close(results[i].done)
+			}
+		}()
+	}
+	go func() {
+		for i := range assets {
+			queue <- i
+		}
+		close(queue)
+	}()
+
+	failed := 0
+	for i, asset := range assets {
+		<-results[i].done
+		fmt.Printf("%s:\n", strings.Join(asset.inputs, " "))
+		os.Stdout.Write(results[i].output)
+		if results[i].err != nil {
+			failed++
+		}
+	}
+	wg.Wait()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d assets failed", failed, len(assets))
+	}
+	if len(assets) == 1 {
+		fmt.Println("Built 1 asset")
+	} else {
+		fmt.Printf("Built %d assets\n", len(assets))
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+//go:build !js
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Shell completion: "zxtex completion bash|zsh|fish" prints a completion script covering the
+// subcommands, the conversion flags and the values of the flags that take a fixed set of them,
+// such as formats and palette names. Other arguments complete as filenames.
+
+// The completion command lists the commands map, so it is added to it here, after the map is
+// initialised, rather than in the map itself.
+func init() {
+	commands["completion"] = completionCommand
+}
+
+// completionValues returns the values offered for each flag that takes one of a fixed set.
+func completionValues() map[string][]string {
+	formats := make([]string, 0, len(formatExtensions))
+	for format := range formatExtensions {
+		formats = append(formats, format)
+	}
+	blockTypes := make([]string, 0, len(agdBlockTypes))
+	for blockType := range agdBlockTypes {
+		blockTypes = append(blockTypes, blockType)
+	}
+	return map[string][]string{
+		"format":         formats,
+		"palette":        {"spectrum", "ulaplus", "next"},
+		"type":           {"auto", "image", "scr", "tap", "tzx", "hex", "raw"},
+		"pixfmt":         {"rgb24", "rgba32"},
+		"quantize":       {"nearest", "cell"},
+		"dither":         {"none", "ordered", "blue-noise", "floyd-steinberg"},
+		"bright":         {"majority", "coverage", "on", "off"},
+		"set-bright":     {"on", "off"},
+		"compress":       {"compare"},
+		"order":          {"row", "column", "screen"},
+		"bitorder":       {"msb", "lsb"},
+		"pad":            {"right", "left", "error"},
+		"pad-bit":        {"0", "1"},
+		"variants":       {"4dir", "8dir", "mirror"},
+		"variant-layout": {"files", "strip"},
+		"scroll":         {"left", "right", "up", "down"},
+		"mask-mode":      {"pixel", "erode", "cell"},
+		"hex-style":      {"dollar", "0x", "decimal"},
+		"block-type":     blockTypes,
+		"run":            {"fuse", "zesarux"},
+	}
+}
+
+// completionFlag is a conversion flag as the completion scripts see it.
+type completionFlag struct {
+	name, usage string
+	takesValue  bool
+	values      []string // Fixed values, sorted; empty for free values such as numbers and files.
+}
+
+// completionFlags lists the conversion flags, by name.
+func completionFlags() []completionFlag {
+	values := completionValues()
+	var flags []completionFlag
+	flag.VisitAll(func(f *flag.Flag) {
+		isBool := false
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = b.IsBoolFlag()
+		}
+		v := append([]string(nil), values[f.Name]...)
+		sort.Strings(v)
+		flags = append(flags, completionFlag{name: f.Name, usage: f.Usage, takesValue: !isBool, values: v})
+	})
+	return flags
+}
+
+// commandNames lists the subcommands, sorted.
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bashCompletion returns a completion script for bash.
+func bashCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	var names []string
+	for _, f := range flags {
+		names = append(names, "--"+f.name)
+	}
+	sb.WriteString("# bash completion for zxtex; load with: source <(zxtex completion bash)\n")
+	sb.WriteString("_zxtex() {\n")
+	sb.WriteString("\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	sb.WriteString(fmt.Sprintf("\tif [[ $COMP_CWORD -eq 1 && $cur != -* ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\") $(compgen -f -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(commandNames(), " ")))
+	sb.WriteString("\tcase \"$prev\" in\n")
+	for _, f := range flags {
+		if len(f.values) > 0 {
+			sb.WriteString(fmt.Sprintf("\t--%s) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", f.name, strings.Join(f.values, " ")))
+		}
+	}
+	sb.WriteString("\tesac\n")
+	sb.WriteString(fmt.Sprintf("\tif [[ $cur == -* ]]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(names, " ")))
+	sb.WriteString("\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n")
+	sb.WriteString("}\n")
+	sb.WriteString("complete -o filenames -F _zxtex zxtex\n")
+	return sb.String()
+}
+
+// zshCompletion returns a completion script for zsh.
+func zshCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	sb.WriteString("#compdef zxtex\n")
+	sb.WriteString("# zsh completion for zxtex; load with: source <(zxtex completion zsh)\n")
+	sb.WriteString("_zxtex() {\n")
+	sb.WriteString(fmt.Sprintf("\tif (( CURRENT == 2 )) && [[ $words[2] != -* ]]; then\n\t\t_alternative 'commands:command:(%s)' 'files:file:_files'\n\t\treturn\n\tfi\n", strings.Join(commandNames(), " ")))
+	sb.WriteString("\tcase $words[CURRENT-1] in\n")
+	for _, f := range flags {
+		if len(f.values) > 0 {
+			sb.WriteString(fmt.Sprintf("\t--%s) compadd -- %s; return ;;\n", f.name, strings.Join(f.values, " ")))
+		}
+	}
+	sb.WriteString("\tesac\n")
+	sb.WriteString("\tif [[ $words[CURRENT] == -* ]]; then\n\t\tlocal -a flags\n\t\tflags=(\n")
+	for _, f := range flags {
+		usage := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:").Replace(f.usage)
+		sb.WriteString(fmt.Sprintf("\t\t\t'--%s:%s'\n", f.name, usage))
+	}
+	sb.WriteString("\t\t)\n\t\t_describe flag flags\n\telse\n\t\t_files\n\tfi\n")
+	sb.WriteString("}\n")
+	sb.WriteString("compdef _zxtex zxtex\n")
+	return sb.String()
+}
+
+// fishCompletion returns a completion script for fish.
+func fishCompletion(flags []completionFlag) string {
+	var sb strings.Builder
+	quote := strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace
+	sb.WriteString("# fish completion for zxtex; load with: zxtex completion fish | source\n")
+	sb.WriteString(fmt.Sprintf("complete -c zxtex -n __fish_use_subcommand -a '%s'\n", strings.Join(commandNames(), " ")))
+	for _, f := range flags {
+		line := fmt.Sprintf("complete -c zxtex -l %s", f.name)
+		switch {
+		case len(f.values) > 0:
+			line += fmt.Sprintf(" -x -a '%s'", strings.Join(f.values, " "))
+		case f.takesValue:
+			line += " -r"
+		}
+		sb.WriteString(line + fmt.Sprintf(" -d '%s'\n", quote(f.usage)))
+	}
+	return sb.String()
+}
+
+// completionCommand prints a completion script for the given shell.
+func completionCommand(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	shells := parseArgs(fs, args)
+	if len(shells) != 1 {
+		return fmt.Errorf("usage: zxtex completion bash|zsh|fish")
+	}
+	flags := completionFlags()
+	switch shells[0] {
+	case "bash":
+		fmt.Print(bashCompletion(flags))
+	case "zsh":
+		fmt.Print(zshCompletion(flags))
+	case "fish":
+		fmt.Print(fishCompletion(flags))
+	default:
+		return fmt.Errorf("unknown shell %q (expected bash, zsh or fish)", shells[0])
+	}
+	return nil
+}
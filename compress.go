@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Compression comparison: --compress compare packs every binary output with three packers common on
+// the Spectrum and prints a table of their sizes on standard error, with a rough estimate of how
+// long the standard Z80 decompressor of each takes, so the right one can be chosen for each asset;
+// the files themselves are written uncompressed. RLE is PackBits-style: a control byte n is
+// followed by n+1 literal bytes when below 128, or by one byte repeated 257-n times otherwise. ZX0
+// and ZX7 are Einar Saukas's LZ77 formats; their sizes are estimates from zxtex's own port of the
+// optimal parse their compressors use, and have not been checked against those compressors. The
+// time estimate counts 21 T-states for each byte written (as LDIR copies it) and, for ZX0 and ZX7,
+// 16 for each bit of the stream that is not literal data, or for RLE, 40 for each control byte.
+
+// compressMode is the --compress setting: "compare", or empty.
+var compressMode string
+
+// Z80 decompression cost estimates, in T-states.
+const (
+	copyTStates  = 21 // Per byte written.
+	bitTStates   = 16 // Per control bit of a ZX0 or ZX7 stream.
+	blockTStates = 40 // Per RLE control byte.
+	z80Clock     = 3500000
+)
+
+// checkCompressSettings validates --compress.
+func checkCompressSettings() error {
+	switch compressMode {
+	case "", "compare":
+		return nil
+	}
+	return fmt.Errorf("unknown --compress mode %q (expected compare)", compressMode)
+}
+
+// eliasGammaBits returns the length of the Elias gamma code of a positive value.
+func eliasGammaBits(value int) int {
+	bits := 1
+	for value >>= 1; value > 0; value >>= 1 {
+		bits += 2
+	}
+	return bits
+}
+
+// rleSize returns the size of data packed with PackBits-style RLE, and how many blocks it takes.
+// Runs of three or more bytes are repeated; anything else is sent as literals.
+func rleSize(data []byte) (size, blocks int) {
+	literals := 0
+	for i := 0; i < len(data); {
+		run := 1
+		for i+run < len(data) && run < 128 && data[i+run] == data[i] {
+			run++
+		}
+		if run >= 3 {
+			if literals > 0 {
+				size, blocks, literals = size+1+literals, blocks+1, 0
+			}
+			size, blocks = size+2, blocks+1
+			i += run
+			continue
+		}
+		literals++
+		if literals == 128 {
+			size, blocks, literals = size+1+literals, blocks+1, 0
+		}
+		i++
+	}
+	if literals > 0 {
+		size, blocks = size+1+literals, blocks+1
+	}
+	return size, blocks
+}
+
+// lzCost is the cost of the best encoding found of the data up to some position: its length in
+// bits, and how many of them are literal bytes.
+type lzCost struct {
+	bits, literals int
+}
+
+// control returns the bits of an encoding that are not literal data.
+func (c lzCost) control() int {
+	return c.bits - 8*c.literals
+}
+
+// matchLengths picks, for a match ending at some position, which length up to the longest possible
+// is cheapest, given the cost of the encoding before it and of the length's Elias gamma code. The
+// choice does not depend on the offset, so it is worked out once for each position and length.
+type matchLengths struct {
+	best []int // best[n] is the cheapest length up to n.
+	size int   // The longest length worked out so far.
+}
+
+// newMatchLengths returns a matchLengths for data of n bytes.
+func newMatchLengths(n int) *matchLengths {
+	ml := &matchLengths{best: make([]int, n+2)}
+	ml.best[2] = 2
+	return ml
+}
+
+// reset starts again at a new position.
+func (ml *matchLengths) reset() {
+	ml.size = 2
+}
+
+// upTo returns the cheapest length up to max for a match ending at index.
+func (ml *matchLengths) upTo(max, index int, optimal []lzCost) int {
+	if ml.size < max {
+		bits := optimal[index-ml.best[ml.size]].bits + eliasGammaBits(ml.best[ml.size]-1)
+		for ml.size < max {
+			ml.size++
+			if b := optimal[index-ml.size].bits + eliasGammaBits(ml.size-1); b <= bits {
+				ml.best[ml.size], bits = ml.size, b
+			} else {
+				ml.best[ml.size] = ml.best[ml.size-1]
+			}
+		}
+	}
+	return ml.best[max]
+}
+
+// zx7Cost returns the cost of data compressed as ZX7, whose stream starts with a literal byte
+// and then has a bit before each block: 0 for a literal byte, 1 for a match with an Elias gamma
+// length and a 7- or 11-bit offset. An end marker of 18 bits finishes it.
+func zx7Cost(data []byte) lzCost {
+	const maxOffset = 2176
+	n := len(data)
+	optimal := make([]lzCost, n)
+	optimal[0] = lzCost{8, 1}
+	matchLength := make([]int, maxOffset+1)
+	ml := newMatchLengths(n)
+	for i := 1; i < n; i++ {
+		optimal[i] = lzCost{optimal[i-1].bits + 9, optimal[i-1].literals + 1}
+		ml.reset()
+		for offset := 1; offset <= maxOffset && offset <= i; offset++ {
+			if data[i] != data[i-offset] {
+				matchLength[offset] = 0
+				continue
+			}
+			if matchLength[offset]++; matchLength[offset] < 2 {
+				continue
+			}
+			length := ml.upTo(matchLength[offset], i, optimal)
+			offsetBits := 8
+			if offset > 128 {
+				offsetBits = 12
+			}
+			prev := optimal[i-length]
+			if bits := prev.bits + 1 + offsetBits + eliasGammaBits(length-1); bits < optimal[i].bits {
+				optimal[i] = lzCost{bits, prev.literals}
+			}
+		}
+	}
+	end := optimal[n-1]
+	end.bits += 18
+	return end
+}
+
+// zx0Cost returns the cost of data compressed as ZX0, whose blocks are literals, matches at a new
+// offset, and matches at the offset of the last match, which may only follow literals. Each has
+// an Elias gamma length, and new offsets a gamma-coded high part and a byte. This follows the
+// optimal parse of Einar Saukas's compressor, which keeps, for every offset, the best encoding
+// ending with literals and the best ending with a match at that offset. An end marker of 18 bits
+// finishes the stream.
+func zx0Cost(data []byte) lzCost {
+	const offsetLimit = 32640
+	n := len(data)
+	// A block is the best encoding found ending at index with literals, or with a match, at some
+	// offset; an index of -2 means there is none yet.
+	type block struct {
+		cost  lzCost
+		index int
+	}
+	optimal := make([]lzCost, n)
+	lastLiteral := make([]block, offsetLimit+1)
+	lastMatch := make([]block, offsetLimit+1)
+	for i := range lastLiteral {
+		lastLiteral[i].index, lastMatch[i].index = -2, -2
+	}
+	matchLength := make([]int, offsetLimit+1)
+	ml := newMatchLengths(n)
+	// The stream starts with literals at offset 1, without the bit that would say so.
+	lastMatch[1] = block{lzCost{-1, 0}, -1}
+	for index := 0; index < n; index++ {
+		ml.reset()
+		best := lzCost{bits: -1}
+		maxOffset := index
+		if maxOffset > offsetLimit {
+			maxOffset = offsetLimit
+		} else if maxOffset < 1 {
+			maxOffset = 1
+		}
+		for offset := 1; offset <= maxOffset; offset++ {
+			if index != 0 && index >= offset && data[index] == data[index-offset] {
+				// A match at the last offset.
+				if lit := &lastLiteral[offset]; lit.index != -2 {
+					c := lzCost{lit.cost.bits + 1 + eliasGammaBits(index-lit.index), lit.cost.literals}
+					lastMatch[offset] = block{c, index}
+					if best.bits < 0 || c.bits < best.bits {
+						best = c
+					}
+				}
+				// A match at a new offset.
+				if matchLength[offset]++; matchLength[offset] > 1 {
+					length := ml.upTo(matchLength[offset], index, optimal)
+					prev := optimal[index-length]
+					c := lzCost{prev.bits + 8 + eliasGammaBits((offset-1)/128+1) + eliasGammaBits(length-1), prev.literals}
+					if m := &lastMatch[offset]; m.index != index || m.cost.bits > c.bits {
+						*m = block{c, index}
+						if best.bits < 0 || c.bits < best.bits {
+							best = c
+						}
+					}
+				}
+				continue
+			}
+			matchLength[offset] = 0
+			if m := &lastMatch[offset]; m.index != -2 {
+				length := index - m.index
+				c := lzCost{m.cost.bits + 1 + eliasGammaBits(length) + 8*length, m.cost.literals + length}
+				lastLiteral[offset] = block{c, index}
+				if best.bits < 0 || c.bits < best.bits {
+					best = c
+				}
+			}
+		}
+		optimal[index] = best
+	}
+	end := optimal[n-1]
+	end.bits += 18
+	return end
+}
+
+// writeCompressionTable prints the sizes of data under each packer, exact for RLE and estimated
+// for ZX0 and ZX7, with their estimated decompression times.
+func writeCompressionTable(w io.Writer, name string, data []byte) {
+	fmt.Fprintf(w, "Estimated compression of %s (%d bytes):\n", name, len(data))
+	if len(data) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "  %-6s %8s %7s %12s %9s\n", "packer", "bytes", "ratio", "T-states", "ms")
+	row := func(packer string, size, tstates int) {
+		fmt.Fprintf(w, "  %-6s %8d %6.1f%% %12d %9.1f\n", packer, size, 100*float64(size)/float64(len(data)), tstates, float64(tstates)*1000/z80Clock)
+	}
+	copyCost := copyTStates * len(data)
+	size, blocks := rleSize(data)
+	row("rle", size, copyCost+blockTStates*blocks)
+	for _, p := range []struct {
+		name string
+		cost func([]byte) lzCost
+	}{{"zx0", zx0Cost}, {"zx7", zx7Cost}} {
+		c := p.cost(data)
+		row(p.name, (c.bits+7)/8, copyCost+bitTStates*c.control())
+	}
+}
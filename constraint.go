@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// Colour constraints: some areas of a screen may only use certain colours, such as a HUD kept to
+// black and white so it never clashes with what moves behind it. --constraint-mask gives an image
+// the size of the input whose colours mark such regions, and --allow says which palette indices
+// each mask colour permits, as hex digits: "#ff0000=07F" limits the red region to black, white
+// and bright white. Mask pixels of other colours, and transparent ones, leave their pixel free.
+// Quantization picks each pixel's nearest permitted colour; with --quantize cell, each cell's
+// INK and PAPER come from the colours all its pixels permit, or, when its pixels lie in regions
+// with no colour in common, from those any of them permit, each pixel then taking one it may use.
+// Black counts as one colour, so permitting 0 or 8 permits both.
+
+// Constraint settings.
+var (
+	constraintMaskFile string                // --constraint-mask.
+	constraintSpec     string                // --allow, #rrggbb=digits,...
+	constraintMask     *image.NRGBA          // Decoded from constraintMaskFile.
+	constraintSets     map[color.RGBA]uint16 // The indices each mask colour permits, one bit per index.
+)
+
+// allColours permits every palette index.
+const allColours = uint16(0xffff)
+
+// checkConstraintSettings parses --allow and reads the constraint mask.
+func checkConstraintSettings() error {
+	constraintMask, constraintSets = nil, nil
+	if constraintMaskFile == "" {
+		if constraintSpec != "" {
+			return fmt.Errorf("--allow needs --constraint-mask")
+		}
+		return nil
+	}
+	if constraintSpec == "" {
+		return fmt.Errorf("--constraint-mask needs --allow to say which colours each region may use")
+	}
+	if chunkyMode || fitScreen {
+		return fmt.Errorf("--constraint-mask cannot be combined with --chunky or --fit-screen")
+	}
+	constraintSets = map[color.RGBA]uint16{}
+	for _, entry := range strings.Split(constraintSpec, ",") {
+		from, digits, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || digits == "" {
+			return fmt.Errorf("invalid --allow entry %q (expected #rrggbb=digits, e.g. #ff0000=07F)", entry)
+		}
+		c, err := parseWebColor(strings.TrimSpace(from))
+		if err != nil {
+			return fmt.Errorf("invalid --allow entry %q: %v", entry, err)
+		}
+		var set uint16
+		for _, d := range digits {
+			idx, err := strconv.ParseUint(string(d), 16, 8)
+			if err != nil {
+				return fmt.Errorf("invalid --allow entry %q: %q is not a palette index (0 to F)", entry, string(d))
+			}
+			set |= 1 << idx
+		}
+		if set&(1<<0|1<<8) != 0 {
+			set |= 1<<0 | 1<<8
+		}
+		constraintSets[c] = set
+	}
+	img, err := decodeImageFile(constraintMaskFile)
+	if err != nil {
+		return fmt.Errorf("reading constraint mask: %w", err)
+	}
+	bounds := img.Bounds()
+	constraintMask = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(constraintMask, constraintMask.Bounds(), img, bounds.Min, draw.Src)
+	return nil
+}
+
+// checkConstraintSize checks that the constraint mask, if there is one, covers a w×h image.
+func checkConstraintSize(w, h int) error {
+	if constraintMask == nil {
+		return nil
+	}
+	if mw, mh := constraintMask.Rect.Dx(), constraintMask.Rect.Dy(); mw != w || mh != h {
+		return fmt.Errorf("%w: constraint mask is %dx%d, but the image is %dx%d", ErrWidthMismatch, mw, mh, w, h)
+	}
+	return nil
+}
+
+// allowedAt returns the palette indices the pixel at (x, y) may use, one bit per index.
+func allowedAt(x, y int) uint16 {
+	if constraintMask == nil {
+		return allColours
+	}
+	c := constraintMask.NRGBAAt(x, y)
+	if set, ok := constraintSets[color.RGBA{c.R, c.G, c.B, 255}]; ok && c.A != 0 {
+		return set
+	}
+	return allColours
+}
+
+// allows reports whether a set of palette indices includes idx.
+func allows(set uint16, idx int) bool {
+	return set&(1<<uint(idx)) != 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// Cropping: --crop x,y,w,h converts one region of an image input, such as a single sprite or
+// panel of a large mock-up, without a trip through an image editor. The region is cut out as soon
+// as the image is decoded, so everything after it, from colour mapping and levels to quantization
+// and constraint masks, sees only the cropped image; in an animated GIF, every frame is cropped
+// alike. It must lie within the image.
+
+// Crop settings.
+var (
+	cropStr  string          // --crop, x,y,w,h; empty for the whole image.
+	cropRect image.Rectangle // Parsed from cropStr.
+)
+
+// checkCropSettings parses --crop.
+func checkCropSettings() error {
+	if cropStr == "" {
+		return nil
+	}
+	var err error
+	cropRect, err = parseRect(cropStr)
+	return err
+}
+
+// cropImage returns the --crop region of an image, with its origin at (0, 0); it returns the image
+// as it is when there is no crop.
+func cropImage(img image.Image) (image.Image, error) {
+	if cropStr == "" {
+		return img, nil
+	}
+	bounds := img.Bounds()
+	if !cropRect.Add(bounds.Min).In(bounds) {
+		return nil, fmt.Errorf("crop %s lies outside the %dx%d image", cropStr, bounds.Dx(), bounds.Dy())
+	}
+	out := image.NewNRGBA(image.Rect(0, 0, cropRect.Dx(), cropRect.Dy()))
+	draw.Draw(out, out.Bounds(), img, bounds.Min.Add(cropRect.Min), draw.Src)
+	return out, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// CRT previews: instead of razor-sharp squares, PNG renderings can approximate a picture on a
+// television. Each pixel line becomes a beam with a dark gap below it, pixels are stretched to
+// the slightly wide shape they have on a PAL screen and softened horizontally, and a mild bloom
+// lets bright areas glow into their surroundings.
+
+// crtPreview enables the CRT filter for png and png-preview outputs.
+var crtPreview bool
+
+const (
+	crtScale  = 4    // Output rows per pixel line.
+	crtAspect = 1.05 // Width of a Spectrum pixel on a PAL screen, relative to its height.
+	crtBloom  = 0.3  // Strength of the glow added around bright areas.
+)
+
+// crtBeam is the brightness of each output row of a pixel line, the last being the gap between
+// scanlines.
+var crtBeam = [crtScale]float64{0.9, 1, 0.9, 0.45}
+
+// rgbPlane is an image as floating-point channels, 0 to 255.
+type rgbPlane struct {
+	width, height int
+	pix           [][3]float64
+}
+
+// boxBlur blurs a plane horizontally and vertically with a box of the given radius.
+func (p *rgbPlane) boxBlur(radius int) *rgbPlane {
+	blur := func(src *rgbPlane, dx, dy int) *rgbPlane {
+		out := &rgbPlane{width: src.width, height: src.height, pix: make([][3]float64, len(src.pix))}
+		for y := 0; y < src.height; y++ {
+			for x := 0; x < src.width; x++ {
+				var sum [3]float64
+				n := 0.0
+				for d := -radius; d <= radius; d++ {
+					sx, sy := x+d*dx, y+d*dy
+					if sx < 0 || sy < 0 || sx >= src.width || sy >= src.height {
+						continue
+					}
+					c := src.pix[sy*src.width+sx]
+					for ch := range sum {
+						sum[ch] += c[ch]
+					}
+					n++
+				}
+				out.pix[y*src.width+x] = [3]float64{sum[0] / n, sum[1] / n, sum[2] / n}
+			}
+		}
+		return out
+	}
+	return blur(blur(p, 1, 0), 0, 1)
+}
+
+// planeFromImage converts an image to a plane, showing transparent pixels as PAPER, as the
+// screen would.
+func planeFromImage(img *image.RGBA) *rgbPlane {
+	b := img.Bounds()
+	p := &rgbPlane{width: b.Dx(), height: b.Dy(), pix: make([][3]float64, b.Dx()*b.Dy())}
+	paper := ZXPalette[paperColour]
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			c := img.RGBAAt(b.Min.X+x, b.Min.Y+y)
+			if c.A == 0 {
+				c = paper
+			}
+			p.pix[y*p.width+x] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+		}
+	}
+	return p
+}
+
+// image converts a plane back to an opaque image, clamping its channels.
+func (p *rgbPlane) image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, p.width, p.height))
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			c := p.pix[y*p.width+x]
+			px := func(v float64) uint8 { return uint8(math.Round(min(max(v, 0), 255))) }
+			img.SetRGBA(x, y, color.RGBA{px(c[0]), px(c[1]), px(c[2]), 255})
+		}
+	}
+	return img
+}
+
+// crtFilter renders an image as it might look on a CRT television.
+func crtFilter(img *image.RGBA) *image.RGBA {
+	src := planeFromImage(img)
+	hscale := crtScale * crtAspect
+	out := &rgbPlane{width: int(math.Round(float64(src.width) * hscale)), height: src.height * crtScale}
+	out.pix = make([][3]float64, out.width*out.height)
+	for y := 0; y < out.height; y++ {
+		sy, beam := y/crtScale, crtBeam[y%crtScale]
+		for x := 0; x < out.width; x++ {
+			// Linear interpolation between neighbouring pixels softens the edges, like the
+			// limited bandwidth of the video signal.
+			sx := (float64(x)+0.5)/hscale - 0.5
+			x0 := int(math.Floor(sx))
+			t := sx - float64(x0)
+			x0, x1 := min(max(x0, 0), src.width-1), min(max(x0+1, 0), src.width-1)
+			a, b := src.pix[sy*src.width+x0], src.pix[sy*src.width+x1]
+			for ch := 0; ch < 3; ch++ {
+				out.pix[y*out.width+x][ch] = (a[ch]*(1-t) + b[ch]*t) * beam
+			}
+		}
+	}
+	// Bloom: screen-blend a blurred copy over the picture, so light spreads without clipping.
+	glow := out.boxBlur(crtScale)
+	for i, c := range out.pix {
+		for ch := range c {
+			g := glow.pix[i][ch] * crtBloom
+			out.pix[i][ch] = 255 - (255-c[ch])*(255-g)/255
+		}
+	}
+	return out.image()
+}
+
+// PAL composite previews: on composite video, colour travels at a fraction of the bandwidth of
+// brightness, so it smears sideways across several pixels, and PAL receivers average it with the
+// line above as well. Dithered art is often drawn with this blending in mind.
+
+// palBleed is the strength of the PAL colour bleed applied to png and png-preview outputs, from 0
+// (none) to 1.
+var palBleed float64
+
+// palChromaRadius is the horizontal reach of the colour smear at full strength, in pixels.
+const palChromaRadius = 3
+
+// checkPreviewSettings validates the preview filter settings.
+func checkPreviewSettings() error {
+	if palBleed < 0 || palBleed > 1 {
+		return fmt.Errorf("--pal-bleed must be between 0 and 1, got %g", palBleed)
+	}
+	return nil
+}
+
+// palFilter approximates PAL composite colour bleed: each pixel keeps its own brightness (Y) but
+// takes its colour (U and V) from a horizontal blur blended with the line above, mixed in by the
+// bleed strength.
+func palFilter(img *image.RGBA) *image.RGBA {
+	p := planeFromImage(img)
+	yuv := &rgbPlane{width: p.width, height: p.height, pix: make([][3]float64, len(p.pix))}
+	for i, c := range p.pix {
+		y := 0.299*c[0] + 0.587*c[1] + 0.114*c[2]
+		yuv.pix[i] = [3]float64{y, 0.492 * (c[2] - y), 0.877 * (c[0] - y)}
+	}
+	radius := max(int(math.Round(palChromaRadius*palBleed)), 1)
+	chroma := &rgbPlane{width: p.width, height: p.height, pix: make([][3]float64, len(p.pix))}
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			var u, v, n float64
+			for d := -radius; d <= radius; d++ {
+				if sx := x + d; sx >= 0 && sx < p.width {
+					c := yuv.pix[y*p.width+sx]
+					u, v, n = u+c[1], v+c[2], n+1
+				}
+			}
+			chroma.pix[y*p.width+x] = [3]float64{0, u / n, v / n}
+		}
+	}
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			i := y*p.width + x
+			u, v := chroma.pix[i][1], chroma.pix[i][2]
+			if y > 0 {
+				// The delay line averages the colour of this line with the one before it.
+				above := chroma.pix[i-p.width]
+				u, v = (u+above[1])/2, (v+above[2])/2
+			}
+			c := yuv.pix[i]
+			u = c[1] + (u-c[1])*palBleed
+			v = c[2] + (v-c[2])*palBleed
+			p.pix[i] = [3]float64{c[0] + v/0.877, c[0] - 0.395*u - 0.581*v, c[0] + u/0.492}
+		}
+	}
+	return p.image()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Duplicate detection: in a batch, inputs that convert to identical data are worth knowing
+// about, since they are usually redundant frames of a sprite set. With --duplicates, the hex and
+// binary files of every conversion are hashed, and each one identical to an earlier output of the
+// same type is reported at the end of the batch, or replaced with a symbolic link to it.
+
+// duplicateMode is what --duplicates does with duplicate outputs: report or link. Empty for
+// nothing.
+var duplicateMode string
+
+// duplicateExtensions are the output file types compared; source formats such as asm and c are
+// left out, as their labels differ even when the data does not.
+var duplicateExtensions = map[string]bool{
+	".hex":  true,
+	".bin":  true,
+	".attr": true,
+	".scr":  true,
+	".l2":   true,
+	".png":  true,
+	".gif":  true,
+}
+
+var (
+	outputDigests  = map[string]string{} // First file written with each extension and digest.
+	duplicateFiles [][2]string           // Duplicate outputs, each with the file it repeats.
+)
+
+// checkDuplicateSettings validates --duplicates.
+func checkDuplicateSettings() error {
+	switch duplicateMode {
+	case "", "report", "link":
+		return nil
+	}
+	return fmt.Errorf("unknown --duplicates mode %q (expected report or link)", duplicateMode)
+}
+
+// outputDigest hashes the data of an output file. Hex files are hashed without their "# file:"
+// line, which names the input and so always differs.
+func outputDigest(filename string) (string, error) {
+	data, err := readOutput(filename)
+	if err != nil {
+		return "", err
+	}
+	if strings.EqualFold(filepath.Ext(filename), ".hex") {
+		var kept [][]byte
+		for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+			if key, _, ok := headerField(strings.TrimRight(string(line), "\r\n")); ok && key == "file" {
+				continue
+			}
+			kept = append(kept, line)
+		}
+		data = bytes.Join(kept, nil)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// recordDuplicates compares the files a conversion wrote with the outputs seen so far, noting
+// (or, in link mode, replacing with a link) each one that repeats an earlier file.
+func recordDuplicates(files []string) error {
+	for _, file := range uniqueStrings(files) {
+		ext := strings.ToLower(filepath.Ext(file))
+		if !duplicateExtensions[ext] {
+			continue
+		}
+		digest, err := outputDigest(file)
+		if err != nil {
+			return fmt.Errorf("checking for duplicates: %w", err)
+		}
+		first, seen := outputDigests[ext+digest]
+		if !seen {
+			outputDigests[ext+digest] = file
+			continue
+		}
+		if first == file {
+			continue // The same file written again.
+		}
+		duplicateFiles = append(duplicateFiles, [2]string{file, first})
+		if duplicateMode == "link" {
+			if err := linkDuplicate(file, first); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// linkDuplicate replaces a duplicate file with a symbolic link to the file it repeats.
+func linkDuplicate(file, first string) error {
+	target, err := filepath.Rel(filepath.Dir(file), first)
+	if err != nil {
+		target, err = filepath.Abs(first)
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("linking duplicate: %w", err)
+	}
+	if err := os.Symlink(target, file); err != nil {
+		return fmt.Errorf("linking duplicate: %w", err)
+	}
+	return nil
+}
+
+// reportDuplicates lists the duplicate outputs found.
+func reportDuplicates() {
+	if duplicateMode == "" {
+		return
+	}
+	if len(duplicateFiles) == 0 {
+		statusf("No duplicate outputs\n")
+		return
+	}
+	verb := "is identical to"
+	if duplicateMode == "link" {
+		verb = "now links to"
+	}
+	for _, d := range duplicateFiles {
+		statusf("Duplicate: %s %s %s\n", d[0], verb, d[1])
+	}
+	noun := "outputs"
+	if len(duplicateFiles) == 1 {
+		noun = "output"
+	}
+	statusf("%d duplicate %s\n", len(duplicateFiles), noun)
+}
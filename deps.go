@@ -0,0 +1,104 @@
+package main
+
+import "strings"
+
+// Dependency manifests: with --deps, every successful conversion adds a make rule naming the
+// files it wrote as targets and the files it read as prerequisites, so make (or ninja, which
+// reads the same format) knows when generated assets are out of date.
+
+// depsFile is the makefile fragment written with the dependency rules; empty for none.
+var depsFile string
+
+// depRule is one make rule of the dependency manifest.
+type depRule struct {
+	targets, prereqs []string
+}
+
+var (
+	depRules     []depRule // Rules of the conversions so far.
+	writtenFiles []string  // Files written since the last rule was recorded.
+)
+
+// recordDeps adds a rule for the conversion of input that has just finished, covering every file
+// written since the previous one. Inputs that are not files (standard input and direct strings)
+// are left out, as are conversions that wrote no files.
+func recordDeps(input string) {
+	targets := uniqueStrings(writtenFiles)
+	writtenFiles = nil
+	if len(targets) == 0 {
+		return
+	}
+	var prereqs []string
+	if member, ok := archiveMembers[input]; ok {
+		prereqs = append(prereqs, member.archive)
+	} else if input != stdinName && fileExists(input) {
+		prereqs = append(prereqs, input)
+	}
+	switch paletteName {
+	case "spectrum", "ulaplus", "next":
+	default:
+		prereqs = append(prereqs, paletteName) // A palette file.
+	}
+	if snapshotTemplate != "" {
+		prereqs = append(prereqs, snapshotTemplate)
+	}
+	if attrFile != "" {
+		prereqs = append(prereqs, attrFile)
+	}
+	if constraintMaskFile != "" {
+		prereqs = append(prereqs, constraintMaskFile)
+	}
+	if sliceFile != "" {
+		prereqs = append(prereqs, sliceFile)
+	}
+	depRules = append(depRules, depRule{targets: targets, prereqs: prereqs})
+}
+
+// uniqueStrings returns the strings in order of first appearance, without repeats.
+func uniqueStrings(list []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range list {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// makeEscape escapes a filename for a make rule.
+func makeEscape(name string) string {
+	name = strings.ReplaceAll(name, "$", "$$")
+	name = strings.ReplaceAll(name, "#", "\\#")
+	return strings.ReplaceAll(name, " ", "\\ ")
+}
+
+// depsText returns the dependency manifest: one rule per conversion.
+func depsText() string {
+	var sb strings.Builder
+	for _, rule := range depRules {
+		targets := make([]string, len(rule.targets))
+		for i, t := range rule.targets {
+			targets[i] = makeEscape(t)
+		}
+		sb.WriteString(strings.Join(targets, " ") + ":")
+		for _, p := range rule.prereqs {
+			sb.WriteString(" " + makeEscape(p))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// writeDeps writes the dependency manifest, when one was asked for.
+func writeDeps() error {
+	if depsFile == "" {
+		return nil
+	}
+	if err := writeOutputFile(depsFile, []byte(depsText())); err != nil {
+		return err
+	}
+	statusf("Dependencies written to %s\n", depsFile)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// Depth reduction: the rest of the pipeline works with 8 bits per channel, so images with 16
+// (PNGs saved at 16 bits, or colour-converted images) are reduced first, by rounding to the
+// nearest 8-bit value rather than dropping the low byte. Smooth gradients can still band into
+// steps at 8 bits, and the steps then map to stripes of palette colours; --depth-dither spreads
+// the rounding with a blue-noise offset of up to half a step, which breaks them up.
+
+// depthDither enables dithering when reducing 16-bit images to 8 bits.
+var depthDither bool
+
+// isDeepImage reports whether an image has more than 8 bits per channel.
+func isDeepImage(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// reduceDepth converts an image with 16-bit channels to 8 bits, rounding each channel and
+// dithering when enabled. Other images are returned as they are.
+func reduceDepth(img image.Image) image.Image {
+	if !isDeepImage(img) {
+		return img
+	}
+	bounds := img.Bounds()
+	deep := image.NewNRGBA64(bounds)
+	draw.Draw(deep, bounds, img, bounds.Min, draw.Src)
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			offset := 0.0
+			if depthDither {
+				offset = (float64(blueNoise16[(y-bounds.Min.Y)%16][(x-bounds.Min.X)%16])+0.5)/256 - 0.5
+			}
+			to8 := func(v uint16) uint8 {
+				return uint8(min(max(math.Floor(float64(v)/257+0.5+offset), 0), 255))
+			}
+			c := deep.NRGBA64At(x, y)
+			// Alpha is rounded without dithering, so fully opaque and transparent pixels stay so.
+			out.SetNRGBA(x, y, color.NRGBA{to8(c.R), to8(c.G), to8(c.B), uint8((uint32(c.A)*255 + 32767) / 65535)})
+		}
+	}
+	return out
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// +3 disk images: the CPCEMU .dsk container (standard or extended) holding a disk in the +3's
+// own format: 40 tracks of nine 512-byte sectors, one reserved track, 1K blocks and a 64-entry
+// CP/M-style directory. Files are stored with their +3DOS header, so LOAD "name"CODE works.
+
+// Settings for +3 disk outputs.
+var (
+	dskImage    string // Add binary outputs to this +3 .dsk image instead of writing files.
+	writeLoader bool   // Also write a loader program that loads every CODE file on the disk or tape.
+)
+
+const (
+	dskTracks          = 40
+	dskSectorsPerTrack = 9
+	dskSectorSize      = 512
+	dskSizeCode        = 2 // FDC sector size code for 512 bytes.
+	dskReservedTracks  = 1
+	dskBlockSize       = 1024
+	dskDirBlocks       = 2
+	dskDirEntries      = dskDirBlocks * dskBlockSize / 32
+	dskBlocks          = (dskTracks - dskReservedTracks) * dskSectorsPerTrack * dskSectorSize / dskBlockSize
+	dskTrackSize       = 256 + dskSectorsPerTrack*dskSectorSize
+	dskUnused          = 0xE5 // Formatted sectors and free directory entries are filled with this.
+	dskLoaderName      = "DISK"
+)
+
+// checkDSKSettings rejects combinations of disk settings that cannot be honoured together.
+func checkDSKSettings() error {
+	if dskImage != "" && (trdImage != "" || hobetaOutput) {
+		return fmt.Errorf("--dsk cannot be combined with --trd or --hobeta")
+	}
+	if writeLoader && dskImage == "" && tapImage == "" {
+		return fmt.Errorf("--loader needs --dsk or --tap")
+	}
+	return nil
+}
+
+// dskDisk is a +3 disk image, with the position of every sector in the image file.
+type dskDisk struct {
+	data    []byte
+	sectors map[[2]int]int // (track, sector ID) to offset of the sector data.
+}
+
+// newDSKImage returns a freshly formatted, empty +3 disk in a standard .dsk container.
+func newDSKImage() []byte {
+	data := make([]byte, 256+dskTracks*dskTrackSize)
+	copy(data, "MV - CPCEMU Disk-File\r\nDisk-Info\r\n")
+	copy(data[34:48], "zxtex")
+	data[48] = dskTracks
+	data[49] = 1 // Sides.
+	binary.LittleEndian.PutUint16(data[50:], dskTrackSize)
+	for t := 0; t < dskTracks; t++ {
+		track := data[256+t*dskTrackSize:]
+		copy(track, "Track-Info\r\n")
+		track[16] = byte(t)
+		track[17] = 0 // Side.
+		track[20] = dskSizeCode
+		track[21] = dskSectorsPerTrack
+		track[22] = 0x52 // GAP#3 length used when formatting.
+		track[23] = dskUnused
+		for s := 0; s < dskSectorsPerTrack; s++ {
+			info := track[24+s*8:]
+			info[0] = byte(t)
+			info[1] = 0
+			info[2] = byte(s + 1) // Sector IDs run from 1.
+			info[3] = dskSizeCode
+		}
+		for i := 256; i < dskTrackSize; i++ {
+			track[i] = dskUnused
+		}
+	}
+	// The first sector describes the disk: +3 format, single sided, 40 tracks, 9 sectors of 512
+	// bytes, 1 reserved track, 1K blocks, 2 directory blocks, and the read/write and format gaps.
+	copy(data[256+256:], []byte{0, 0, dskTracks, dskSectorsPerTrack, 2, dskReservedTracks, 3, dskDirBlocks, 0x2A, 0x52, 0, 0, 0, 0, 0, 0})
+	return data
+}
+
+// parseDSK locates the sectors of a +3 disk in a standard or extended .dsk container.
+func parseDSK(data []byte) (*dskDisk, error) {
+	extended := bytes.HasPrefix(data, []byte("EXTENDED CPC DSK File"))
+	if !extended && !bytes.HasPrefix(data, []byte("MV - CPC")) {
+		return nil, fmt.Errorf("%w: not a .dsk disk image", ErrUnsupportedFormat)
+	}
+	if len(data) < 256 {
+		return nil, fmt.Errorf("%w: truncated .dsk disk image", ErrUnsupportedFormat)
+	}
+	tracks, sides := int(data[48]), int(data[49])
+	if sides != 1 {
+		return nil, fmt.Errorf("%w: only single-sided +3 disks are supported", ErrUnsupportedFormat)
+	}
+	d := &dskDisk{data: data, sectors: map[[2]int]int{}}
+	offset := 256
+	for t := 0; t < tracks; t++ {
+		size := int(binary.LittleEndian.Uint16(data[50:]))
+		if extended {
+			size = int(data[52+t]) * 256
+		}
+		if size == 0 {
+			continue // Unformatted track in an extended image.
+		}
+		if offset+size > len(data) || !bytes.HasPrefix(data[offset:], []byte("Track-Info")) {
+			return nil, fmt.Errorf("%w: truncated .dsk disk image", ErrUnsupportedFormat)
+		}
+		track := data[offset:]
+		pos := offset + 256
+		for s := 0; s < int(track[21]); s++ {
+			info := track[24+s*8:]
+			length := 128 << uint(info[3]&7)
+			if extended {
+				length = int(binary.LittleEndian.Uint16(info[6:]))
+			}
+			if length >= dskSectorSize && pos+dskSectorSize <= len(data) {
+				d.sectors[[2]int{int(info[0]), int(info[2])}] = pos
+			}
+			pos += length
+		}
+		offset += size
+	}
+	for t := 0; t < dskTracks; t++ {
+		for s := 1; s <= dskSectorsPerTrack; s++ {
+			if _, ok := d.sectors[[2]int{t, s}]; !ok {
+				return nil, fmt.Errorf("%w: not a +3 format disk (track %d sector %d missing)", ErrUnsupportedFormat, t, s)
+			}
+		}
+	}
+	return d, nil
+}
+
+// block returns the two sectors holding a 1K block, counted from the first track after the
+// reserved one.
+func (d *dskDisk) block(n int) [][]byte {
+	var out [][]byte
+	for i := 0; i < dskBlockSize/dskSectorSize; i++ {
+		s := n*dskBlockSize/dskSectorSize + i
+		pos := d.sectors[[2]int{dskReservedTracks + s/dskSectorsPerTrack, s%dskSectorsPerTrack + 1}]
+		out = append(out, d.data[pos:pos+dskSectorSize])
+	}
+	return out
+}
+
+// readBlock returns a copy of a block's contents.
+func (d *dskDisk) readBlock(n int) []byte {
+	var out []byte
+	for _, sector := range d.block(n) {
+		out = append(out, sector...)
+	}
+	return out
+}
+
+// writeBlock stores up to a block of data, filling the rest of the block.
+func (d *dskDisk) writeBlock(n int, data []byte) {
+	for _, sector := range d.block(n) {
+		k := copy(sector, data)
+		for i := k; i < len(sector); i++ {
+			sector[i] = 0x1A // CP/M end-of-file filler.
+		}
+		data = data[k:]
+	}
+}
+
+// directory returns a copy of the directory: dskDirEntries entries of 32 bytes.
+func (d *dskDisk) directory() []byte {
+	var dir []byte
+	for b := 0; b < dskDirBlocks; b++ {
+		dir = append(dir, d.readBlock(b)...)
+	}
+	return dir
+}
+
+// setDirectory writes the directory back to the disk.
+func (d *dskDisk) setDirectory(dir []byte) {
+	for b := 0; b < dskDirBlocks; b++ {
+		d.writeBlock(b, dir[b*dskBlockSize:(b+1)*dskBlockSize])
+	}
+}
+
+// plus3Name converts a filename into the space-padded 8.3 name stored in directory entries.
+func plus3Name(filename string) []byte {
+	base := filepath.Base(filename)
+	ext := strings.TrimPrefix(filepath.Ext(base), ".")
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	name := []byte("           ")
+	clean := func(c byte) byte {
+		if c >= 'a' && c <= 'z' {
+			return c - 'a' + 'A'
+		}
+		if c <= ' ' || c >= 0x7F || strings.IndexByte(`<>.,;:=?*[]"|/\`, c) >= 0 {
+			return '_'
+		}
+		return c
+	}
+	for i := 0; i < len(base) && i < 8; i++ {
+		name[i] = clean(base[i])
+	}
+	for i := 0; i < len(ext) && i < 3; i++ {
+		name[8+i] = clean(ext[i])
+	}
+	return name
+}
+
+// displayName formats a stored 8.3 name the way BASIC expects it, as in "SCREEN.SCR".
+func displayName(name []byte) string {
+	base := strings.TrimRight(string(name[:8]), " ")
+	ext := make([]byte, 3)
+	for i := range ext {
+		ext[i] = name[8+i] & 0x7F // The top bits hold attributes.
+	}
+	if e := strings.TrimRight(string(ext), " "); e != "" {
+		return base + "." + e
+	}
+	return base
+}
+
+// usedEntry reports whether a directory entry belongs to a file.
+func usedEntry(entry []byte) bool {
+	return entry[0] < 0x10
+}
+
+// sameName reports whether a directory entry belongs to the file with the given stored name.
+func sameName(entry, name []byte) bool {
+	for i := 0; i < 11; i++ {
+		if entry[1+i]&0x7F != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// deleteFile removes every directory entry of a file; its blocks become free.
+func deleteFile(dir, name []byte) {
+	for i := 0; i < dskDirEntries; i++ {
+		entry := dir[i*32 : i*32+32]
+		if usedEntry(entry) && sameName(entry, name) {
+			entry[0] = dskUnused
+		}
+	}
+}
+
+// addFile stores a file in user area 0, allocating directory entries and blocks for it.
+func (d *dskDisk) addFile(dir, name, content []byte) error {
+	used := make([]bool, dskBlocks)
+	for b := 0; b < dskDirBlocks; b++ {
+		used[b] = true
+	}
+	var freeEntries []int
+	for i := 0; i < dskDirEntries; i++ {
+		entry := dir[i*32 : i*32+32]
+		if !usedEntry(entry) {
+			freeEntries = append(freeEntries, i)
+			continue
+		}
+		if sameName(entry, name) {
+			return fmt.Errorf("%s is already on the disk", displayName(name))
+		}
+		for _, b := range entry[16:32] {
+			if int(b) < dskBlocks {
+				used[b] = true
+			}
+		}
+	}
+	var freeBlocks []int
+	for b, u := range used {
+		if !u {
+			freeBlocks = append(freeBlocks, b)
+		}
+	}
+	records := (len(content) + 127) / 128
+	blocks := (len(content) + dskBlockSize - 1) / dskBlockSize
+	// Each directory entry maps one 16K extent with up to 16 one-byte block numbers.
+	extents := (blocks + 15) / 16
+	if extents == 0 {
+		extents = 1
+	}
+	if blocks > len(freeBlocks) {
+		return fmt.Errorf("not enough free space on the disk (%dK needed, %dK free)", blocks, len(freeBlocks))
+	}
+	if extents > len(freeEntries) {
+		return fmt.Errorf("disk directory is full")
+	}
+	for x := 0; x < extents; x++ {
+		entry := dir[freeEntries[x]*32 : freeEntries[x]*32+32]
+		for i := range entry {
+			entry[i] = 0
+		}
+		copy(entry[1:12], name)
+		entry[12] = byte(x & 0x1F) // Extent number, low bits.
+		entry[14] = byte(x >> 5)   // Extent number, high bits.
+		rc := records - x*128
+		if rc > 128 {
+			rc = 128
+		}
+		entry[15] = byte(rc)
+		for i := 0; i < 16 && x*16+i < blocks; i++ {
+			b := freeBlocks[x*16+i]
+			entry[16+i] = byte(b)
+			end := (x*16 + i + 1) * dskBlockSize
+			if end > len(content) {
+				end = len(content)
+			}
+			d.writeBlock(b, content[(x*16+i)*dskBlockSize:end])
+		}
+	}
+	return nil
+}
+
+// codeFiles lists the files on the disk that are +3DOS CODE files, in directory order.
+func (d *dskDisk) codeFiles(dir []byte) []string {
+	var names []string
+	for i := 0; i < dskDirEntries; i++ {
+		entry := dir[i*32 : i*32+32]
+		if entry[0] != 0 || entry[12] != 0 || entry[14] != 0 || entry[16] == 0 || int(entry[16]) >= dskBlocks {
+			continue // Only the first extent of files in user area 0.
+		}
+		first := d.readBlock(int(entry[16]))
+		if bytes.HasPrefix(first, []byte("PLUS3DOS")) && first[15] == fileTypeCode {
+			names = append(names, displayName(entry[1:12]))
+		}
+	}
+	return names
+}
+
+// addToDSK adds data to a +3 disk image file as a CODE file named after filename, creating a new
+// formatted image when the file does not exist yet. With --loader, the disk's DISK program is
+// rewritten to load every CODE file on it.
+func addToDSK(diskFile, filename string, data []byte, addr int) error {
+	image := newDSKImage()
+	if fileExists(diskFile) {
+		var err error
+		if image, err = ioutil.ReadFile(diskFile); err != nil {
+			return err
+		}
+	}
+	d, err := parseDSK(image)
+	if err != nil {
+		return fmt.Errorf("%s: %w", diskFile, err)
+	}
+	content, err := plus3CodeFile(data, addr)
+	if err != nil {
+		return err
+	}
+	dir := d.directory()
+	if err := d.addFile(dir, plus3Name(filename), content); err != nil {
+		return fmt.Errorf("%s: %w", diskFile, err)
+	}
+	if writeLoader {
+		loader := plus3Name(dskLoaderName)
+		deleteFile(dir, loader)
+		prog := loaderProgram(d.codeFiles(dir))
+		file := append(plus3DOSHeader(fileTypeProgram, len(prog), 10, len(prog)), prog...)
+		if err := d.addFile(dir, loader, file); err != nil {
+			return fmt.Errorf("%s: %w", diskFile, err)
+		}
+	}
+	d.setDirectory(dir)
+	return writeFileAtomic(diskFile, d.data)
+}
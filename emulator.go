@@ -0,0 +1,43 @@
+//go:build !js
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Emulator launch: after a conversion, the screen, snapshot or disk image it wrote can be opened
+// in an emulator straight away, so checking a change to the artwork takes a single command.
+
+// runCommand is the emulator command run on the output: a program name such as fuse or zesarux,
+// or a command line in which {} stands for the file. Empty to launch nothing.
+var runCommand string
+
+// checkRunSettings rejects --run when the output it would open never reaches a file.
+func checkRunSettings() error {
+	if runCommand != "" && outputToStdout {
+		return fmt.Errorf("--run needs an output file; it cannot be used with --output -")
+	}
+	if runCommand != "" && zipOutput != "" {
+		return fmt.Errorf("--run needs an output file; it cannot be used with --zip")
+	}
+	if runCommand != "" && len(strings.Fields(runCommand)) == 0 {
+		return fmt.Errorf("--run needs an emulator name or command")
+	}
+	return nil
+}
+
+// launchEmulator opens the last screen, snapshot or disk image written in the emulator, and waits
+// for it to exit.
+func launchEmulator() error {
+	if launchFile == "" {
+		return fmt.Errorf("--run found nothing to open; write an scr, sna, z80 or if2 output, or use --trd, --dsk or --tap")
+	}
+	cmd := toolCommand(runCommand, launchFile, launchFile)
+	statusf("Running %s\n", strings.Join(cmd.Args, " "))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running %s: %w", cmd.Args[0], err)
+	}
+	return nil
+}
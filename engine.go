@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Engine metadata: the godot and engine-json formats describe where the frames of a PNG sheet lie,
+// for prototyping in modern engines with the same assets. Conversions describe the PNG written
+// alongside them (with png in the --format list), an animation's frames stacked down it, each
+// with its duration; "zxtex atlas" describes its sheet, one sprite per frame. godot writes a
+// Godot 4 SpriteFrames resource (.tres) with an AtlasTexture per frame: an animation plays its
+// frames in a looping "default" animation, and each other sprite gets an animation of its own.
+// engine-json writes the same description as plain JSON (_engine.json) for engines with no
+// importer of their own.
+
+// engineFrame is a rectangle of an engine sheet.
+type engineFrame struct {
+	Name     string `json:"name"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Duration int    `json:"duration,omitempty"` // Milliseconds, for animation frames.
+}
+
+// engineAnimation is a sequence of frames of an engine sheet, by name.
+type engineAnimation struct {
+	Name   string   `json:"name"`
+	Frames []string `json:"frames"`
+	Loop   bool     `json:"loop"`
+}
+
+// engineSheet describes a PNG sheet for game engines.
+type engineSheet struct {
+	Image      string            `json:"image"` // Relative to the description.
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Frames     []engineFrame     `json:"frames"`
+	Animations []engineAnimation `json:"animations,omitempty"`
+	Generator  string            `json:"generator"`
+}
+
+// isEngineFormat reports whether a format is one of the engine metadata formats.
+func isEngineFormat(format string) bool {
+	return format == "godot" || format == "engine-json"
+}
+
+// sourceSheet describes the PNG of a converted image m, named image: one frame, or for an
+// animation, its stacked frames and their timing.
+func sourceSheet(src *source, m *indexedImage, image string) engineSheet {
+	name := strings.TrimSuffix(image, ".png")
+	sheet := engineSheet{Image: image, Width: m.width, Height: m.height, Generator: "zxtex"}
+	if src.anim == nil {
+		sheet.Frames = []engineFrame{{Name: name, Width: m.width, Height: m.height}}
+		return sheet
+	}
+	anim := engineAnimation{Name: name, Loop: true}
+	h := m.height / len(src.anim.frames)
+	for i := range src.anim.frames {
+		f := engineFrame{Name: fmt.Sprintf("%s_%d", name, i), Y: i * h, Width: m.width, Height: h, Duration: src.anim.frameDuration(i)}
+		sheet.Frames = append(sheet.Frames, f)
+		anim.Frames = append(anim.Frames, f.Name)
+	}
+	sheet.Animations = []engineAnimation{anim}
+	return sheet
+}
+
+// atlasSheet describes a packed atlas sheet, named image.
+func atlasSheet(manifest atlasManifest, image string) engineSheet {
+	sheet := engineSheet{Image: image, Width: manifest.Width, Height: manifest.Height, Generator: "zxtex"}
+	for _, e := range manifest.Sprites {
+		sheet.Frames = append(sheet.Frames, engineFrame{Name: e.Name, X: e.X, Y: e.Y, Width: e.Width, Height: e.Height})
+	}
+	return sheet
+}
+
+// sheetImageName returns the name of the PNG a description written to output refers to: the
+// output's name with a .png extension, or the source's default PNG name when it has none.
+func sheetImageName(src *source, format, output string) string {
+	if output == "" || output == stdoutName {
+		return defaultOutputName(src, ".png")
+	}
+	base := filepath.Base(output)
+	if ext := outputExtension(format); strings.HasSuffix(base, ext) {
+		return strings.TrimSuffix(base, ext) + ".png"
+	}
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ".png"
+}
+
+// engineText formats a sheet description in an engine metadata format.
+func engineText(sheet engineSheet, format string) (string, error) {
+	if format == "godot" {
+		return godotSpriteFrames(sheet), nil
+	}
+	data, err := json.MarshalIndent(sheet, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data) + "\n", nil
+}
+
+// godotSpriteFrames formats a sheet description as a Godot 4 SpriteFrames resource. Godot gives
+// an animation a speed in frames per second and each frame a duration relative to it, so the
+// speed follows the first frame and the others scale from there.
+func godotSpriteFrames(sheet engineSheet) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("[gd_resource type=\"SpriteFrames\" load_steps=%d format=3]\n\n", len(sheet.Frames)+2))
+	sb.WriteString(fmt.Sprintf("[ext_resource type=\"Texture2D\" path=%s id=\"1\"]\n\n", godotString(sheet.Image)))
+	textures := map[string]string{}
+	for i, f := range sheet.Frames {
+		id := fmt.Sprintf("AtlasTexture_%d", i)
+		textures[f.Name] = id
+		sb.WriteString(fmt.Sprintf("[sub_resource type=\"AtlasTexture\" id=\"%s\"]\n", id))
+		sb.WriteString("atlas = ExtResource(\"1\")\n")
+		sb.WriteString(fmt.Sprintf("region = Rect2(%d, %d, %d, %d)\n\n", f.X, f.Y, f.Width, f.Height))
+	}
+	durations := map[string]int{}
+	for _, f := range sheet.Frames {
+		durations[f.Name] = f.Duration
+	}
+	anims := sheet.Animations
+	if anims == nil {
+		// Sprites each make an animation of one frame.
+		for _, f := range sheet.Frames {
+			anims = append(anims, engineAnimation{Name: f.Name, Frames: []string{f.Name}})
+		}
+	} else if len(anims) == 1 {
+		anims = []engineAnimation{anims[0]}
+		anims[0].Name = "default"
+	}
+	var entries []string
+	for _, a := range anims {
+		speed, base := 5.0, 0
+		if d := durations[a.Frames[0]]; d > 0 {
+			speed, base = 1000/float64(d), d
+		}
+		var frames []string
+		for _, name := range a.Frames {
+			rel := 1.0
+			if base > 0 && durations[name] > 0 {
+				rel = float64(durations[name]) / float64(base)
+			}
+			frames = append(frames, fmt.Sprintf("{\n\"duration\": %s,\n\"texture\": SubResource(\"%s\")\n}", godotFloat(rel), textures[name]))
+		}
+		entries = append(entries, fmt.Sprintf("{\n\"frames\": [%s],\n\"loop\": %t,\n\"name\": &%s,\n\"speed\": %s\n}", strings.Join(frames, ", "), a.Loop, godotString(a.Name), godotFloat(speed)))
+	}
+	sb.WriteString("[resource]\n")
+	sb.WriteString("animations = [" + strings.Join(entries, ", ") + "]\n")
+	return sb.String()
+}
+
+// godotString quotes a string for a Godot resource file.
+func godotString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// godotFloat formats a number as a Godot float, to three decimal places at most, and always with a
+// decimal point.
+func godotFloat(f float64) string {
+	s := strconv.FormatFloat(math.Round(f*1000)/1000, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
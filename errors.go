@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds returned by the conversion functions. Errors are wrapped with context as they travel
+// up, so code in zxtex should test for these with errors.Is and errors.As rather than comparing
+// messages. zxtex is a single main package, so other programs cannot import them, and reading
+// accepts the same input it always has: only the errors it returns are typed.
+var (
+	// ErrUnsupportedFormat is returned for image formats, file types and output formats zxtex
+	// cannot handle.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrInvalidHexDigit is returned for characters in hex data that are neither hex digits nor '.'.
+	ErrInvalidHexDigit = errors.New("invalid hex digit")
+	// ErrWidthMismatch is returned when the rows of a direct hex string differ in length, or when
+	// an image's dimensions do not suit what is asked of it.
+	ErrWidthMismatch = errors.New("width mismatch")
+	// ErrEmptyData is returned when there is no hex data to convert.
+	ErrEmptyData = errors.New("empty hex data")
+)
+
+// HexDigitError describes an invalid character in hex data. It wraps ErrInvalidHexDigit.
+type HexDigitError struct {
+	Digit  rune // The offending character.
+	Offset int  // Position within the continuous hex data.
+}
+
+func (e *HexDigitError) Error() string {
+	return fmt.Sprintf("invalid hex digit '%c' at offset %d", e.Digit, e.Offset)
+}
+
+func (e *HexDigitError) Unwrap() error {
+	return ErrInvalidHexDigit
+}
+
+// WidthError describes a hex row whose length does not match the expected width.
+// It wraps ErrWidthMismatch.
+type WidthError struct {
+	Line     int // Row number in the hex string, from 1.
+	Width    int // Length of the row.
+	Expected int // Width of the other rows, or from the header.
+}
+
+func (e *WidthError) Error() string {
+	return fmt.Sprintf("width mismatch on row %d: it has %d pixels, expected %d", e.Line, e.Width, e.Expected)
+}
+
+func (e *WidthError) Unwrap() error {
+	return ErrWidthMismatch
+}
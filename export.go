@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Byte exports: the sprite is packed into a 1bpp bitmap (one bit per pixel, set for INK) and
+// written either as raw binary or as assembler source.
+
+// byteOrder selects how packed bitmap bytes are laid out: "row", "column" or "screen".
+var byteOrder = "row"
+
+// bitOrder selects which bit holds the leftmost pixel of each byte: "msb" (bit 7) or "lsb" (bit 0).
+var bitOrder = "msb"
+
+// packBitmap packs an indexed image into a row-major 1bpp bitmap, each row padded to a whole byte.
+// A bit is set where the pixel resolves to its 8×8 attribute cell's INK; the leftmost pixel is bit 7,
+// or bit 0 when the bit order is "lsb". It returns the bitmap and the number of bytes per row.
+func packBitmap(m *indexedImage) ([]byte, int) {
+	return packBitmapBits(m, bitOrder == "lsb")
+}
+
+// pixelMask returns the bit of its byte that holds pixel column x.
+func pixelMask(x int, lsb bool) byte {
+	if lsb {
+		return 0x01 << uint(x%8)
+	}
+	return 0x80 >> uint(x%8)
+}
+
+// packBitmapBits is packBitmap with an explicit bit order, for formats whose layout is fixed.
+func packBitmapBits(m *indexedImage, lsb bool) ([]byte, int) {
+	bytesPerRow := (m.width + 7) / 8
+	data := make([]byte, bytesPerRow*m.height)
+	cells, cols := imageAttributes(m)
+	for cy := 0; cy < m.height; cy += 8 {
+		for cx := 0; cx < m.width; cx += 8 {
+			cell := cells[(cy/8)*cols+cx/8]
+			for y := cy; y < cy+8 && y < m.height; y++ {
+				for x := cx; x < cx+8 && x < m.width; x++ {
+					if _, ink := resolveInCell(m.at(x, y), cell); ink {
+						data[y*bytesPerRow+x/8] |= pixelMask(x, lsb)
+					}
+				}
+			}
+		}
+	}
+	return data, bytesPerRow
+}
+
+// screenLineOffset returns the offset of pixel line y from the start of Spectrum display memory,
+// which interleaves lines by thirds (64 lines), pixel line within the character, then character row.
+func screenLineOffset(y int) int {
+	return (y&0xC0)<<5 | (y&0x07)<<8 | (y&0x38)<<2
+}
+
+// orderBytes rearranges row-major bitmap bytes into the given byte order.
+// Column order emits every row of the leftmost byte column, then the next column, and so on,
+// as expected by push-based and other column-oriented Z80 sprite routines. Screen order emits
+// rows in display memory order, so a 256-pixel wide image lands exactly where the Spectrum
+// screen expects it and narrower sprites follow the same line interleave.
+func orderBytes(data []byte, bytesPerRow int, order string) ([]byte, error) {
+	switch order {
+	case "row":
+		return data, nil
+	case "column":
+		rows := len(data) / bytesPerRow
+		out := make([]byte, 0, len(data))
+		for col := 0; col < bytesPerRow; col++ {
+			for row := 0; row < rows; row++ {
+				out = append(out, data[row*bytesPerRow+col])
+			}
+		}
+		return out, nil
+	case "screen":
+		rows := make([]int, len(data)/bytesPerRow)
+		for i := range rows {
+			rows[i] = i
+		}
+		sort.SliceStable(rows, func(i, j int) bool {
+			return screenLineOffset(rows[i]) < screenLineOffset(rows[j])
+		})
+		out := make([]byte, 0, len(data))
+		for _, row := range rows {
+			out = append(out, data[row*bytesPerRow:(row+1)*bytesPerRow]...)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown byte order %q (expected row, column or screen)", order)
+	}
+}
+
+// Padding settings for images whose width is not a multiple of 8.
+var (
+	padPolicy = "right" // Where the padding bits go: "right", "left", or "error" to refuse.
+	padBit    = 0       // Value of the padding bits.
+)
+
+// checkPadSettings validates the padding settings.
+func checkPadSettings() error {
+	switch padPolicy {
+	case "right", "left", "error":
+	default:
+		return fmt.Errorf("unknown padding policy %q (expected right, left or error)", padPolicy)
+	}
+	if padBit != 0 && padBit != 1 {
+		return fmt.Errorf("invalid padding bit %d (expected 0 or 1)", padBit)
+	}
+	return nil
+}
+
+// padImage widens an image to a whole number of bytes for byte exports, following the padding
+// policy. Right padding leaves the image as it is, since packing pads each row on the right; left
+// padding returns a copy with transparent columns added on the left, so the attribute cells line
+// up with the bytes. It also returns the number of columns added on the left.
+func padImage(m *indexedImage) (*indexedImage, int, error) {
+	extra := (8 - m.width%8) % 8
+	if extra == 0 {
+		return m, 0, nil
+	}
+	switch padPolicy {
+	case "error":
+		return nil, 0, fmt.Errorf("%w: width %d is not a multiple of 8 (use --pad left or right)", ErrWidthMismatch, m.width)
+	case "left":
+		p := newIndexedImage(m.width+extra, m.height)
+		for y := 0; y < m.height; y++ {
+			for x := 0; x < m.width; x++ {
+				p.set(x+extra, y, m.at(x, y))
+			}
+		}
+		return p, extra, nil
+	}
+	return m, 0, nil
+}
+
+// setPadBits sets the bits of padding columns in a row-major bitmap: the first left columns and
+// any after the width image columns.
+func setPadBits(data []byte, bytesPerRow, left, width int, lsb bool) {
+	for row := 0; row < len(data)/bytesPerRow; row++ {
+		for x := 0; x < bytesPerRow*8; x++ {
+			if x < left || x >= left+width {
+				data[row*bytesPerRow+x/8] |= pixelMask(x, lsb)
+			}
+		}
+	}
+}
+
+// exportBitmap packs an indexed image and arranges its bytes in the configured order.
+// It returns the bytes and the length of each natural line (a row or a column).
+func exportBitmap(m *indexedImage) ([]byte, int, error) {
+	if bitOrder != "msb" && bitOrder != "lsb" {
+		return nil, 0, fmt.Errorf("unknown bit order %q (expected msb or lsb)", bitOrder)
+	}
+	width := m.width
+	m, left, err := padImage(m)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, bytesPerRow := packBitmap(m)
+	if padBit == 1 {
+		setPadBits(data, bytesPerRow, left, width, bitOrder == "lsb")
+	}
+	ordered, err := orderBytes(data, bytesPerRow, byteOrder)
+	if err != nil {
+		return nil, 0, err
+	}
+	if byteOrder == "column" {
+		return ordered, m.height, nil
+	}
+	return ordered, bytesPerRow, nil
+}
+
+// asmLabel derives an assembler label from a filename, replacing anything that is not a letter,
+// digit or underscore.
+func asmLabel(filename string) string {
+	base := filepath.Base(filename)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	label := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			return r
+		}
+		return '_'
+	}, base)
+	if label == "" || unicode.IsDigit(rune(label[0])) {
+		label = "_" + label
+	}
+	return label
+}
+
+// Source export formatting settings.
+var (
+	bytesPerLine int    // Bytes per defb line or C array row; 0 for the natural line of each export.
+	labelPrefix  string // Prepended to every generated label.
+	hexStyle     string // Byte literal style: "dollar" ($FF), "0x" (0xFF) or "decimal" (255); empty for the language default.
+)
+
+// Assembler placement settings, for dropping asm exports into banked builds: an org address, a
+// section (as z88dk's z80asm names them), a 128K bank paged in with sjasmplus's page directive,
+// and a length equate after every block of data.
+var (
+	asmOrgStr  string // --asm-org, $C000, 0xC000 or 49152; empty for none.
+	asmOrg     = -1   // Parsed from asmOrgStr.
+	asmSection string // --asm-section name; empty for none.
+	asmBankStr string // --asm-bank N; empty for none.
+	asmBank    = -1   // Parsed from asmBankStr.
+	asmLen     bool   // --asm-len: a label_len equate after every block.
+)
+
+// checkSourceSettings validates the source export formatting settings.
+func checkSourceSettings() error {
+	switch hexStyle {
+	case "", "dollar", "0x", "decimal":
+	default:
+		return fmt.Errorf("unknown hex style %q (expected dollar, 0x or decimal)", hexStyle)
+	}
+	if bytesPerLine < 0 {
+		return fmt.Errorf("bytes per line must not be negative")
+	}
+	asmOrg, asmBank = -1, -1
+	if asmOrgStr != "" {
+		s := asmOrgStr
+		if strings.HasPrefix(s, "$") {
+			s = "0x" + s[1:]
+		}
+		n, err := strconv.ParseInt(s, 0, 32)
+		if err != nil || n < 0 || n > 0xFFFF {
+			return fmt.Errorf("invalid --asm-org %q (expected an address such as $C000, 0xC000 or 49152)", asmOrgStr)
+		}
+		asmOrg = int(n)
+	}
+	if asmBankStr != "" {
+		n, err := strconv.Atoi(asmBankStr)
+		if err != nil || n < 0 || n > 255 {
+			return fmt.Errorf("invalid --asm-bank %q (expected a bank number from 0 to 255)", asmBankStr)
+		}
+		asmBank = n
+	}
+	if strings.ContainsAny(asmSection, " \t") {
+		return fmt.Errorf("invalid --asm-section %q: section names cannot contain spaces", asmSection)
+	}
+	return nil
+}
+
+// wordLiteral formats a 16-bit value in the configured style, or in defaultStyle when none was set.
+func wordLiteral(n int, defaultStyle string) string {
+	style := hexStyle
+	if style == "" {
+		style = defaultStyle
+	}
+	switch style {
+	case "0x":
+		return fmt.Sprintf("0x%04X", n)
+	case "decimal":
+		return fmt.Sprintf("%d", n)
+	default:
+		return fmt.Sprintf("$%04X", n)
+	}
+}
+
+// byteLiteral formats a byte in the configured style, or in defaultStyle when none was set.
+func byteLiteral(b byte, defaultStyle string) string {
+	style := hexStyle
+	if style == "" {
+		style = defaultStyle
+	}
+	switch style {
+	case "0x":
+		return fmt.Sprintf("0x%02X", b)
+	case "decimal":
+		return fmt.Sprintf("%d", b)
+	default:
+		return fmt.Sprintf("$%02X", b)
+	}
+}
+
+// sourceLines splits data into lines of perLine bytes, or --bytes-per-line bytes when set, each
+// formatted as a comma-separated list of literals.
+func sourceLines(data []byte, perLine int, defaultStyle string) []string {
+	if bytesPerLine > 0 {
+		perLine = bytesPerLine
+	}
+	if perLine <= 0 {
+		perLine = 8
+	}
+	var lines []string
+	for i := 0; i < len(data); i += perLine {
+		end := i + perLine
+		if end > len(data) {
+			end = len(data)
+		}
+		values := make([]string, 0, end-i)
+		for _, b := range data[i:end] {
+			values = append(values, byteLiteral(b, defaultStyle))
+		}
+		lines = append(lines, strings.Join(values, ","))
+	}
+	return lines
+}
+
+// bytesToAsm formats bytes as assembler source: header comments, a label, then defb lines of
+// perLine bytes each. A block with a header starts a file, so the placement directives follow
+// its header.
+func bytesToAsm(data []byte, label string, perLine int, header []string) string {
+	var sb strings.Builder
+	for _, line := range header {
+		sb.WriteString("; " + line + "\n")
+	}
+	if header != nil {
+		if asmSection != "" {
+			sb.WriteString("\tsection " + asmSection + "\n")
+		}
+		if asmBank >= 0 {
+			sb.WriteString(fmt.Sprintf("\tpage %d\n", asmBank))
+		}
+		if asmOrg >= 0 {
+			sb.WriteString("\torg " + wordLiteral(asmOrg, "dollar") + "\n")
+		}
+		if asmBank >= 0 {
+			sb.WriteString(fmt.Sprintf("%s_bank equ %d\n", label, asmBank))
+		}
+	}
+	sb.WriteString(label + ":\n")
+	for _, line := range sourceLines(data, perLine, "dollar") {
+		sb.WriteString("\tdefb " + line + "\n")
+	}
+	if asmLen {
+		sb.WriteString(fmt.Sprintf("%s_len equ %d\n", label, len(data)))
+	}
+	return sb.String()
+}
+
+// bytesToC formats bytes as C source: header comments, then a const unsigned char array named
+// label with perLine bytes on each row.
+func bytesToC(data []byte, label string, perLine int, header []string) string {
+	var sb strings.Builder
+	for _, line := range header {
+		sb.WriteString("// " + line + "\n")
+	}
+	sb.WriteString(fmt.Sprintf("const unsigned char %s[%d] = {\n", label, len(data)))
+	lines := sourceLines(data, perLine, "0x")
+	for i, line := range lines {
+		line = strings.Replace(line, ",", ", ", -1)
+		if i < len(lines)-1 {
+			line += ","
+		}
+		sb.WriteString("\t" + line + "\n")
+	}
+	sb.WriteString("};\n")
+	return sb.String()
+}
@@ -0,0 +1,61 @@
+package main
+
+import "math"
+
+// Fitting to the screen: an image of any size is resampled with an area-average (box) filter to
+// fit the 256×192 Spectrum screen, keeping its aspect ratio, and quantized straight from the
+// resampled channels, so nothing is rounded to 8 bits in between.
+
+// fitScreen enables fitting images to the screen before they are quantized.
+var fitScreen bool
+
+// fitToScreen resamples an image to fit the screen, centred, with any borders transparent. Each
+// output pixel averages the source pixels under it, weighted by how much of each it covers;
+// transparent source pixels take no part, and an output pixel is transparent when they cover at
+// least half of it.
+func fitToScreen(f *rgbImage) *rgbImage {
+	if f.width == scrWidth && f.height == scrHeight {
+		return f
+	}
+	scale := math.Min(float64(scrWidth)/float64(f.width), float64(scrHeight)/float64(f.height))
+	ow := min(max(int(math.Round(float64(f.width)*scale)), 1), scrWidth)
+	oh := min(max(int(math.Round(float64(f.height)*scale)), 1), scrHeight)
+	offX, offY := (scrWidth-ow)/2, (scrHeight-oh)/2
+
+	out := &rgbImage{width: scrWidth, height: scrHeight, pix: make([][3]float64, scrWidth*scrHeight), opaque: make([]bool, scrWidth*scrHeight)}
+	paper := ZXPalette[paperColour]
+	for i := range out.pix {
+		out.pix[i] = [3]float64{float64(paper.R), float64(paper.G), float64(paper.B)}
+	}
+	sx, sy := float64(f.width)/float64(ow), float64(f.height)/float64(oh)
+	for oy := 0; oy < oh; oy++ {
+		y0, y1 := float64(oy)*sy, float64(oy+1)*sy
+		for ox := 0; ox < ow; ox++ {
+			x0, x1 := float64(ox)*sx, float64(ox+1)*sx
+			var sum [3]float64
+			covered, total := 0.0, 0.0
+			for y := int(y0); y < f.height && float64(y) < y1; y++ {
+				wy := math.Min(y1, float64(y+1)) - math.Max(y0, float64(y))
+				for x := int(x0); x < f.width && float64(x) < x1; x++ {
+					weight := wy * (math.Min(x1, float64(x+1)) - math.Max(x0, float64(x)))
+					total += weight
+					if !f.opaque[y*f.width+x] {
+						continue
+					}
+					p := f.pix[y*f.width+x]
+					for ch := range sum {
+						sum[ch] += p[ch] * weight
+					}
+					covered += weight
+				}
+			}
+			if covered*2 < total || covered == 0 {
+				continue
+			}
+			i := (offY+oy)*scrWidth + offX + ox
+			out.pix[i] = [3]float64{sum[0] / covered, sum[1] / covered, sum[2] / covered}
+			out.opaque[i] = true
+		}
+	}
+	return out
+}
@@ -2,4 +2,4 @@ module github.com/ha1tch/zxtex
 
 go 1.21.6
 
-require golang.org/x/image v0.24.0 // indirect
+require golang.org/x/image v0.24.0
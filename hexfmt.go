@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Hex formatting: "zxtex fmt" rewrites hex files in one canonical form, so hand-edited files diff
+// cleanly and mistakes in them show up straight away. The header is regenerated: the file name,
+// the size taken from the rows, any other fields in the order they were written, free comments,
+// and "# generator: zxtex"; bounding boxes, pivots and animation timings are recomputed. Rows are
+// written in one case, grouped and annotated as the formatting flags say, so the result depends
+// only on the pixels and not on how they were typed. Files that do not parse (rows of different
+// lengths, digits out of range) are reported instead.
+
+// regeneratedFields are the header fields formatting writes afresh rather than copying.
+var regeneratedFields = map[string]bool{
+	"file": true, "width": true, "height": true, "generator": true,
+	"frames": true, "duration": true, "bbox": true, "pivot": true,
+}
+
+// isRuler reports whether a comment is a column ruler written by --annotate.
+func isRuler(comment string) bool {
+	return strings.Trim(comment, "0123456789 ") == "" && strings.TrimSpace(comment) != ""
+}
+
+// headerLines returns the header of hex text that formatting keeps, in order and without the
+// leading "# ": the fields it does not regenerate, and comments other than rulers. It also
+// reports whether the header or any frame recorded a bounding box or a pivot.
+func headerLines(content string) (lines []string, bbox, pivot bool) {
+	scanner := hexScanner(content)
+	inHeader := true
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if !strings.HasPrefix(line, "#") {
+			if strings.TrimSpace(line) != "" {
+				inHeader = false
+			}
+			continue
+		}
+		key, value, ok := headerField(line)
+		bbox = bbox || ok && key == "bbox"
+		pivot = pivot || ok && key == "pivot"
+		if ok && key == "frame" {
+			inHeader = false
+		}
+		if !inHeader {
+			continue
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "#"))
+		switch {
+		case ok && !regeneratedFields[key]:
+			lines = append(lines, key+": "+value)
+		case !ok && comment != "" && !isRuler(comment):
+			lines = append(lines, comment)
+		}
+	}
+	return lines, bbox, pivot
+}
+
+// formatHex returns the canonical form of a hex file, read with the given width (0 for the one
+// in the file).
+func formatHex(ctx context.Context, filename string, width int) (string, error) {
+	data, err := readInput(filename)
+	if err != nil {
+		return "", err
+	}
+	if kind, err := inputKind(data); err != nil || kind != "hex" {
+		return "", fmt.Errorf("%w: not a hex file", ErrUnsupportedFormat)
+	}
+	extra, bbox, pivot := headerLines(string(data))
+	recordBBox, recordPivot = bbox, pivot
+	name := filename
+	if name == stdinName {
+		name = ""
+	}
+	src, err := hexSource(ctx, name, data, width, false)
+	if err != nil {
+		return "", err
+	}
+	if src.anim != nil {
+		return animationToHex(src.anim, src.meta["file"], extra...), nil
+	}
+	if bbox {
+		extra = append(extra, bboxField(src.image))
+	}
+	if pivot {
+		extra = append(extra, pivotField(src.image))
+	}
+	return indexedToHex(src.image, src.meta["file"], extra...), nil
+}
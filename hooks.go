@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Hooks: commands run around each conversion, so zxtex can anchor a pipeline without wrapper
+// scripts. The pre-hook runs before an input is converted (to export it from an editor, say)
+// and the post-hook after, once for every file written (to compress it, or copy it to an SD card
+// image). Either failing fails the conversion.
+
+// Hook commands: a command line in which {} stands for the file and {input} for the input being
+// converted; with no {}, the file is added at the end. Empty for none.
+var (
+	preHook  string
+	postHook string
+)
+
+// toolCommand builds a command from a command line template, with {} replaced by file and
+// {input} by input, or file appended when there is no {}.
+func toolCommand(template, file, input string) *exec.Cmd {
+	words := strings.Fields(template)
+	placed := false
+	for i, word := range words {
+		word = strings.ReplaceAll(word, "{input}", input)
+		if strings.Contains(word, "{}") {
+			word = strings.ReplaceAll(word, "{}", file)
+			placed = true
+		}
+		words[i] = word
+	}
+	if !placed {
+		words = append(words, file)
+	}
+	cmd := exec.Command(words[0], words[1:]...)
+	var stdout io.Writer = os.Stdout
+	if outputToStdout {
+		stdout = os.Stderr // Keep the converted data on standard output clean.
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, stdout, os.Stderr
+	return cmd
+}
+
+// checkHookSettings rejects hooks that name no command.
+func checkHookSettings() error {
+	if preHook != "" && len(strings.Fields(preHook)) == 0 {
+		return fmt.Errorf("--pre-hook needs a command")
+	}
+	if postHook != "" && len(strings.Fields(postHook)) == 0 {
+		return fmt.Errorf("--post-hook needs a command")
+	}
+	return nil
+}
+
+// runHook runs a hook command on a file.
+func runHook(name, template, file, input string) error {
+	cmd := toolCommand(template, file, input)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: running %s: %w", name, cmd.Args[0], err)
+	}
+	return nil
+}
+
+// convertWithHooks converts an input as convertInput does, running the pre-hook on the input
+// first and the post-hook on every file written afterwards.
+func convertWithHooks(ctx context.Context, input, output, outDir string, toFile bool) error {
+	if preHook != "" {
+		if err := runHook("pre-hook", preHook, input, input); err != nil {
+			return err
+		}
+	}
+	if err := convertInput(ctx, input, output, outDir, toFile); err != nil {
+		return err
+	}
+	if postHook != "" {
+		for _, file := range uniqueStrings(writtenFiles) {
+			if err := runHook("post-hook", postHook, file, input); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
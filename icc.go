@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+)
+
+// Colour profiles: Go's PNG decoder hands over the stored samples as they are, but an image
+// exported from a wide-gamut editor describes its colours with an embedded ICC profile (iCCP), or
+// with gamma and primaries chunks (gAMA, cHRM), and taken as sRGB its colours come out wrong:
+// Display P3 reds turn orange and greens lose their saturation, and quantize to the wrong Spectrum
+// colours. PNG inputs, and BMP inputs with a profile embedded in their V5 header, are therefore
+// converted to sRGB first, as browsers do. Matrix and curve ("matrix/TRC") ICC profiles, which
+// cover the RGB working spaces editors export, are understood; other profiles are ignored with a
+// warning. Inputs marked sRGB, or whose profile amounts to sRGB, are left untouched.
+
+// ignoreColourProfile makes all images be read as plain sRGB, whatever profile they carry.
+var ignoreColourProfile bool
+
+// mat3 is a 3×3 matrix, row by row.
+type mat3 [3][3]float64
+
+// mul returns the product m·n.
+func (m mat3) mul(n mat3) mat3 {
+	var out mat3
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				out[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return out
+}
+
+// apply returns m·v.
+func (m mat3) apply(v [3]float64) [3]float64 {
+	var out [3]float64
+	for i := 0; i < 3; i++ {
+		out[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+	return out
+}
+
+// inverse returns the inverse of m.
+func (m mat3) inverse() mat3 {
+	a, b, c := m[0][0], m[0][1], m[0][2]
+	d, e, f := m[1][0], m[1][1], m[1][2]
+	g, h, i := m[2][0], m[2][1], m[2][2]
+	det := a*(e*i-f*h) - b*(d*i-f*g) + c*(d*h-e*g)
+	return mat3{
+		{(e*i - f*h) / det, (c*h - b*i) / det, (b*f - c*e) / det},
+		{(f*g - d*i) / det, (a*i - c*g) / det, (c*d - a*f) / det},
+		{(d*h - e*g) / det, (b*g - a*h) / det, (a*e - b*d) / det},
+	}
+}
+
+var (
+	// xyzD50ToSRGB converts the XYZ of the ICC connection space (D50 white) to linear sRGB,
+	// with Bradford chromatic adaptation to sRGB's D65 white.
+	xyzD50ToSRGB = mat3{
+		{3.1338561, -1.6168667, -0.4906146},
+		{-0.9787684, 1.9161415, 0.0334540},
+		{0.0719453, -0.2289914, 1.4052427},
+	}
+	// bradford converts XYZ to the cone responses of the Bradford chromatic adaptation.
+	bradford = mat3{
+		{0.8951, 0.2664, -0.1614},
+		{-0.7502, 1.7135, 0.0367},
+		{0.0389, -0.0685, 1.0296},
+	}
+	whiteD50 = [3]float64{0.9642, 1, 0.8249}
+	// srgbPrimaries are the chromaticities of sRGB's red, green and blue, and of its D65 white.
+	srgbPrimaries = [4][2]float64{{0.64, 0.33}, {0.30, 0.60}, {0.15, 0.06}, {0.3127, 0.3290}}
+)
+
+// adaptToD50 returns the Bradford adaptation of XYZ colours seen under white to the D50 white.
+func adaptToD50(white [3]float64) mat3 {
+	src, dst := bradford.apply(white), bradford.apply(whiteD50)
+	scale := mat3{{dst[0] / src[0], 0, 0}, {0, dst[1] / src[1], 0}, {0, 0, dst[2] / src[2]}}
+	return bradford.inverse().mul(scale).mul(bradford)
+}
+
+// primariesToD50 returns the matrix from linear RGB with the given primaries and white point
+// (x,y chromaticities of red, green, blue and white) to D50 XYZ.
+func primariesToD50(p [4][2]float64) mat3 {
+	xyz := func(c [2]float64) [3]float64 { return [3]float64{c[0] / c[1], 1, (1 - c[0] - c[1]) / c[1]} }
+	r, g, b, w := xyz(p[0]), xyz(p[1]), xyz(p[2]), xyz(p[3])
+	m := mat3{{r[0], g[0], b[0]}, {r[1], g[1], b[1]}, {r[2], g[2], b[2]}}
+	s := m.inverse().apply(w)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] *= s[j]
+		}
+	}
+	return adaptToD50(w).mul(m)
+}
+
+// toneCurve converts a stored channel value, 0 to 1, to linear light.
+type toneCurve func(v float64) float64
+
+// srgbCurve is the sRGB tone curve.
+func srgbCurve(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// gammaCurve returns a pure power-law tone curve.
+func gammaCurve(gamma float64) toneCurve {
+	return func(v float64) float64 { return math.Pow(v, gamma) }
+}
+
+// colourProfile describes how an image's stored values map to colours: a tone curve per channel
+// (one, for grey images) and a matrix from linear values to D50 XYZ.
+type colourProfile struct {
+	curves [3]toneCurve
+	matrix mat3
+	grey   bool
+}
+
+// isSRGB reports whether a profile is, to within rounding, sRGB itself.
+func (p *colourProfile) isSRGB() bool {
+	srgb := primariesToD50(srgbPrimaries)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if !p.grey && math.Abs(p.matrix[i][j]-srgb[i][j]) > 0.003 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for v := 0.0; v <= 1; v += 0.125 {
+			if math.Abs(curve(v)-srgbCurve(v)) > 0.003 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pngChunks returns the chunks of a PNG file that come before its image data, by type.
+func pngChunks(data []byte) map[string][]byte {
+	chunks := map[string][]byte{}
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return chunks
+	}
+	for pos := 8; pos+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		if kind == "IDAT" || n < 0 || pos+12+n > len(data) {
+			break
+		}
+		chunks[kind] = data[pos+8 : pos+8+n]
+		pos += 12 + n
+	}
+	return chunks
+}
+
+// pngColourProfile returns the colour profile a PNG file declares, or nil when its values are
+// sRGB (as declared, or by default).
+func pngColourProfile(data []byte) (*colourProfile, error) {
+	chunks := pngChunks(data)
+	if _, ok := chunks["sRGB"]; ok {
+		return nil, nil
+	}
+	if iccp, ok := chunks["iCCP"]; ok {
+		// A profile name, a NUL, the compression method (0, zlib) and the compressed profile.
+		nul := bytes.IndexByte(iccp, 0)
+		if nul < 0 || nul+2 > len(iccp) {
+			return nil, fmt.Errorf("malformed iCCP chunk")
+		}
+		r, err := zlib.NewReader(bytes.NewReader(iccp[nul+2:]))
+		if err != nil {
+			return nil, fmt.Errorf("reading ICC profile: %w", err)
+		}
+		icc, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading ICC profile: %w", err)
+		}
+		return parseICC(icc)
+	}
+	gama, hasGamma := chunks["gAMA"]
+	chrm, hasPrimaries := chunks["cHRM"]
+	if !hasGamma && !hasPrimaries {
+		return nil, nil
+	}
+	p := &colourProfile{matrix: primariesToD50(srgbPrimaries)}
+	curve := toneCurve(srgbCurve)
+	if hasGamma && len(gama) == 4 {
+		// gAMA stores the encoding exponent, so decoding raises to its inverse.
+		if g := float64(binary.BigEndian.Uint32(gama)) / 100000; g > 0 {
+			curve = gammaCurve(1 / g)
+		}
+	}
+	p.curves = [3]toneCurve{curve, curve, curve}
+	if hasPrimaries && len(chrm) == 32 {
+		var c [8]float64
+		for i := range c {
+			c[i] = float64(binary.BigEndian.Uint32(chrm[4*i:])) / 100000
+		}
+		// cHRM gives the white point first, then red, green and blue.
+		p.matrix = primariesToD50([4][2]float64{{c[2], c[3]}, {c[4], c[5]}, {c[6], c[7]}, {c[0], c[1]}})
+	}
+	if !hasPrimaries && hasGamma && len(gama) == 4 {
+		// The gAMA of 1/2.2 many editors write on its own is taken as sRGB, as browsers take it.
+		if g := float64(binary.BigEndian.Uint32(gama)); math.Abs(g-45455) < 455 {
+			return nil, nil
+		}
+	}
+	if p.isSRGB() {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// errUnsupportedProfile marks ICC profiles that are not of the matrix/TRC kind.
+var errUnsupportedProfile = fmt.Errorf("%w: only matrix/TRC ICC profiles are understood", ErrUnsupportedFormat)
+
+// parseICC reads an RGB or grey matrix/TRC ICC profile.
+func parseICC(icc []byte) (*colourProfile, error) {
+	if len(icc) < 132 {
+		return nil, fmt.Errorf("ICC profile too short")
+	}
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(icc[128:]))
+	for i := 0; i < count && 132+12*i+12 <= len(icc); i++ {
+		entry := icc[132+12*i:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(icc) {
+			return nil, fmt.Errorf("ICC tag %s lies outside the profile", entry[:4])
+		}
+		tags[string(entry[:4])] = icc[offset : offset+size]
+	}
+	p := &colourProfile{}
+	switch string(icc[16:20]) {
+	case "GRAY":
+		curve, err := iccCurve(tags["kTRC"])
+		if err != nil {
+			return nil, err
+		}
+		p.curves, p.grey = [3]toneCurve{curve, curve, curve}, true
+	case "RGB ":
+		for i, name := range []string{"r", "g", "b"} {
+			curve, err := iccCurve(tags[name+"TRC"])
+			if err != nil {
+				return nil, err
+			}
+			xyz := tags[name+"XYZ"]
+			if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+				return nil, errUnsupportedProfile
+			}
+			p.curves[i] = curve
+			for j := 0; j < 3; j++ {
+				p.matrix[j][i] = s15Fixed16(xyz[8+4*j:])
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: ICC profile for %q colours", ErrUnsupportedFormat, icc[16:20])
+	}
+	if p.isSRGB() {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// s15Fixed16 decodes an ICC signed 15.16 fixed-point number.
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// iccCurve decodes an ICC curv or para tone curve.
+func iccCurve(tag []byte) (toneCurve, error) {
+	if len(tag) < 12 {
+		return nil, errUnsupportedProfile
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(v float64) float64 { return v }, nil
+		case n == 1 && len(tag) >= 14:
+			return gammaCurve(float64(binary.BigEndian.Uint16(tag[12:])) / 256), nil
+		case len(tag) < 12+2*n:
+			return nil, fmt.Errorf("ICC curve too short")
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			// Sampled curves are interpolated linearly between their entries.
+			pos := min(max(v, 0), 1) * float64(n-1)
+			i := min(int(pos), n-2)
+			return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+		}, nil
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:])
+		params := []int{1, 3, 4, 5, 7}
+		if int(kind) >= len(params) || len(tag) < 12+4*params[kind] {
+			return nil, errUnsupportedProfile
+		}
+		var q [7]float64
+		for i := 0; i < params[kind]; i++ {
+			q[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := q[0], q[1], q[2], q[3], q[4], q[5], q[6]
+		return func(v float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(v, g)
+			case 1:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g)
+				}
+				return 0
+			case 2:
+				if v >= -b/a {
+					return math.Pow(a*v+b, g) + c
+				}
+				return c
+			case 3:
+				if v >= d {
+					return math.Pow(a*v+b, g)
+				}
+				return c * v
+			}
+			if v >= d {
+				return math.Pow(a*v+b, g) + e
+			}
+			return c*v + f
+		}, nil
+	}
+	return nil, errUnsupportedProfile
+}
+
+// toSRGB converts an image with the given profile to sRGB, keeping 16 bits per channel.
+// Transparent pixels, including those matched by --transpcolor, are left as they are.
+func (p *colourProfile) toSRGB(img image.Image) *image.NRGBA64 {
+	bounds := img.Bounds()
+	out := image.NewNRGBA64(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	toSRGB := xyzD50ToSRGB.mul(p.matrix)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if r, g, b, a := out.At(x, y).RGBA(); shouldBeTransparent(r, g, b, a) {
+				continue
+			}
+			c := out.NRGBA64At(x, y)
+			in := [3]float64{float64(c.R) / 65535, float64(c.G) / 65535, float64(c.B) / 65535}
+			var lin [3]float64
+			if p.grey {
+				v := p.curves[0](in[0])
+				lin = [3]float64{v, v, v}
+			} else {
+				lin = toSRGB.apply([3]float64{p.curves[0](in[0]), p.curves[1](in[1]), p.curves[2](in[2])})
+			}
+			enc := func(v float64) uint16 {
+				v = min(max(v, 0), 1) // Colours outside sRGB are clipped.
+				if v <= 0.0031308 {
+					v *= 12.92
+				} else {
+					v = 1.055*math.Pow(v, 1/2.4) - 0.055
+				}
+				return uint16(math.Round(v * 65535))
+			}
+			out.SetNRGBA64(x, y, color.NRGBA64{enc(lin[0]), enc(lin[1]), enc(lin[2]), c.A})
+		}
+	}
+	return out
+}
+
+// applyColourProfile converts a decoded PNG or BMP image to sRGB according to the profile it
+// declares. Profiles zxtex cannot read are reported and ignored, as is everything with
+// --ignore-colour-profile.
+func applyColourProfile(data []byte, img image.Image, input string) image.Image {
+	if ignoreColourProfile {
+		return img
+	}
+	var p *colourProfile
+	var err error
+	if bytes.HasPrefix(data, []byte("BM")) {
+		p, err = bmpColourProfile(data)
+	} else {
+		p, err = pngColourProfile(data)
+	}
+	if err != nil {
+		if input == "" {
+			input = "standard input"
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s: %v; reading its colours as sRGB\n", input, err)
+		return img
+	}
+	if p == nil {
+		return img
+	}
+	return p.toSRGB(img)
+}
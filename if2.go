@@ -0,0 +1,49 @@
+package main
+
+// Interface 2 cartridges: the Interface 2's cartridge slot takes a 16K ROM that replaces the
+// Spectrum's own, running from address 0 at power-on. --format if2 builds such a ROM (.rom) that
+// shows the converted screen at boot: a few instructions copy the screen, stored after them, into
+// display memory, set the border (black, unless --border says otherwise) and halt with interrupts
+// off; an NMI returns to the halt. The stack is moved out of display memory, where it may point
+// at power-on, so an NMI cannot spoil the picture. The rest of the ROM is left as blank EPROM
+// ($FF), ready to burn or to load into an emulator as a cartridge.
+
+// IF2 ROM layout.
+const (
+	if2ROMSize    = 16384
+	if2ScreenAddr = 0x0100 // Where the screen is stored in the ROM.
+	if2NMI        = 0x0066 // The Z80's NMI entry point.
+)
+
+// if2Boot is the code at address 0.
+var if2Boot = []byte{
+	0xF3,             // DI
+	0x31, 0x00, 0x80, // LD SP,$8000
+	0x3E, 0x00, // LD A,border
+	0xD3, 0xFE, // OUT ($FE),A
+	0x21, if2ScreenAddr & 0xFF, if2ScreenAddr >> 8, // LD HL,screen
+	0x11, 0x00, 0x40, // LD DE,$4000
+	0x01, scrSize & 0xFF, scrSize >> 8, // LD BC,6912
+	0xED, 0xB0, // LDIR
+	0x76,       // HALT
+	0x18, 0xFD, // JR back to the HALT, after an NMI
+}
+
+// if2BorderAt is the offset in if2Boot of the border colour.
+const if2BorderAt = 5
+
+// if2ROM returns a 16K Interface 2 ROM that displays a screen at boot, with a border colour, or
+// black for -1.
+func if2ROM(scr []byte, border int) []byte {
+	rom := make([]byte, if2ROMSize)
+	for i := range rom {
+		rom[i] = 0xFF
+	}
+	copy(rom, if2Boot)
+	if border >= 0 {
+		rom[if2BorderAt] = byte(border)
+	}
+	copy(rom[if2NMI:], []byte{0xED, 0x45}) // RETN
+	copy(rom[if2ScreenAddr:], scr)
+	return rom
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// IFF images: Amiga pixel art is mostly stored as ILBM, an IFF FORM whose BMHD chunk gives the
+// size and depth, CMAP the palette, CAMG the display mode and BODY the pixels, one bit plane per
+// bit of the colour index, row by row, usually packed with ByteRun1. zxtex reads ILBMs of up to 8
+// planes, Extra Half-Brite images (6 planes, the upper 32 colours being the lower 32 at half
+// brightness) and HAM6 and HAM8 images, and the chunky PBM variant Deluxe Paint writes on the PC.
+// Mask planes and transparent colours are read as transparency.
+
+// IFF bitmap masking modes.
+const (
+	iffMaskPlane       = 1
+	iffTransparentMask = 2
+)
+
+// Amiga display modes in the CAMG chunk.
+const (
+	camgEHB = 0x80
+	camgHAM = 0x800
+)
+
+// isIFF reports whether data is an IFF ILBM or PBM image.
+func isIFF(data []byte) bool {
+	if len(data) < 12 || string(data[:4]) != "FORM" {
+		return false
+	}
+	kind := string(data[8:12])
+	return kind == "ILBM" || kind == "PBM "
+}
+
+// iffChunks returns the chunks of an IFF FORM, by type; only the first of each type is kept.
+func iffChunks(data []byte) map[string][]byte {
+	chunks := map[string][]byte{}
+	end := 8 + int(binary.BigEndian.Uint32(data[4:]))
+	if end > len(data) {
+		end = len(data)
+	}
+	for i := 12; i+8 <= end; {
+		kind, size := string(data[i:i+4]), int(binary.BigEndian.Uint32(data[i+4:]))
+		i += 8
+		if size > end-i {
+			size = end - i
+		}
+		if _, ok := chunks[kind]; !ok {
+			chunks[kind] = data[i : i+size]
+		}
+		// Chunks are padded to an even length.
+		i += size + size&1
+	}
+	return chunks
+}
+
+// unpackByteRun1 expands ByteRun1 (PackBits) data until it has n bytes.
+func unpackByteRun1(data []byte, n int) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(data) && len(out) < n; {
+		c := int(int8(data[i]))
+		i++
+		switch {
+		case c >= 0:
+			if i+c+1 > len(data) {
+				return nil, fmt.Errorf("%w: truncated IFF BODY", ErrUnsupportedFormat)
+			}
+			out = append(out, data[i:i+c+1]...)
+			i += c + 1
+		case c != -128:
+			if i == len(data) {
+				return nil, fmt.Errorf("%w: truncated IFF BODY", ErrUnsupportedFormat)
+			}
+			for k := 0; k < 1-c; k++ {
+				out = append(out, data[i])
+			}
+			i++
+		}
+	}
+	if len(out) < n {
+		return nil, fmt.Errorf("%w: truncated IFF BODY", ErrUnsupportedFormat)
+	}
+	return out[:n], nil
+}
+
+// decodeIFF decodes an IFF ILBM or PBM image.
+func decodeIFF(data []byte) (image.Image, error) {
+	if !isIFF(data) {
+		return nil, fmt.Errorf("%w: not an IFF image", ErrUnsupportedFormat)
+	}
+	chunky := string(data[8:12]) == "PBM "
+	chunks := iffChunks(data)
+	bmhd, body := chunks["BMHD"], chunks["BODY"]
+	if len(bmhd) < 20 || body == nil {
+		return nil, fmt.Errorf("%w: IFF image without a BMHD or BODY chunk", ErrUnsupportedFormat)
+	}
+	be := binary.BigEndian
+	width, height := int(be.Uint16(bmhd[0:])), int(be.Uint16(bmhd[2:]))
+	planes, masking, compression := int(bmhd[8]), bmhd[9], bmhd[10]
+	transparent := int(be.Uint16(bmhd[12:]))
+	var camg uint32
+	if c := chunks["CAMG"]; len(c) >= 4 {
+		camg = be.Uint32(c)
+	}
+	if err := checkImageSize("IFF", width, height); err != nil {
+		return nil, err
+	}
+	if planes < 1 || planes > 8 || chunky && planes != 8 {
+		return nil, fmt.Errorf("%w: IFF images with %d bit planes", ErrUnsupportedFormat, planes)
+	}
+	if compression > 1 {
+		return nil, fmt.Errorf("%w: IFF compression method %d", ErrUnsupportedFormat, compression)
+	}
+
+	// Each row holds every plane in turn, then the mask plane; ILBM planes are padded to 16 bits
+	// and PBM rows to an even number of bytes.
+	rowPlanes := planes
+	if masking == iffMaskPlane {
+		rowPlanes++
+	}
+	planeSize := (width + 15) / 16 * 2
+	rowSize := planeSize * rowPlanes
+	if chunky {
+		rowSize = (width + 1) &^ 1
+	}
+	// A ByteRun1 run takes two bytes and expands to 128 at most, so a BODY too short for the
+	// image is rejected before anything is allocated.
+	limit := len(body)
+	if compression == 1 {
+		limit = (limit + 1) / 2 * 128
+	}
+	if height > limit/rowSize {
+		return nil, fmt.Errorf("%w: truncated IFF BODY", ErrUnsupportedFormat)
+	}
+	pixels := body
+	if compression == 1 {
+		var err error
+		if pixels, err = unpackByteRun1(body, rowSize*height); err != nil {
+			return nil, err
+		}
+	}
+
+	ham := camg&camgHAM != 0 && !chunky && (planes == 6 || planes == 8)
+	palette := iffPalette(chunks["CMAP"], planes, camg&camgEHB != 0 && planes == 6)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := pixels[y*rowSize:]
+		var r, g, b uint8
+		if ham {
+			r, g, b = palette[0][0], palette[0][1], palette[0][2]
+		}
+		for x := 0; x < width; x++ {
+			idx := 0
+			if chunky {
+				idx = int(row[x])
+			} else {
+				for plane := 0; plane < planes; plane++ {
+					idx |= int(row[plane*planeSize+x/8]>>(7-x%8)&1) << plane
+				}
+			}
+			opaque := true
+			switch {
+			case masking == iffMaskPlane:
+				opaque = row[planes*planeSize+x/8]>>(7-x%8)&1 != 0
+			case masking == iffTransparentMask:
+				opaque = idx != transparent
+			}
+			if ham {
+				r, g, b = hamPixel(idx, planes, palette, r, g, b)
+			} else {
+				c := palette[idx%len(palette)]
+				r, g, b = c[0], c[1], c[2]
+			}
+			p := img.Pix[y*img.Stride+4*x:]
+			p[0], p[1], p[2], p[3] = r, g, b, 0
+			if opaque {
+				p[3] = 0xff
+			}
+		}
+	}
+	return img, nil
+}
+
+// iffPalette returns the colours of an IFF image's CMAP chunk, extended to every index its planes
+// can hold: with halved copies for Extra Half-Brite, and with grey shades for images without a
+// palette.
+func iffPalette(cmap []byte, planes int, ehb bool) [][3]uint8 {
+	pal := make([][3]uint8, 1<<planes)
+	n := len(cmap) / 3
+	for i := range pal {
+		switch {
+		case i < n:
+			pal[i] = [3]uint8{cmap[3*i], cmap[3*i+1], cmap[3*i+2]}
+		case ehb && i >= 32:
+			c := pal[i-32]
+			pal[i] = [3]uint8{c[0] >> 1, c[1] >> 1, c[2] >> 1}
+		case n == 0:
+			v := uint8(i * 255 / (len(pal) - 1))
+			pal[i] = [3]uint8{v, v, v}
+		}
+	}
+	return pal
+}
+
+// hamPixel decodes a Hold-And-Modify pixel: its top two bits either pick a palette colour or say
+// which channel of the previous pixel's colour the remaining bits replace.
+func hamPixel(idx, planes int, palette [][3]uint8, r, g, b uint8) (uint8, uint8, uint8) {
+	bits := planes - 2
+	value := idx & (1<<bits - 1)
+	// The new value fills the top bits of the channel, repeated into the low bits.
+	v := uint8(value << (8 - bits))
+	v |= v >> bits
+	switch idx >> bits {
+	case 0:
+		c := palette[value]
+		return c[0], c[1], c[2]
+	case 1:
+		return r, g, v
+	case 2:
+		return v, g, b
+	}
+	return r, v, b
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Width inference: hex data with no header and all its digits on one line, as other tools and
+// bare raw output write it, says nothing about its width. Of the widths that divide it exactly,
+// zxtex picks the one a sprite most likely has: a common sprite or screen width (8, 16, 24, 32 or
+// 256 pixels) giving a shape no more than four times wider than tall or the other way round, else
+// a multiple of 8 within the same bounds, else the shape closest to square. --aspect replaces all
+// that with the shape closest to the one given. Data whose length is prime stays a single row.
+
+// widthAspect is the --aspect hint, as width over height; 0 when none was given.
+var widthAspect float64
+
+// commonWidths are the sprite and screen widths preferred when guessing.
+var commonWidths = map[int]bool{8: true, 16: true, 24: true, 32: true, 256: true}
+
+// maxGuessedAspect bounds how far from square a preferred width may make an image.
+const maxGuessedAspect = 4
+
+// parseAspect parses an --aspect hint: a ratio such as 4:3, or a number such as 1.5.
+func parseAspect(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var aspect float64
+	if ws, hs, ok := strings.Cut(s, ":"); ok {
+		w, werr := strconv.ParseFloat(ws, 64)
+		h, herr := strconv.ParseFloat(hs, 64)
+		if werr == nil && herr == nil && h > 0 {
+			aspect = w / h
+		}
+	} else if v, err := strconv.ParseFloat(s, 64); err == nil {
+		aspect = v
+	}
+	if aspect <= 0 || math.IsInf(aspect, 0) || math.IsNaN(aspect) {
+		return 0, fmt.Errorf("invalid aspect %q (expected W:H, e.g. 4:3, or a ratio such as 1.5)", s)
+	}
+	return aspect, nil
+}
+
+// guessWidth picks a width for total pixels of headerless hex data.
+func guessWidth(total int) int {
+	if total <= 0 {
+		return 0
+	}
+	target := 1.0
+	if widthAspect > 0 {
+		target = widthAspect
+	}
+	// distance measures how far the shape a width gives is from the target, in either direction.
+	distance := func(w int) float64 {
+		return math.Abs(math.Log(float64(w) * float64(w) / float64(total) / target))
+	}
+	best := 0
+	pick := func(accept func(w int) bool) {
+		for w := 1; w <= total; w++ {
+			if total%w != 0 || !accept(w) {
+				continue
+			}
+			// Ties go to the wider shape, a row of cells rather than a column.
+			if best == 0 || distance(w) <= distance(best) {
+				best = w
+			}
+		}
+	}
+	if widthAspect == 0 {
+		bounded := func(w int) bool { return distance(w) <= math.Log(maxGuessedAspect) }
+		pick(func(w int) bool { return commonWidths[w] && bounded(w) })
+		if best == 0 {
+			pick(func(w int) bool { return w%8 == 0 && bounded(w) })
+		}
+	}
+	if best == 0 {
+		pick(func(w int) bool { return true })
+	}
+	return best
+}
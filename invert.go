@@ -0,0 +1,50 @@
+package main
+
+// Inversion: --invert swaps the roles of INK and PAPER in every attribute cell, as fonts and UI
+// assets drawn one way round often need for highlighted or selected states. Each pixel takes the
+// other of its cell's two colours; transparent pixels count as PAPER, so they become INK, and a
+// cell of a single colour swaps it with the default PAPER (or INK, if it is the default PAPER).
+// The byte formats follow from the inverted image: cells that keep the default PAPER come out
+// with their bitmap inverted and the same attribute, and others with INK and PAPER swapped in the
+// attribute and the same bitmap.
+
+// invertInk enables inversion.
+var invertInk bool
+
+// invertCells returns a copy of an image with INK and PAPER swapped in each cellW×cellH cell.
+func invertCells(m *indexedImage, cellW, cellH int) *indexedImage {
+	out := newIndexedImage(m.width, m.height)
+	for cy := 0; cy < m.height; cy += cellH {
+		for cx := 0; cx < m.width; cx += cellW {
+			cell := chooseCellColours(cellPixels(m, cx, cy, cellW, cellH), paperColour)
+			for y := cy; y < cy+cellH && y < m.height; y++ {
+				for x := cx; x < cx+cellW && x < m.width; x++ {
+					if _, ink := resolveInCell(m.at(x, y), cell); ink {
+						out.set(x, y, cell.paperIndex())
+					} else {
+						out.set(x, y, cell.inkIndex())
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// invertSource inverts a loaded source, every frame of an animation included. Full colours no
+// longer match the inverted indices, so they are dropped.
+func invertSource(src *source) {
+	cellSize := 8
+	if src.chunky {
+		cellSize = chunkyCell
+	}
+	src.rgb = nil
+	if src.anim == nil {
+		src.image = invertCells(src.image, cellSize, cellSize)
+		return
+	}
+	for i, frame := range src.anim.frames {
+		src.anim.frames[i] = invertCells(frame, cellSize, cellSize)
+	}
+	src.image = stackFrames(src.anim.frames)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Splitting sheets by islands: every connected group of solid pixels, touching at edges or
+// corners, is cut out as a sprite of its own, so irregularly packed sheets can be ripped without
+// a grid. Each sprite is written with an _iN suffix and a JSON manifest records its offset.
+
+// splitIslands enables splitting images into their islands of solid pixels.
+var splitIslands bool
+
+// islandLayout is the manifest written alongside the sprites of a split sheet.
+type islandLayout struct {
+	Source    string       `json:"source"`
+	Width     int          `json:"width"`
+	Height    int          `json:"height"`
+	Sprites   []islandTile `json:"sprites"`
+	Generator string       `json:"generator"`
+}
+
+// islandTile describes one sprite cut from a sheet.
+type islandTile struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	File   string `json:"file"`
+}
+
+// findIslands returns the islands of solid pixels of an image, in the order their first pixels
+// come in reading order, as the bounding box of each and a copy of the image holding only its
+// own pixels.
+func findIslands(m *indexedImage) ([]bbox, []*indexedImage) {
+	label := make([]int, len(m.pix))
+	var boxes []bbox
+	var sprites []*indexedImage
+	for start := range m.pix {
+		if label[start] != 0 || m.pix[start] == transparentIndex {
+			continue
+		}
+		n := len(boxes) + 1
+		label[start] = n
+		pixels := []int{start}
+		minX, minY, maxX, maxY := m.width, m.height, -1, -1
+		for i := 0; i < len(pixels); i++ {
+			x, y := pixels[i]%m.width, pixels[i]/m.width
+			minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if !solid(m, x+dx, y+dy) {
+						continue
+					}
+					if j := (y+dy)*m.width + x + dx; label[j] == 0 {
+						label[j] = n
+						pixels = append(pixels, j)
+					}
+				}
+			}
+		}
+		b := bbox{X: minX, Y: minY, Width: maxX - minX + 1, Height: maxY - minY + 1}
+		sprite := newIndexedImage(b.Width, b.Height)
+		for _, p := range pixels {
+			sprite.set(p%m.width-minX, p/m.width-minY, m.pix[p])
+		}
+		boxes = append(boxes, b)
+		sprites = append(sprites, sprite)
+	}
+	return boxes, sprites
+}
+
+// writeIslands writes every island of an image to its own file, named after output (or the
+// default output name) with an _iN suffix, then writes the manifest.
+func writeIslands(src *source, m *indexedImage, format, output, outDir string) error {
+	boxes, sprites := findIslands(m)
+	if len(sprites) == 0 {
+		return fmt.Errorf("%w: no solid pixels to split", ErrEmptyData)
+	}
+	if output == "" {
+		output = filepath.Join(outDir, defaultOutputName(src, formatExtensions[format]))
+	}
+	layout := islandLayout{
+		Source:    recordedName(sourceFileName(src)),
+		Width:     m.width,
+		Height:    m.height,
+		Generator: "zxtex",
+	}
+	for i, sprite := range sprites {
+		suffix := fmt.Sprintf("_i%d", i)
+		spriteOutput := withSuffix(output, suffix)
+		if err := writeFormat(suffixedSource(src, suffix), sprite, format, spriteOutput); err != nil {
+			return err
+		}
+		b := boxes[i]
+		layout.Sprites = append(layout.Sprites, islandTile{X: b.X, Y: b.Y, Width: b.Width, Height: b.Height, File: filepath.Base(spriteOutput)})
+	}
+	data, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifest := strings.TrimSuffix(output, filepath.Ext(output)) + "_islands.json"
+	if err := writeOutputFile(manifest, append(data, '\n')); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	statusf("Manifest written to %s\n", manifest)
+	return nil
+}
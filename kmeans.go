@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// K-means pre-quantization: before an image is mapped to the Spectrum palette, its colours can be
+// reduced to K representative ones, found by k-means clustering in CIE Lab space, where distances
+// follow perceived differences. Sensor noise and JPEG speckle collapse into their cluster colour,
+// which steadies dithering on photographic inputs.
+
+// kmeansColours is the number of colours to reduce images to first; 0 skips the stage.
+var kmeansColours int
+
+// kmeansIterations caps the refinement passes of the clustering.
+const kmeansIterations = 20
+
+// lab is a colour in CIE L*a*b* space, relative to the D65 white point.
+type lab [3]float64
+
+// srgbToLinear converts an 8-bit sRGB channel to linear light.
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts linear light to an 8-bit sRGB channel.
+func linearToSRGB(v float64) uint8 {
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(min(max(v, 0), 1) * 255))
+}
+
+// D65 reference white.
+const whiteX, whiteY, whiteZ = 0.95047, 1.0, 1.08883
+
+// labF is the companding function of the XYZ to Lab conversion.
+func labF(t float64) float64 {
+	if t > 216.0/24389 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27*t + 16) / 116
+}
+
+// labFInv inverts labF.
+func labFInv(t float64) float64 {
+	if t*t*t > 216.0/24389 {
+		return t * t * t
+	}
+	return (116*t - 16) * 27 / 24389
+}
+
+// toLab converts an sRGB colour to Lab.
+func toLab(r, g, b uint8) lab {
+	lr, lg, lb := srgbToLinear(r), srgbToLinear(g), srgbToLinear(b)
+	x := (0.4124*lr + 0.3576*lg + 0.1805*lb) / whiteX
+	y := (0.2126*lr + 0.7152*lg + 0.0722*lb) / whiteY
+	z := (0.0193*lr + 0.1192*lg + 0.9505*lb) / whiteZ
+	fx, fy, fz := labF(x), labF(y), labF(z)
+	return lab{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// rgb converts a Lab colour back to sRGB.
+func (c lab) rgb() (uint8, uint8, uint8) {
+	fy := (c[0] + 16) / 116
+	x := labFInv(fy+c[1]/500) * whiteX
+	y := labFInv(fy) * whiteY
+	z := labFInv(fy-c[2]/200) * whiteZ
+	lr := 3.2406*x - 1.5372*y - 0.4986*z
+	lg := -0.9689*x + 1.8758*y + 0.0415*z
+	lb := 0.0557*x - 0.2040*y + 1.0570*z
+	return linearToSRGB(lr), linearToSRGB(lg), linearToSRGB(lb)
+}
+
+// labDistance returns the squared distance between two Lab colours.
+func labDistance(a, b lab) float64 {
+	d0, d1, d2 := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return d0*d0 + d1*d1 + d2*d2
+}
+
+// packRGB packs a colour into a single sortable number.
+func packRGB(c [3]uint8) int {
+	return int(c[0])<<16 | int(c[1])<<8 | int(c[2])
+}
+
+// reduceColours returns a copy of an image with its opaque colours reduced to at most k, each
+// pixel replaced by the centre of its k-means cluster. Pixels the transparency settings make
+// transparent are copied unchanged and take no part. The centres start evenly spread through the
+// pixels in order of lightness, so the result does not depend on chance. It stops early,
+// returning the context's error, if ctx is cancelled.
+func reduceColours(ctx context.Context, img image.Image, k int) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+
+	// Cluster each distinct colour once, weighted by how often it appears.
+	counts := map[[3]uint8]int{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := rgba.At(x, y).RGBA()
+			if !shouldBeTransparent(r, g, b, a) {
+				counts[[3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}]++
+			}
+		}
+	}
+	if len(counts) <= k {
+		return rgba, nil
+	}
+	keys := make([][3]uint8, 0, len(counts))
+	for c := range counts {
+		keys = append(keys, c)
+	}
+	// Map order is random; sorting keeps the floating-point sums, and so the result, repeatable.
+	sort.Slice(keys, func(a, b int) bool { return packRGB(keys[a]) < packRGB(keys[b]) })
+	colours := make([]lab, len(keys))
+	for i, c := range keys {
+		colours[i] = toLab(c[0], c[1], c[2])
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return colours[order[a]][0] < colours[order[b]][0] })
+	centres := make([]lab, k)
+	for i := range centres {
+		centres[i] = colours[order[(2*i+1)*len(order)/(2*k)]]
+	}
+
+	cluster := make([]int, len(colours))
+	for iter := 0; iter < kmeansIterations; iter++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		changed := iter == 0
+		for i, c := range colours {
+			best := 0
+			for j := range centres {
+				if labDistance(c, centres[j]) < labDistance(c, centres[best]) {
+					best = j
+				}
+			}
+			if cluster[i] != best {
+				cluster[i], changed = best, true
+			}
+		}
+		if !changed {
+			break
+		}
+		sums := make([]lab, k)
+		weights := make([]float64, k)
+		for i, c := range colours {
+			w := float64(counts[keys[i]])
+			for ch := range c {
+				sums[cluster[i]][ch] += c[ch] * w
+			}
+			weights[cluster[i]] += w
+		}
+		for j := range centres {
+			// A centre left without colours stays where it is.
+			if weights[j] > 0 {
+				centres[j] = lab{sums[j][0] / weights[j], sums[j][1] / weights[j], sums[j][2] / weights[j]}
+			}
+		}
+	}
+
+	replace := make(map[[3]uint8]color.RGBA, len(keys))
+	for i, c := range keys {
+		r, g, b := centres[cluster[i]].rgb()
+		replace[c] = color.RGBA{r, g, b, 255}
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := rgba.At(x, y).RGBA()
+			if !shouldBeTransparent(r, g, b, a) {
+				rgba.SetRGBA(x, y, replace[[3]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)}])
+			}
+		}
+	}
+	return rgba, nil
+}
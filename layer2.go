@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"path/filepath"
+	"strings"
+)
+
+// Spectrum Next Layer 2: a 256-colour bitmap with one byte per pixel, an index into the Next's
+// default RRRGGGBB palette. The 256×192 mode stores rows top to bottom; the 320×256 mode stores
+// columns left to right. Either way the data is paged in as 8K banks, so it is written pre-split
+// into them, with an assembler include giving each bank's number and offset.
+
+// layer2Bank is the 16K bank where Layer 2 starts, as set in Next register $12 (8 after reset).
+var layer2Bank = 8
+
+const (
+	layer2PageSize    = 8192
+	layer2Pages       = 224  // 8K pages in 2MB of Next memory.
+	layer2Transparent = 0xE3 // The default global transparency colour.
+)
+
+// checkLayer2Settings validates the Layer 2 settings.
+func checkLayer2Settings() error {
+	if layer2Bank < 0 || 2*layer2Bank >= layer2Pages {
+		return fmt.Errorf("--layer2-bank must be a 16K bank from 0 to %d, got %d", layer2Pages/2-1, layer2Bank)
+	}
+	return nil
+}
+
+// layer2Colour returns the index of the Next palette colour closest to c. Opaque pixels never
+// take the transparency colour, using the nearest colour that is not transparent instead.
+func layer2Colour(pal []color.RGBA, cache map[color.RGBA]byte, c color.RGBA) byte {
+	if i, ok := cache[c]; ok {
+		return i
+	}
+	best, bestDist := 0, -1
+	for i, p := range pal {
+		if i == layer2Transparent {
+			continue
+		}
+		dr, dg, db := int(c.R)-int(p.R), int(c.G)-int(p.G), int(c.B)-int(p.B)
+		if d := dr*dr + dg*dg + db*db; bestDist < 0 || d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	cache[c] = byte(best)
+	return byte(best)
+}
+
+// layer2Data returns the Layer 2 pixel bytes of an image, which must be 256×192 or 320×256. The
+// colours of the original image are used when it is available at the same size, and the palette
+// colours of its indices otherwise. Transparent pixels take the transparency colour.
+func layer2Data(src *source, m *indexedImage) ([]byte, error) {
+	columns := false
+	switch {
+	case m.width == 256 && m.height == 192:
+	case m.width == 320 && m.height == 256:
+		columns = true
+	default:
+		return nil, fmt.Errorf("%w: Layer 2 images must be 256×192 or 320×256, not %d×%d", ErrUnsupportedFormat, m.width, m.height)
+	}
+	rgb := src.rgb
+	if m != src.image || rgb == nil || rgb.Bounds().Dx() != m.width || rgb.Bounds().Dy() != m.height {
+		rgb = nil
+	}
+	pal, cache := nextPalette(), map[color.RGBA]byte{}
+	data := make([]byte, m.width*m.height)
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			offset := y*m.width + x
+			if columns {
+				offset = x*m.height + y
+			}
+			index := m.pix[y*m.width+x]
+			switch {
+			case index == transparentIndex:
+				data[offset] = layer2Transparent
+			case rgb != nil:
+				min := rgb.Bounds().Min
+				c := color.RGBAModel.Convert(rgb.At(min.X+x, min.Y+y)).(color.RGBA)
+				data[offset] = layer2Colour(pal, cache, color.RGBA{c.R, c.G, c.B, 255})
+			default:
+				data[offset] = layer2Colour(pal, cache, ZXPalette[index])
+			}
+		}
+	}
+	return data, nil
+}
+
+// writeLayer2 writes an image as Layer 2 banks, one file each with a _bN suffix, and an include
+// file defining the number and image offset of every bank.
+func writeLayer2(src *source, m *indexedImage, output string) error {
+	if output == stdoutName {
+		return fmt.Errorf("Layer 2 images are written as bank files and an include, and cannot go to standard output")
+	}
+	data, err := layer2Data(src, m)
+	if err != nil {
+		return err
+	}
+	pages := len(data) / layer2PageSize
+	first := 2 * layer2Bank
+	if first+pages > layer2Pages {
+		return fmt.Errorf("a %d×%d Layer 2 image does not fit in memory from bank %d", m.width, m.height, layer2Bank)
+	}
+	label := sourceLabel(src) + "_l2"
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("; Layer 2 image %s: %dx%d, %d banks of 8K from 16K bank %d\n", recordedName(sourceFileName(src)), m.width, m.height, pages, layer2Bank))
+	sb.WriteString("; Generated by zxtex\n")
+	sb.WriteString(fmt.Sprintf("%s_banks equ %d\n", label, pages))
+	sb.WriteString(fmt.Sprintf("%s_first equ %d\n", label, first))
+	for i := 0; i < pages; i++ {
+		bankOutput := withSuffix(output, fmt.Sprintf("_b%d", i))
+		if err := writeOutputFile(bankOutput, data[i*layer2PageSize:(i+1)*layer2PageSize]); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+		statusf("Layer 2 bank %d written to %s\n", first+i, bankOutput)
+		sb.WriteString(fmt.Sprintf("%s_bank%d equ %d\t; %s\n", label, i, first+i, filepath.Base(bankOutput)))
+		sb.WriteString(fmt.Sprintf("%s_offset%d equ $%04X\n", label, i, i*layer2PageSize))
+	}
+	include := strings.TrimSuffix(output, filepath.Ext(output)) + "_banks.asm"
+	if err := writeOutputFile(include, []byte(sb.String())); err != nil {
+		return fmt.Errorf("writing bank include: %w", err)
+	}
+	statusf("Bank include written to %s\n", include)
+	return nil
+}
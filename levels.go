@@ -0,0 +1,70 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Auto levels: dim or washed-out reference photos use only part of the brightness range, so most
+// of their pixels land on the same few palette colours. Stretching the range first, so that the
+// darkest pixels become black and the brightest white, brings out the detail quantization would
+// otherwise flatten.
+
+// autoLevels enables stretching the brightness range of images before they are quantized.
+var autoLevels bool
+
+// levelsClip is the fraction of pixels at each end of the brightness range that are allowed to
+// clip, so a few stray specks do not hold the stretch back.
+const levelsClip = 0.005
+
+// stretchLevels stretches an image's brightness histogram to the full range. Every channel is
+// scaled alike, so hues are kept; transparent pixels are left as they are and take no part.
+func stretchLevels(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+
+	var histogram [256]int
+	total := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := nrgba.At(x, y).RGBA()
+			if shouldBeTransparent(r, g, b, a) {
+				continue
+			}
+			c := nrgba.NRGBAAt(x, y)
+			histogram[(299*int(c.R)+587*int(c.G)+114*int(c.B)+500)/1000]++
+			total++
+		}
+	}
+	clip := int(float64(total) * levelsClip)
+	lo, hi := 0, 255
+	for n := 0; lo < 255 && n+histogram[lo] <= clip; lo++ {
+		n += histogram[lo]
+	}
+	for n := 0; hi > 0 && n+histogram[hi] <= clip; hi-- {
+		n += histogram[hi]
+	}
+	if hi <= lo || lo == 0 && hi == 255 {
+		return nrgba // A flat image, or one that already spans the range.
+	}
+
+	scale := 255 / float64(hi-lo)
+	var lut [256]uint8
+	for v := range lut {
+		lut[v] = uint8(math.Round(min(max((float64(v)-float64(lo))*scale, 0), 255)))
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := nrgba.At(x, y).RGBA()
+			if shouldBeTransparent(r, g, b, a) {
+				continue
+			}
+			c := nrgba.NRGBAAt(x, y)
+			c.R, c.G, c.B = lut[c.R], lut[c.G], lut[c.B]
+			nrgba.SetNRGBA(x, y, c)
+		}
+	}
+	return nrgba
+}
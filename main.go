@@ -0,0 +1,532 @@
+//go:build !js
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+// parseArgs parses command line arguments into a flag set, allowing flags to follow the inputs
+// (as in "zxtex invader.png --raw"), and returns the inputs. Everything after "--" is an input.
+func parseArgs(fs *flag.FlagSet, rest []string) []string {
+	var args []string
+	for {
+		fs.Parse(rest)
+		remaining := fs.Args()
+		if len(remaining) == 0 {
+			return args
+		}
+		if n := len(rest) - len(remaining); n > 0 && rest[n-1] == "--" {
+			return append(args, remaining...)
+		}
+		args = append(args, remaining[0])
+		rest = remaining[1:]
+	}
+}
+
+func main() {
+	rawMode := flag.Bool("raw", false, "Output as a single continuous hex string with no header or row breaks, after a WxH: size prefix")
+	bareFlag := flag.Bool("bare", false, "With --raw, leave out the size prefix too (implies --raw)")
+	widthFlag := flag.Int("width", 0, "Width for output image when converting from hex data (mandatory in direct string mode)")
+	aspectFlag := flag.String("aspect", "", "Shape to guess for hex data without a width, as W:H (e.g. 4:3) or a ratio")
+	output := flag.String("output", "", "Output filename (- for standard output)")
+	// New flags for transparent colour override.
+	transpColorFlag := flag.String("transpcolor", "", "Transparent color (in web format, e.g. #aabbcc) to use as transparent")
+	transpColourFlag := flag.String("transpcolour", "", "Transparent colour (in web format, e.g. #aabbcc) to use as transparent")
+	transpIndexFlag := flag.Int("transpindex", -1, "Palette index to treat as transparent")
+	chunkyFlag := flag.Bool("chunky", false, "Chunky low-res mode: 2x2 pixel blocks with two colours per 8x8 attribute cell")
+	formatFlag := flag.String("format", "", "Output format: hex, png, bin, asm, attr, attr-hex, attr-asm, c, attr-c, attr-grid, agd-sprite, agd-block, scr, png-preview, gif, onion, mask, mask-hex, mask-asm, mask-c, bbox, godot, engine-json, sna, z80, if2 or layer2; several may be separated by commas (default: hex for images, png for hex data)")
+	orderFlag := flag.String("order", "row", "Byte order for bin/asm exports: row, column or screen")
+	bitOrderFlag := flag.String("bitorder", "msb", "Bit holding the leftmost pixel in bin/asm exports: msb (bit 7) or lsb (bit 0)")
+	paperFlag := flag.Int("paper", 0, "Default PAPER colour (0-7) for transparent pixels and single-colour cells")
+	brightFlag := flag.String("bright", "majority", "BRIGHT selection for attribute cells: majority, coverage, on or off")
+	animateFlashFlag := flag.Bool("animate-flash", false, "Decode SCR inputs as the two phases of their FLASH cycle, written as an animated GIF by default")
+	cropFlag := flag.String("crop", "", "Region x,y,w,h of image inputs to convert, cut out before anything else (default: the whole image)")
+	fitScreenFlag := flag.Bool("fit-screen", false, "Resample images to fit the 256x192 screen with an area-average filter before quantizing them")
+	ignoreProfileFlag := flag.Bool("ignore-colour-profile", false, "Read PNG and BMP colours as sRGB, ignoring any embedded ICC profile, BMP colour space or gAMA and cHRM chunks")
+	depthDitherFlag := flag.Bool("depth-dither", false, "Dither 16-bit images when reducing them to 8 bits per channel, against banding in gradients")
+	autoLevelsFlag := flag.Bool("auto-levels", false, "Stretch the brightness range of images to the full range before quantizing them")
+	kmeansFlag := flag.Int("kmeans", 0, "Reduce images to K representative colours (k-means in Lab space) before mapping them to the palette; 0 for none")
+	mapFlag := flag.String("map", "", "Source colours to convert to given palette indices, whatever the nearest colour, as #rrggbb>N,... (e.g. #ff8800>A)")
+	constraintMaskFlag := flag.String("constraint-mask", "", "Image the size of the input whose colours mark regions limited to the colours --allow gives")
+	allowFlag := flag.String("allow", "", "Palette indices each constraint mask colour permits, as #rrggbb=digits,... (e.g. #ff0000=07F)")
+	quantizeFlag := flag.String("quantize", "nearest", "Colour mapping for images: nearest (each pixel to its nearest colour) or cell (each 8x8 cell to its best INK/PAPER/BRIGHT)")
+	ditherStrengthFlag := flag.Float64("dither-strength", 1, "Dither strength from 0 (none) to 1 (full), scaling the diffused error or the ordered pattern")
+	serpentineFlag := flag.Bool("serpentine", false, "Scan alternate rows in opposite directions when diffusing dither error")
+	ditherFlag := flag.String("dither", "none", "Dithering inside attribute cells with --quantize cell: none, ordered, blue-noise or floyd-steinberg")
+	forceFlag := flag.Bool("force", false, "Overwrite existing output files, including hex text files")
+	noClobberFlag := flag.Bool("no-clobber", false, "Never overwrite an existing output file")
+	brightReportFlag := flag.Bool("bright-report", false, "Report attribute cells whose BRIGHT choice was ambiguous (to standard error)")
+	clashReportFlag := flag.Bool("clash-report", false, "Report attribute cells that clash, with the best INK/PAPER pair for each (to standard error)")
+	flashFlag := flag.Bool("flash", false, "Set FLASH in every attribute cell")
+	invertFlag := flag.Bool("invert", false, "Swap INK and PAPER in every attribute cell")
+	toggleBrightFlag := flag.Bool("toggle-bright", false, "Move every colour to the other half of the palette (1-7 to 9-F and back)")
+	setBrightFlag := flag.String("set-bright", "", "Move every colour to the bright (on) or normal (off) half of the palette")
+	regionFlag := flag.String("region", "", "Rectangle x,y,w,h that --toggle-bright and --set-bright apply to (default: the whole image)")
+	outDirFlag := flag.String("outdir", "", "Directory for output files when converting several inputs")
+	reproFlag := flag.Bool("repro", false, "Reproducible output: record only base filenames in metadata")
+	blockTypeFlag := flag.String("block-type", "EMPTYBLOCK", "AGD block type for agd-block exports (EMPTYBLOCK, PLATFORMBLOCK, WALLBLOCK, LADDERBLOCK, FODDERBLOCK, DEADLYBLOCK or CUSTOMBLOCK)")
+	plus3Flag := flag.Bool("plus3dos", false, "Prepend a +3DOS header to binary outputs (bin, attr, scr)")
+	loadAddressFlag := flag.Int("load-address", 0, "CODE load address recorded in +3DOS headers (default: 16384 for scr, 32768 otherwise)")
+	hobetaFlag := flag.Bool("hobeta", false, "Wrap binary outputs (bin, attr, scr) as Hobeta files for TR-DOS")
+	trdFlag := flag.String("trd", "", "Add binary outputs to this TR-DOS .trd disk image (created if missing) instead of writing files")
+	dskFlag := flag.String("dsk", "", "Add binary outputs to this +3 .dsk disk image (created if missing) instead of writing files")
+	tapFlag := flag.String("tap", "", "Add binary outputs to this .tap tape image (created if missing) instead of writing files")
+	loaderFlag := flag.Bool("loader", false, "With --dsk or --tap, also write a loader program that loads every CODE file on the disk or tape")
+	borderFlag := flag.Int("border", -1, "Border colour (0-7) recorded in hex headers and set by snapshots, Interface 2 ROMs and the loader")
+	loaderBorderFlag := flag.Int("loader-border", -1, "BORDER colour (0-7) the loader sets before loading")
+	loaderClearFlag := flag.Int("loader-clear", 0, "Address the loader gives to CLEAR before loading")
+	loaderUSRFlag := flag.Int("loader-usr", -1, "Address the loader calls with RANDOMIZE USR once everything is loaded, instead of waiting for a key")
+	loaderREMFlag := flag.String("loader-rem", "", "Banner text for a REM line at the top of the loader")
+	bytesPerLineFlag := flag.Int("bytes-per-line", 0, "Bytes per line in asm and C exports (default: one bitmap row, column or attribute row)")
+	labelPrefixFlag := flag.String("label-prefix", "", "Prefix for labels in asm and C exports")
+	asmOrgFlag := flag.String("asm-org", "", "Address for an org directive at the top of asm exports ($C000, 0xC000 or 49152)")
+	asmSectionFlag := flag.String("asm-section", "", "Section directive at the top of asm exports, e.g. BANK_3 for z88dk")
+	asmBankFlag := flag.String("asm-bank", "", "128K bank paged in with a page directive (sjasmplus) at the top of asm exports, also given as a label_bank equate")
+	asmLenFlag := flag.Bool("asm-len", false, "Add a label_len equate giving the length of every block of data in asm exports")
+	hexStyleFlag := flag.String("hex-style", "", "Byte literal style in asm and C exports: dollar ($FF), 0x (0xFF) or decimal (255)")
+	padFlag := flag.String("pad", "right", "Padding for byte exports of images whose width is not a multiple of 8: right, left or error")
+	padBitFlag := flag.Int("pad-bit", 0, "Value (0 or 1) of padding bits in byte exports")
+	alignFlag := flag.Int("align", 0, "Pad binary outputs to a multiple of N bytes, e.g. 256 for a page or 16384 for a bank")
+	padByteFlag := flag.Int("pad-byte", 0, "Value of the padding bytes added by --align (decimal or 0x hex)")
+	byteReportFlag := flag.Bool("byte-report", false, "Report the entropy, most common values and longest runs of binary outputs (to standard error)")
+	compressFlag := flag.String("compress", "", "compare: print the sizes of binary outputs packed with RLE, ZX0 and ZX7, and their decompression times (to standard error)")
+	splitBytesFlag := flag.Int("split-bytes", 0, "Split binary outputs into chunks of N bytes (_b0, _b1, ...), e.g. 16384 for 128K banks, with an index")
+	islandsFlag := flag.Bool("islands", false, "Cut every connected group of solid pixels out as its own sprite (_i0, _i1, ...) with a manifest of offsets")
+	slicesFlag := flag.String("slices", "", "JSON file of named rectangles to cut out of each input as sprites of their own (_name)")
+	splitFlag := flag.Bool("split-screens", false, "Tile images larger than 256x192 into screen-sized outputs (_r0c0, _r0c1, ...) with a layout manifest")
+	scrollFlag := flag.String("scroll", "", "Export a scroll strip in chunks, in the order a screen scrolling left, right, up or down draws them (bin, asm and c)")
+	chunkCellsFlag := flag.Int("chunk-cells", 1, "Width (or height, when scrolling up or down) of scroll strip chunks, in 8-pixel cells")
+	annotateFlag := flag.Bool("annotate", false, "Add a column ruler and row number comments to hex output")
+	groupFlag := flag.Int("group", 0, "Insert a space every N digits of each hex row (e.g. 8 to show attribute cells)")
+	lowercaseFlag := flag.Bool("lowercase", false, "Write hex digits in lowercase")
+	rowSepFlag := flag.String("row-separator", "/", "Character marking row breaks in direct hex strings")
+	decodeFlag := flag.Bool("decode", false, "Read every input as hex text (same as --type hex)")
+	rawInputFlag := flag.Bool("raw-input", false, "Read every input as raw pixels of the --size and --pixfmt given (same as --type raw)")
+	sizeFlag := flag.String("size", "", "Image size of raw inputs, as WxH")
+	pixfmtFlag := flag.String("pixfmt", "rgb24", "Pixel format of raw inputs: rgb24 or rgba32")
+	typeFlag := flag.String("type", "auto", "Input type: auto (detected from the content), image, scr, tap, tzx, hex or raw")
+	layer2BankFlag := flag.Int("layer2-bank", 8, "16K bank where Layer 2 starts, for the bank numbers in layer2 includes")
+	snapshotFlag := flag.String("snapshot", "", "Snapshot (.sna or .z80) whose screen the sna and z80 formats replace")
+	attrFlag := flag.String("attr", "", "Attribute file (768 bytes) to join with each 6144-byte bitmap input into a screen")
+	tapeBlockFlag := flag.String("tape-block", "", "Tape block to decode from .tap and .tzx inputs: a block number or a file name (default: the first 6912-byte block)")
+	variantsFlag := flag.String("variants", "", "Write rotated and mirrored copies of the sprite: 4dir, 8dir or mirror")
+	variantLayoutFlag := flag.String("variant-layout", "files", "Variant output: files (one per variant) or strip (side by side in one output)")
+	durationFlag := flag.Int("duration", 0, "Time each animation frame is shown for, in milliseconds (recorded in hex output and used for GIF export)")
+	frameDurationsFlag := flag.String("frame-durations", "", "Comma-separated per-frame times for animations, in milliseconds")
+	maskModeFlag := flag.String("mask-mode", "pixel", "Collision mask resolution: pixel, erode (ignore edge pixels) or cell")
+	bboxFlag := flag.Bool("bbox", false, "Record the bounding box of the solid pixels in hex and source headers")
+	pivotFlag := flag.Bool("pivot", false, "Record the pivot (centroid of the solid pixels) in hex and source headers")
+	alignPivotFlag := flag.Bool("align-pivot", false, "Move animation frames so that their pivots line up")
+	crtFlag := flag.Bool("crt", false, "Render png and png-preview outputs as a CRT television would show them: scanlines, PAL pixel aspect and a mild bloom")
+	palBleedFlag := flag.Float64("pal-bleed", 0, "Colour bleed strength (0-1) of a PAL composite preview for png and png-preview outputs")
+	paletteFlag := flag.String("palette", "spectrum", "Palette for colour matching and rendering: spectrum or a 16-colour palette file")
+	preHookFlag := flag.String("pre-hook", "", "Command run before each conversion, with {} for the input")
+	postHookFlag := flag.String("post-hook", "", "Command run on every file a conversion writes, with {} for the file and {input} for the input")
+	depsFlag := flag.String("deps", "", "Write a makefile fragment listing the files each conversion read and wrote")
+	runFlag := flag.String("run", "", "Open the screen, snapshot or disk image written in an emulator: a program such as fuse or zesarux, or a command line with {} for the file")
+	duplicatesFlag := flag.String("duplicates", "", "In a batch, find hex and binary outputs identical to earlier ones: report them, or link them to the first")
+	cacheFlag := flag.String("cache", "", "Record conversions in this cache file and skip inputs whose outputs are already up to date")
+	zipFlag := flag.String("zip", "", "Write every output file into this zip archive instead of the filesystem")
+	verifyFlag := flag.Bool("verify", false, "Read back every hex, png and scr file written and fail if it does not decode to the encoded image")
+	cpuProfileFlag := flag.String("cpuprofile", "", "Write a CPU profile of the conversions to this file, for go tool pprof")
+	memProfileFlag := flag.String("memprofile", "", "Write a memory profile to this file once the conversions finish, for go tool pprof")
+	traceFlag := flag.String("trace", "", "Write an execution trace of the conversions to this file, for go tool trace")
+	timeoutFlag := flag.Duration("timeout", 0, "Abandon the conversion after this long (e.g. 30s); 0 for no limit")
+
+	// Subcommands parse their own flags; the conversion flags are defined first all the same, so
+	// that the completion command can list them.
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	args := parseArgs(flag.CommandLine, os.Args[1:])
+
+	// Use either transpcolor or transpcolour if provided.
+	if *transpColorFlag != "" {
+		transpColorStr = *transpColorFlag
+	} else if *transpColourFlag != "" {
+		transpColorStr = *transpColourFlag
+	}
+	transpIndex = *transpIndexFlag
+	byteOrder = *orderFlag
+	bitOrder = *bitOrderFlag
+	paperColour = *paperFlag
+	brightMode = *brightFlag
+	quantizeMode = *quantizeFlag
+	kmeansColours = *kmeansFlag
+	colourMapStr = *mapFlag
+	if err := checkColourMapSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	autoLevels = *autoLevelsFlag
+	depthDither = *depthDitherFlag
+	ignoreColourProfile = *ignoreProfileFlag
+	fitScreen = *fitScreenFlag
+	cropStr = *cropFlag
+	if err := checkCropSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	ditherMode = *ditherFlag
+	serpentine = *serpentineFlag
+	ditherAmount = *ditherStrengthFlag
+	flashCells = *flashFlag
+	invertInk = *invertFlag
+	toggleBright = *toggleBrightFlag
+	setBright = *setBrightFlag
+	regionStr = *regionFlag
+	if err := checkBrightOpSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	forceOverwrite = *forceFlag
+	noClobber = *noClobberFlag
+	outputFormat = *formatFlag
+	animateFlash = *animateFlashFlag
+	if animateFlash && outputFormat == "" {
+		outputFormat = "gif"
+	}
+	rawOutput = *rawMode || *bareFlag
+	bareOutput = *bareFlag
+	hexWidth = *widthFlag
+	aspect, err := parseAspect(*aspectFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	widthAspect = aspect
+	chunkyMode = *chunkyFlag
+	brightReport = *brightReportFlag
+	clashReport = *clashReportFlag
+	reproducible = *reproFlag
+	agdBlockType = strings.ToUpper(*blockTypeFlag)
+	plus3Header = *plus3Flag
+	loadAddress = *loadAddressFlag
+	hobetaOutput = *hobetaFlag
+	trdImage = *trdFlag
+	dskImage = *dskFlag
+	writeLoader = *loaderFlag
+	tapImage = *tapFlag
+	loaderBorder = *loaderBorderFlag
+	borderColour = *borderFlag
+	loaderClear = *loaderClearFlag
+	loaderUSR = *loaderUSRFlag
+	loaderREM = *loaderREMFlag
+	bytesPerLine = *bytesPerLineFlag
+	labelPrefix = *labelPrefixFlag
+	hexStyle = *hexStyleFlag
+	asmOrgStr = *asmOrgFlag
+	asmSection = *asmSectionFlag
+	asmBankStr = *asmBankFlag
+	asmLen = *asmLenFlag
+	padPolicy = *padFlag
+	padBit = *padBitFlag
+	splitScreens = *splitFlag
+	splitIslands = *islandsFlag
+	sliceFile = *slicesFlag
+	splitBytes = *splitBytesFlag
+	alignBytes = *alignFlag
+	padByte = *padByteFlag
+	byteReport = *byteReportFlag
+	compressMode = *compressFlag
+	if err := checkCompressSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	scrollDirection = *scrollFlag
+	chunkCells = *chunkCellsFlag
+	annotateHex = *annotateFlag
+	hexGroup = *groupFlag
+	lowercaseHex = *lowercaseFlag
+	rowSeparator = *rowSepFlag
+	inputType = *typeFlag
+	tapeBlockSelector = *tapeBlockFlag
+	attrFile = *attrFlag
+	if err := checkAttrSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	snapshotTemplate = *snapshotFlag
+	layer2Bank = *layer2BankFlag
+	if err := checkLayer2Settings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *decodeFlag {
+		inputType = "hex"
+	}
+	if *rawInputFlag {
+		inputType = "raw"
+	}
+	if err := checkInputType(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	rawSize = *sizeFlag
+	rawPixelFormat = *pixfmtFlag
+	if err := checkRawSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	variantSet = *variantsFlag
+	variantLayout = *variantLayoutFlag
+	if err := checkVariantSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	animDuration = *durationFlag
+	frameDurations = *frameDurationsFlag
+	if err := checkDurationSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	recordBBox = *bboxFlag
+	recordPivot = *pivotFlag
+	alignPivot = *alignPivotFlag
+	maskMode = *maskModeFlag
+	if err := checkMaskSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	paletteName = *paletteFlag
+	crtPreview = *crtFlag
+	palBleed = *palBleedFlag
+	if err := checkPreviewSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := applyPalette(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if rowSeparator == "" || filterHexString(rowSeparator) != "" {
+		fmt.Fprintln(os.Stderr, "Error: the row separator must not be empty, a hex digit or '.'")
+		os.Exit(1)
+	}
+	outputToStdout = *output == stdoutName
+	if outputToStdout && (splitScreens || splitIslands || sliceFile != "" || splitBytes > 0 || trdImage != "" || dskImage != "" || tapImage != "") {
+		fmt.Fprintln(os.Stderr, "Error: --output - cannot be combined with --split-screens, --islands, --slices, --split-bytes, --trd, --dsk or --tap")
+		os.Exit(1)
+	}
+	if forceOverwrite && noClobber {
+		fmt.Fprintln(os.Stderr, "Error: --force and --no-clobber cannot be used together")
+		os.Exit(1)
+	}
+	if err := checkAttributeSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkQuantizeSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	constraintMaskFile = *constraintMaskFlag
+	constraintSpec = *allowFlag
+	if err := checkConstraintSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkTRDOSSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkScrollSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkPadSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkSliceSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkSourceSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkDSKSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkBankSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkTAPSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkBorderSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkLoaderSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkLoadAddress(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	runCommand = *runFlag
+	zipOutput = *zipFlag
+	depsFile = *depsFlag
+	preHook = *preHookFlag
+	postHook = *postHookFlag
+	if err := checkHookSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkRunSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	duplicateMode = *duplicatesFlag
+	if err := checkDuplicateSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkZipSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	verifyOutput = *verifyFlag
+	cacheFile = *cacheFlag
+	if err := checkCacheSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// Every setting given on the command line goes into the cache keys, except those that do not
+	// change what a conversion writes.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "cache", "output", "outdir", "duplicates", "deps", "run", "timeout", "cpuprofile", "memprofile", "trace":
+			return
+		}
+		cacheSettings = append(cacheSettings, f.Name+"="+f.Value.String())
+	})
+	if err := checkVerifySettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	// With no inputs, read hex text piped in on standard input.
+	if info, err := os.Stdin.Stat(); len(args) == 0 && err == nil && info.Mode()&os.ModeCharDevice == 0 {
+		args = []string{stdinName}
+	}
+	if len(args) < 1 {
+		fmt.Println("Usage: zxtex <input>... [--type auto|image|scr|tap|tzx|hex|raw|--decode|--raw-input [--size WxH] [--pixfmt rgb24|rgba32]] [--tape-block N|name] [--attr file.attr] [--animate-flash] [--raw [--bare]] [--annotate] [--group N] [--lowercase] [--width N|--aspect W:H] [--row-separator /] [--output file|-] [--outdir dir] [--transpcolor #aabbcc|--transpindex N] [--chunky] [--crop x,y,w,h] [--fit-screen] [--ignore-colour-profile] [--depth-dither] [--auto-levels] [--kmeans K] [--map #rrggbb>N,...] [--constraint-mask mask.png --allow #rrggbb=digits,...] [--quantize nearest|cell [--dither none|ordered|blue-noise|floyd-steinberg [--dither-strength 0..1] [--serpentine]]] [--split-screens] [--islands] [--slices slices.json] [--split-bytes N] [--align N [--pad-byte 0x00]] [--compress compare] [--byte-report] [--variants 4dir|8dir|mirror [--variant-layout files|strip]] [--scroll left|right|up|down [--chunk-cells N]] [--format hex|png|bin|asm|attr|attr-hex|attr-asm|c|attr-c|attr-grid|agd-sprite|agd-block|scr|png-preview|gif|onion|mask|mask-hex|mask-asm|mask-c|bbox|godot|engine-json|sna|z80|if2|layer2[,...]] [--snapshot template.sna|template.z80] [--border N] [--layer2-bank N] [--bbox] [--pivot] [--align-pivot] [--mask-mode pixel|erode|cell] [--duration MS] [--frame-durations MS,...] [--bytes-per-line N] [--label-prefix P] [--hex-style dollar|0x|decimal] [--asm-org ADDR] [--asm-section NAME] [--asm-bank N] [--asm-len] [--block-type TYPE] [--paper N] [--bright majority|coverage|on|off] [--bright-report] [--clash-report] [--flash] [--invert] [--toggle-bright|--set-bright on|off [--region x,y,w,h]] [--order row|column|screen] [--bitorder msb|lsb] [--pad right|left|error] [--pad-bit 0|1] [--plus3dos|--hobeta|--trd disk.trd|--dsk disk.dsk|--tap tape.tap [--loader [--loader-border N] [--loader-clear N] [--loader-usr N] [--loader-rem TEXT]]] [--load-address N] [--run emulator|command] [--deps file.d] [--pre-hook command] [--post-hook command] [--force|--no-clobber] [--palette file] [--crt] [--pal-bleed 0..1] [--verify] [--duplicates report|link] [--zip archive.zip] [--cache file] [--repro] [--timeout 30s] [--cpuprofile file] [--memprofile file] [--trace file]")
+		fmt.Println("       zxtex palette-chart [--palette spectrum|ulaplus|next|file] [--output chart.png]")
+		fmt.Println("       zxtex pattern gradient|checker|bars [--size WxH] [--format hex,png] [--output file] [--outdir dir]")
+		fmt.Println("       zxtex random sprite|noise [--size WxH] [--seed N] [--count N] [--format hex,png] [--output file] [--outdir dir]")
+		fmt.Println("       zxtex play anim.hex [--fps N] [--loops N]")
+		fmt.Println("       zxtex atlas <sprite>... [--cell-align] [--pow2] [--format hex,png] [--output file] [--outdir dir]")
+		fmt.Println("       zxtex unpack <atlas.json>... [--format hex] [--outdir dir]")
+		fmt.Println("       zxtex blocks <tape>...")
+		fmt.Println("       zxtex build <recipe> [--jobs N] [--dry-run]")
+		fmt.Println("       zxtex catalog <dir|file>... [--output catalog.html] [--title T] [--scale N]")
+		fmt.Println("       zxtex fmt <file.hex>... [--write|--check] [--width N] [--group N] [--lowercase] [--annotate]")
+		fmt.Println("       zxtex completion bash|zsh|fish")
+		os.Exit(1)
+	}
+
+	// Ctrl-C, or the timeout, cancels the conversions in progress.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutFlag)
+		defer cancel()
+	}
+
+	cpuProfile = *cpuProfileFlag
+	memProfile = *memProfileFlag
+	traceFile = *traceFlag
+	if err := startProfiling(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	defer stopProfiling()
+	if cacheFile != "" {
+		if err := loadCache(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+
+	inputs, err := expandInputs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if len(inputs) == 1 && *outDirFlag == "" && !isDir(args[0]) && !isZip(args[0]) {
+		// Outputs going into an archive are never printed instead.
+		if err := convertCached(ctx, inputs[0], *output, "", zipOutput != ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if err := saveCache(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if err := writeZip(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		recordDeps(inputs[0])
+		if err := writeDeps(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+		if runCommand != "" {
+			stopProfiling() // Leave the emulator out of the profiles.
+			if err := launchEmulator(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				exit(1)
+			}
+		}
+		return
+	}
+	if *output != "" {
+		fmt.Fprintln(os.Stderr, "Error: --output names a single file; use --outdir when converting several inputs")
+		exit(1)
+	}
+	failed := runBatch(ctx, inputs, *outDirFlag)
+	if err := saveCache(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if err := writeZip(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if err := writeDeps(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		exit(1)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d conversions failed\n", failed, len(inputs))
+		exit(1)
+	}
+	if runCommand != "" {
+		stopProfiling()
+		if err := launchEmulator(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			exit(1)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import "fmt"
+
+// Collision masks: one bit per pixel, set where the sprite is solid (not transparent), packed
+// like the bitmap export so the mask lines up byte for byte with the sprite data. Masks can be
+// eroded, so that glancing contact does not count, or reduced to one bit per 8×8 cell.
+
+// maskMode selects the mask resolution: "pixel", "erode" or "cell".
+var maskMode = "pixel"
+
+// checkMaskSettings validates the mask settings.
+func checkMaskSettings() error {
+	switch maskMode {
+	case "pixel", "erode", "cell":
+		return nil
+	}
+	return fmt.Errorf("unknown mask mode %q (expected pixel, erode or cell)", maskMode)
+}
+
+// solid reports whether a pixel is inside the image and not transparent.
+func solid(m *indexedImage, x, y int) bool {
+	return x >= 0 && y >= 0 && x < m.width && y < m.height && m.at(x, y) != transparentIndex
+}
+
+// maskBits returns the mask of an image as a grid of bits: for each pixel, or for each cell in
+// cell mode, where a cell counts as solid when any of its pixels is. Eroding keeps only solid
+// pixels whose four neighbours are solid too.
+func maskBits(m *indexedImage) ([]bool, int, int) {
+	if maskMode == "cell" {
+		cols, rows := (m.width+7)/8, (m.height+7)/8
+		bits := make([]bool, cols*rows)
+		for cy := 0; cy < rows; cy++ {
+			for cx := 0; cx < cols; cx++ {
+				for y := cy * 8; y < cy*8+8 && y < m.height; y++ {
+					for x := cx * 8; x < cx*8+8 && x < m.width; x++ {
+						if solid(m, x, y) {
+							bits[cy*cols+cx] = true
+						}
+					}
+				}
+			}
+		}
+		return bits, cols, rows
+	}
+	bits := make([]bool, m.width*m.height)
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			bits[y*m.width+x] = solid(m, x, y) && (maskMode != "erode" ||
+				solid(m, x-1, y) && solid(m, x+1, y) && solid(m, x, y-1) && solid(m, x, y+1))
+		}
+	}
+	return bits, m.width, m.height
+}
+
+// collisionMask exports the collision mask of an image. Pixel masks are padded, bit-ordered and
+// byte-ordered like the bitmap export; cell masks are always row-major. It returns the mask bytes,
+// the line length for text output, and the mask width and height in bits.
+func collisionMask(m *indexedImage) ([]byte, int, int, int, error) {
+	if bitOrder != "msb" && bitOrder != "lsb" {
+		return nil, 0, 0, 0, fmt.Errorf("unknown bit order %q (expected msb or lsb)", bitOrder)
+	}
+	if maskMode != "cell" {
+		padded, _, err := padImage(m)
+		if err != nil {
+			return nil, 0, 0, 0, err
+		}
+		m = padded
+	}
+	bits, w, h := maskBits(m)
+	bytesPerRow := (w + 7) / 8
+	data := make([]byte, bytesPerRow*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if bits[y*w+x] {
+				data[y*bytesPerRow+x/8] |= pixelMask(x, bitOrder == "lsb")
+			}
+		}
+	}
+	if maskMode == "cell" {
+		return data, bytesPerRow, w, h, nil
+	}
+	ordered, err := orderBytes(data, bytesPerRow, byteOrder)
+	if err != nil {
+		return nil, 0, 0, 0, err
+	}
+	if byteOrder == "column" {
+		return ordered, h, w, h, nil
+	}
+	return ordered, bytesPerRow, w, h, nil
+}
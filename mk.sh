@@ -7,21 +7,26 @@ BASENAME="zxtex"
 BINDIR="./bin"
 
 # Build for Windows
-GOOS=windows GOARCH=amd64 go build  -o $BINDIR/$BASENAME.win64.exe   zxtex.go
-GOOS=windows GOARCH=386   go build  -o $BINDIR/$BASENAME.win32.exe   zxtex.go
+GOOS=windows GOARCH=amd64 go build  -o $BINDIR/$BASENAME.win64.exe   .
+GOOS=windows GOARCH=386   go build  -o $BINDIR/$BASENAME.win32.exe   .
 
 # Build for Linux
-GOOS=linux   GOARCH=amd64 go build  -o $BINDIR/$BASENAME.linux64     zxtex.go
-GOOS=linux   GOARCH=386   go build  -o $BINDIR/$BASENAME.linux32     zxtex.go
+GOOS=linux   GOARCH=amd64 go build  -o $BINDIR/$BASENAME.linux64     .
+GOOS=linux   GOARCH=386   go build  -o $BINDIR/$BASENAME.linux32     .
 
 # Build for macOS (modern architectures)
-GOOS=darwin  GOARCH=arm64 go build  -o $BINDIR/$BASENAME.mac64.m1    zxtex.go
-GOOS=darwin  GOARCH=amd64 go build  -o $BINDIR/$BASENAME.mac64.intel zxtex.go
+GOOS=darwin  GOARCH=arm64 go build  -o $BINDIR/$BASENAME.mac64.m1    .
+GOOS=darwin  GOARCH=amd64 go build  -o $BINDIR/$BASENAME.mac64.intel .
 
 # Build for Raspberry Pi
-GOOS=linux   GOARCH=arm   GOARM=6  go build  -o $BINDIR/$BASENAME.rpi.arm6   zxtex.go  # Pi 1, Pi Zero
-GOOS=linux   GOARCH=arm   GOARM=7  go build  -o $BINDIR/$BASENAME.rpi.arm7   zxtex.go  # Pi 2, Pi 3 (32-bit)
-GOOS=linux   GOARCH=arm64          go build  -o $BINDIR/$BASENAME.rpi.arm64  zxtex.go  # Pi 3, Pi 4, Pi 5 (64-bit)
+GOOS=linux   GOARCH=arm   GOARM=6  go build  -o $BINDIR/$BASENAME.rpi.arm6   .  # Pi 1, Pi Zero
+GOOS=linux   GOARCH=arm   GOARM=7  go build  -o $BINDIR/$BASENAME.rpi.arm7   .  # Pi 2, Pi 3 (32-bit)
+GOOS=linux   GOARCH=arm64          go build  -o $BINDIR/$BASENAME.rpi.arm64  .  # Pi 3, Pi 4, Pi 5 (64-bit)
+
+# Build for WebAssembly (browser-based tools), with the matching JavaScript support file.
+# Go 1.24 moved wasm_exec.js from misc/wasm to lib/wasm.
+GOOS=js      GOARCH=wasm  go build  -o $BINDIR/$BASENAME.wasm        .
+cp "$(go env GOROOT)/lib/wasm/wasm_exec.js" $BINDIR/ 2>/dev/null || cp "$(go env GOROOT)/misc/wasm/wasm_exec.js" $BINDIR/
 
 # ---------------------------------------------------------------
 # Important Note on 32-bit macOS (i386) Builds
@@ -38,7 +43,7 @@ GOOS=linux   GOARCH=arm64          go build  -o $BINDIR/$BASENAME.rpi.arm64  zxt
 # If you STILL need to generate 32-bit Intel binaries for macOS and have installed
 # Go 1.15 (or earlier), you can attempt the following build command:
 #
-# GOOS=darwin  GOARCH=386 go build  -o $BINDIR/$BASENAME.mac32.intel zxtex.go
+# GOOS=darwin  GOARCH=386 go build  -o $BINDIR/$BASENAME.mac32.intel .
 #
 # However, this is completely unsupported and untested in modern Go versions.
 # There are no guarantees that this will work.
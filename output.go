@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output protection settings.
+var (
+	forceOverwrite bool // Overwrite any existing output file, including hex text files.
+	noClobber      bool // Never overwrite an existing output file.
+)
+
+// checkClobber refuses to overwrite an existing file when --no-clobber is set, and refuses to
+// overwrite existing hex text files (which are often edited by hand) unless --force is set.
+func checkClobber(filename string) error {
+	if forceOverwrite || !fileExists(filename) {
+		return nil
+	}
+	if noClobber {
+		return fmt.Errorf("%s already exists (not overwriting because of --no-clobber)", filename)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hex", ".txt":
+		return fmt.Errorf("%s already exists (use --force to overwrite hex files)", filename)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to filename, then renames it into place,
+// so a failed conversion never leaves a truncated file behind. An existing file keeps its mode.
+func writeFileAtomic(filename string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(filename); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, mode); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	writtenFiles = append(writtenFiles, filename)
+	return nil
+}
+
+// stdoutName is the output name that writes to standard output.
+const stdoutName = "-"
+
+// outputToStdout is set when output data goes to standard output, so progress messages must go
+// to standard error instead.
+var outputToStdout bool
+
+// statusf prints a progress message.
+func statusf(format string, args ...interface{}) {
+	if outputToStdout {
+		fmt.Fprintf(os.Stderr, format, args...)
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// writeOutputFile writes an output file, honouring the overwrite protection settings, or writes
+// the data to standard output when the filename is "-", or into the archive given with --zip.
+func writeOutputFile(filename string, data []byte) error {
+	if filename == stdoutName {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	if zipOutput != "" {
+		addToZip(filename, data)
+		writtenFiles = append(writtenFiles, filename)
+		return nil
+	}
+	if err := checkClobber(filename); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Palettes: the built-in Spectrum palette, custom 16-colour palettes loaded from a file (to match
+// an emulator or editor), and the extended ULAplus and Spectrum Next colour sets, which can be
+// charted but not used for hex data, since a hex digit only holds 16 colours.
+
+// paletteName selects the palette: "spectrum", "ulaplus", "next" or the name of a palette file.
+var paletteName = "spectrum"
+
+// spectrumColourNames names the eight Spectrum colours; indices 8-15 are their bright versions.
+var spectrumColourNames = []string{"black", "blue", "red", "magenta", "green", "cyan", "yellow", "white"}
+
+// channel3 expands a 3-bit colour channel to 8 bits.
+func channel3(v byte) uint8 {
+	return v<<5 | v<<2 | v>>1
+}
+
+// blue2 expands a 2-bit blue channel to 3 bits, the way the ULAplus and Next hardware do: the low
+// bit is set when either of the others is.
+func blue2(b byte) byte {
+	b &= 3
+	return b<<1 | (b>>1 | b&1)
+}
+
+// ulaplusPalette returns the 256 colours a ULAplus palette entry can hold, indexed by their
+// GGGRRRBB byte.
+func ulaplusPalette() []color.RGBA {
+	pal := make([]color.RGBA, 256)
+	for i := range pal {
+		b := byte(i)
+		pal[i] = color.RGBA{channel3(b >> 2 & 7), channel3(b >> 5), channel3(blue2(b)), 255}
+	}
+	return pal
+}
+
+// nextPalette returns the Spectrum Next's default 256-colour palette, indexed by its RRRGGGBB byte.
+func nextPalette() []color.RGBA {
+	pal := make([]color.RGBA, 256)
+	for i := range pal {
+		b := byte(i)
+		pal[i] = color.RGBA{channel3(b >> 5), channel3(b >> 2 & 7), channel3(blue2(b)), 255}
+	}
+	return pal
+}
+
+// parsePaletteFile reads a custom palette: one web colour (e.g. "#d70000") per line, optionally
+// followed by a name. Blank lines and lines starting with ";" are ignored.
+func parsePaletteFile(data []byte) ([]color.RGBA, error) {
+	var pal []color.RGBA
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		c, err := parseWebColor(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		pal = append(pal, c)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(pal) == 0 {
+		return nil, fmt.Errorf("%w: no colours in palette", ErrEmptyData)
+	}
+	return pal, nil
+}
+
+// loadPalette returns the named palette.
+func loadPalette(name string) ([]color.RGBA, error) {
+	switch name {
+	case "spectrum":
+		return ZXPalette, nil
+	case "ulaplus":
+		return ulaplusPalette(), nil
+	case "next":
+		return nextPalette(), nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("reading palette: %w", err)
+	}
+	pal, err := parsePaletteFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("palette %s: %w", name, err)
+	}
+	return pal, nil
+}
+
+// applyPalette replaces the Spectrum palette used for colour matching and rendering with the
+// selected one, which must have exactly 16 colours.
+func applyPalette() error {
+	if paletteName == "spectrum" {
+		return nil
+	}
+	pal, err := loadPalette(paletteName)
+	if err != nil {
+		return err
+	}
+	if len(pal) != len(ZXPalette) {
+		return fmt.Errorf("palette %s has %d colours; conversions need %d", paletteName, len(pal), len(ZXPalette))
+	}
+	ZXPalette = pal
+	return nil
+}
+
+// paletteLabel returns the label of a palette entry: its hex digit for 16-colour palettes, as in
+// hex data, and its two-digit index byte otherwise.
+func paletteLabel(pal []color.RGBA, i int) string {
+	if len(pal) <= 16 {
+		return fmt.Sprintf("%X", i)
+	}
+	return fmt.Sprintf("%02X", i)
+}
+
+// paletteListing returns one line per palette entry mapping its index to its RGB value, with the
+// colour name for the Spectrum palette layout.
+func paletteListing(pal []color.RGBA) string {
+	var sb strings.Builder
+	for i, c := range pal {
+		sb.WriteString(fmt.Sprintf("%3d  %-2s  #%02x%02x%02x", i, paletteLabel(pal, i), c.R, c.G, c.B))
+		if len(pal) == len(ZXPalette) {
+			name := spectrumColourNames[i%8]
+			if i >= 8 {
+				name = "bright " + name
+			}
+			sb.WriteString("  " + name)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Palette chart layout, in pixels.
+const (
+	swatchWidth  = 56
+	swatchHeight = 28
+	chartCellW   = 64
+	chartCellH   = 64
+)
+
+// paletteChart draws a palette as a grid of swatches, each labelled with its index and RGB value.
+// The Spectrum palette is laid out as a row of normal colours above a row of bright ones; larger
+// palettes have 16 swatches per row.
+func paletteChart(pal []color.RGBA) *image.RGBA {
+	cols := 16
+	if len(pal) == len(ZXPalette) {
+		cols = 8
+	}
+	rows := (len(pal) + cols - 1) / cols
+	img := image.NewRGBA(image.Rect(0, 0, cols*chartCellW, rows*chartCellH))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{48, 48, 48, 255}), image.Point{}, draw.Src)
+	d := &font.Drawer{Dst: img, Src: image.White, Face: basicfont.Face7x13}
+	for i, c := range pal {
+		x, y := i%cols*chartCellW+(chartCellW-swatchWidth)/2, i/cols*chartCellH+4
+		draw.Draw(img, image.Rect(x, y, x+swatchWidth, y+swatchHeight), image.NewUniform(c), image.Point{}, draw.Src)
+		for n, label := range []string{paletteLabel(pal, i), fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)} {
+			d.Dot = fixed.P(x, y+swatchHeight+13*(n+1))
+			d.DrawString(label)
+		}
+	}
+	return img
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+)
+
+// PCX images: the format of Deluxe Paint and most DOS-era paint programs, still written by
+// retro tools, and not covered by the standard library or x/image. A 128-byte header is followed
+// by run-length encoded scan lines, each holding one line of every plane in turn. zxtex reads the
+// common layouts: 1, 2, 4 or 8 bits in a single plane, 1-bit EGA planes, and 24- and 32-bit
+// images with a plane per channel.
+
+// pcxHeaderSize is the size of the PCX file header.
+const pcxHeaderSize = 128
+
+// egaPalette is the default 16-colour palette, for PCX files that do not give their own.
+var egaPalette = color.Palette{
+	color.RGBA{0x00, 0x00, 0x00, 0xff}, color.RGBA{0x00, 0x00, 0xaa, 0xff},
+	color.RGBA{0x00, 0xaa, 0x00, 0xff}, color.RGBA{0x00, 0xaa, 0xaa, 0xff},
+	color.RGBA{0xaa, 0x00, 0x00, 0xff}, color.RGBA{0xaa, 0x00, 0xaa, 0xff},
+	color.RGBA{0xaa, 0x55, 0x00, 0xff}, color.RGBA{0xaa, 0xaa, 0xaa, 0xff},
+	color.RGBA{0x55, 0x55, 0x55, 0xff}, color.RGBA{0x55, 0x55, 0xff, 0xff},
+	color.RGBA{0x55, 0xff, 0x55, 0xff}, color.RGBA{0x55, 0xff, 0xff, 0xff},
+	color.RGBA{0xff, 0x55, 0x55, 0xff}, color.RGBA{0xff, 0x55, 0xff, 0xff},
+	color.RGBA{0xff, 0xff, 0x55, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff},
+}
+
+// isPCX reports whether data starts with a plausible PCX header. PCX has no signature beyond its
+// first byte, so the other header fields are checked too.
+func isPCX(data []byte) bool {
+	if len(data) < pcxHeaderSize || data[0] != 0x0a || data[2] > 1 {
+		return false
+	}
+	switch data[1] {
+	case 0, 2, 3, 4, 5:
+	default:
+		return false
+	}
+	switch data[3] {
+	case 1, 2, 4, 8:
+	default:
+		return false
+	}
+	le := binary.LittleEndian
+	return le.Uint16(data[8:]) >= le.Uint16(data[4:]) && le.Uint16(data[10:]) >= le.Uint16(data[6:]) && data[65] >= 1 && data[65] <= 4
+}
+
+// decodePCX decodes a PCX image: an image.Paletted for images of up to 8 bits per pixel, and an
+// image.NRGBA for those with a plane per channel.
+func decodePCX(data []byte) (image.Image, error) {
+	if !isPCX(data) {
+		return nil, fmt.Errorf("%w: not a PCX file", ErrUnsupportedFormat)
+	}
+	le := binary.LittleEndian
+	width := int(le.Uint16(data[8:])) - int(le.Uint16(data[4:])) + 1
+	height := int(le.Uint16(data[10:])) - int(le.Uint16(data[6:])) + 1
+	depth, planes := int(data[3]), int(data[65])
+	bytesPerLine := int(le.Uint16(data[66:]))
+	if err := checkImageSize("PCX", width, height); err != nil {
+		return nil, err
+	}
+	if bytesPerLine*8 < width*depth {
+		return nil, fmt.Errorf("%w: PCX lines of %d bytes are too short for %d pixels", ErrUnsupportedFormat, bytesPerLine, width)
+	}
+
+	// Runs are decoded as one stream, as some encoders let them cross scan lines.
+	// A run takes two bytes and expands to 63 at most, so an image larger than the data allows is
+	// truncated, and is rejected before anything is allocated.
+	lineSize := bytesPerLine * planes
+	limit := len(data) - pcxHeaderSize
+	if data[2] != 0 {
+		limit = (limit + 1) / 2 * 63
+	}
+	if height > limit/lineSize {
+		return nil, fmt.Errorf("%w: truncated PCX image data", ErrUnsupportedFormat)
+	}
+	size := lineSize * height
+	var pixels []byte
+	for i := pcxHeaderSize; i < len(data) && len(pixels) < size; i++ {
+		b := data[i]
+		if data[2] == 0 || b&0xc0 != 0xc0 {
+			pixels = append(pixels, b)
+			continue
+		}
+		i++
+		if i == len(data) {
+			break
+		}
+		for n := int(b & 0x3f); n > 0 && len(pixels) < size; n-- {
+			pixels = append(pixels, data[i])
+		}
+	}
+	if len(pixels) < size {
+		return nil, fmt.Errorf("%w: truncated PCX image data", ErrUnsupportedFormat)
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	if depth == 8 && planes >= 3 {
+		img := image.NewNRGBA(bounds)
+		for y := 0; y < height; y++ {
+			line := pixels[y*lineSize:]
+			for x := 0; x < width; x++ {
+				p := img.Pix[y*img.Stride+4*x:]
+				p[0], p[1], p[2], p[3] = line[x], line[bytesPerLine+x], line[2*bytesPerLine+x], 0xff
+				if planes == 4 {
+					p[3] = line[3*bytesPerLine+x]
+				}
+			}
+		}
+		return img, nil
+	}
+	if depth*planes > 8 {
+		return nil, fmt.Errorf("%w: PCX images with %d planes of %d bits", ErrUnsupportedFormat, planes, depth)
+	}
+
+	img := image.NewPaletted(bounds, pcxPalette(data, depth, planes))
+	for y := 0; y < height; y++ {
+		line := pixels[y*lineSize:]
+		for x := 0; x < width; x++ {
+			// Each plane holds one bit of a pixel's index, or, with a single plane, all of them.
+			idx := 0
+			for plane := 0; plane < planes; plane++ {
+				bit := x * depth
+				b := line[plane*bytesPerLine+bit/8]
+				v := int(b>>(8-depth-bit%8)) & (1<<depth - 1)
+				idx |= v << (plane * depth)
+			}
+			if idx >= len(img.Palette) {
+				idx = len(img.Palette) - 1
+			}
+			img.SetColorIndex(x, y, uint8(idx))
+		}
+	}
+	return img, nil
+}
+
+// pcxPalette returns the palette of an indexed PCX image: the 256 colours after the image data
+// for 8-bit images, black and white for 1-bit ones and the 16 colours in the header otherwise,
+// or their defaults when the file has none.
+func pcxPalette(data []byte, depth, planes int) color.Palette {
+	bits := depth * planes
+	switch {
+	case bits == 8:
+		if n := len(data) - 769; n >= pcxHeaderSize && data[n] == 0x0c {
+			pal := make(color.Palette, 256)
+			for i := range pal {
+				c := data[n+1+3*i:]
+				pal[i] = color.RGBA{c[0], c[1], c[2], 0xff}
+			}
+			return pal
+		}
+		pal := make(color.Palette, 256)
+		for i := range pal {
+			pal[i] = color.RGBA{uint8(i), uint8(i), uint8(i), 0xff}
+		}
+		return pal
+	case bits == 1:
+		return color.Palette{color.RGBA{0, 0, 0, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}}
+	}
+	// Version 3 files have no palette, and some others leave the header's zeroed.
+	pal := egaPalette
+	header := data[16:64]
+	if data[1] != 3 && !allZero(header) {
+		pal = make(color.Palette, 16)
+		for i := range pal {
+			pal[i] = color.RGBA{header[3*i], header[3*i+1], header[3*i+2], 0xff}
+		}
+	}
+	return pal[:1<<bits]
+}
+
+// allZero reports whether every byte of b is zero.
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import "fmt"
+
+// Pivots: the centroid of a frame's solid pixels, the point frames of differing trim are lined up
+// on. Animations can be normalised around a common pivot, which moves every frame so that its
+// pivot lands on the same point.
+
+// Pivot settings.
+var (
+	recordPivot bool // Add each frame's pivot to the hex header.
+	alignPivot  bool // Move animation frames so that their pivots coincide.
+)
+
+// pivot returns the centroid of the solid pixels of an image, rounded to the nearest pixel, and
+// false when it has none. Integer arithmetic keeps the result the same on every platform.
+func pivot(m *indexedImage) (int, int, bool) {
+	sumX, sumY, count := 0, 0, 0
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			if m.at(x, y) != transparentIndex {
+				sumX, sumY, count = sumX+x, sumY+y, count+1
+			}
+		}
+	}
+	if count == 0 {
+		return 0, 0, false
+	}
+	return (2*sumX + count) / (2 * count), (2*sumY + count) / (2 * count), true
+}
+
+// pivotField formats an image's pivot as a header field: "pivot: x,y", or "pivot: none" for an
+// image with no solid pixels.
+func pivotField(m *indexedImage) string {
+	x, y, ok := pivot(m)
+	if !ok {
+		return "pivot: none"
+	}
+	return fmt.Sprintf("pivot: %d,%d", x, y)
+}
+
+// alignPivots moves the frames of an animation so that every pivot lands on the average pivot of
+// all frames. The frames grow to fit their moved contents, so no pixels are lost; empty frames
+// stay where they are.
+func alignPivots(anim *animation) {
+	type point struct{ x, y int }
+	pivots := make([]*point, len(anim.frames))
+	sumX, sumY, count := 0, 0, 0
+	for i, frame := range anim.frames {
+		if x, y, ok := pivot(frame); ok {
+			pivots[i] = &point{x, y}
+			sumX, sumY, count = sumX+x, sumY+y, count+1
+		}
+	}
+	if count == 0 {
+		return
+	}
+	target := point{(2*sumX + count) / (2 * count), (2*sumY + count) / (2 * count)}
+	shifts := make([]point, len(anim.frames))
+	minX, minY, maxX, maxY := 0, 0, 0, 0
+	for i, p := range pivots {
+		if p == nil {
+			continue
+		}
+		s := point{target.x - p.x, target.y - p.y}
+		shifts[i] = s
+		minX, minY, maxX, maxY = min(minX, s.x), min(minY, s.y), max(maxX, s.x), max(maxY, s.y)
+	}
+	w, h := anim.frames[0].width+maxX-minX, anim.frames[0].height+maxY-minY
+	for i, frame := range anim.frames {
+		moved := newIndexedImage(w, h)
+		dx, dy := shifts[i].x-minX, shifts[i].y-minY
+		for y := 0; y < frame.height; y++ {
+			for x := 0; x < frame.width; x++ {
+				moved.set(x+dx, y+dy, frame.at(x, y))
+			}
+		}
+		anim.frames[i] = moved
+	}
+}
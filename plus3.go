@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// +3DOS file headers: files on a Spectrum +3 disk start with a 128-byte header holding the file
+// length and the BASIC tape header, which LOAD "name"CODE needs to know where the data goes.
+
+// Settings for binary outputs.
+var (
+	plus3Header bool // Prepend a +3DOS header to binary outputs.
+	loadAddress int  // CODE load address; 0 picks the screen for SCR files and 32768 otherwise.
+)
+
+const plus3HeaderSize = 128
+
+// codeLoadAddress returns the load address recorded for a binary output of the given format.
+func codeLoadAddress(format string) int {
+	if loadAddress != 0 {
+		return loadAddress
+	}
+	if format == "scr" {
+		return 16384
+	}
+	return 32768
+}
+
+// checkLoadAddress validates the --load-address setting.
+func checkLoadAddress() error {
+	if loadAddress < 0 || loadAddress > 0xFFFF {
+		return fmt.Errorf("load address %d out of range (0-65535)", loadAddress)
+	}
+	return nil
+}
+
+// BASIC file types recorded in +3DOS and tape headers.
+const (
+	fileTypeProgram = 0
+	fileTypeCode    = 3
+)
+
+// plus3DOSHeader builds the header for a file of the given type and length. For CODE files param1
+// is the load address; for programs it is the autostart line and param2 the program length.
+func plus3DOSHeader(fileType byte, length, param1, param2 int) []byte {
+	h := make([]byte, plus3HeaderSize)
+	copy(h, "PLUS3DOS")
+	h[8] = 0x1A // Soft end of file.
+	h[9] = 1    // Issue.
+	h[10] = 0   // Version.
+	binary.LittleEndian.PutUint32(h[11:], uint32(length+plus3HeaderSize))
+	// BASIC header: file type, data length and the two type-specific parameters.
+	h[15] = fileType
+	binary.LittleEndian.PutUint16(h[16:], uint16(length))
+	binary.LittleEndian.PutUint16(h[18:], uint16(param1))
+	binary.LittleEndian.PutUint16(h[20:], uint16(param2))
+	var sum byte
+	for _, b := range h[:plus3HeaderSize-1] {
+		sum += b
+	}
+	h[plus3HeaderSize-1] = sum
+	return h
+}
+
+// plus3CodeFile returns data as a +3DOS CODE file loading at addr.
+func plus3CodeFile(data []byte, addr int) ([]byte, error) {
+	if len(data) > 0xFFFF {
+		return nil, fmt.Errorf("%d bytes is too long for a +3DOS CODE file", len(data))
+	}
+	// The second parameter is unused for CODE files; 32768 is what the ROM writes.
+	return append(plus3DOSHeader(fileTypeCode, len(data), addr, 0x8000), data...), nil
+}
+
+// wrapBinary prepends a +3DOS header to binary output data when one was asked for.
+func wrapBinary(data []byte, format string) ([]byte, error) {
+	if !plus3Header {
+		return data, nil
+	}
+	return plus3CodeFile(data, codeLoadAddress(format))
+}
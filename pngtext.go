@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// PNG metadata: PNG outputs carry the fields of the hex header (the original file, its size and
+// mode) and the settings they were made with (palette and transparency) as text chunks, keyed
+// "zxtex:file", "zxtex:width" and so on, so a PNG made by zxtex says where it came from, and
+// converting it again gives the same result as converting its source. Values are written as tEXt
+// chunks, or as iTXt when they are not Latin-1. Reading such a PNG restores its file name and mode.
+
+// pngTextPrefix starts the keyword of every text chunk zxtex writes.
+const pngTextPrefix = "zxtex:"
+
+// pngTextFields returns the metadata recorded for a PNG output, in the order it is written.
+func pngTextFields(src *source, m *indexedImage) [][2]string {
+	fields := [][2]string{
+		{"file", recordedName(sourceFileName(src))},
+		{"width", strconv.Itoa(m.width)},
+		{"height", strconv.Itoa(m.height)},
+	}
+	if src.chunky {
+		fields = append(fields, [2]string{"mode", "chunky"})
+	}
+	fields = append(fields, [2]string{"palette", recordedName(paletteName)})
+	if transpColorStr != "" {
+		fields = append(fields, [2]string{"transpcolour", transpColorStr})
+	}
+	if transpIndex >= 0 {
+		fields = append(fields, [2]string{"transpindex", strconv.Itoa(transpIndex)})
+	}
+	return fields
+}
+
+// pngChunk encodes a PNG chunk, with its length and checksum.
+func pngChunk(kind string, data []byte) []byte {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// isLatin1 reports whether s holds only characters a tEXt chunk can: Latin-1, without NUL.
+func isLatin1(s string) bool {
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// addPNGText inserts text chunks holding the fields after the IHDR chunk of an encoded PNG, with
+// a Software chunk naming zxtex.
+func addPNGText(data []byte, fields [][2]string) []byte {
+	const ihdrEnd = 8 + 12 + 13
+	if len(data) < ihdrEnd {
+		return data
+	}
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, pngChunk("tEXt", []byte("Software\x00zxtex"))...)
+	for _, f := range fields {
+		keyword := pngTextPrefix + f[0]
+		if isLatin1(f[1]) {
+			text := make([]byte, 0, len(keyword)+1+len(f[1]))
+			text = append(text, keyword...)
+			text = append(text, 0)
+			// tEXt is Latin-1, which matches the first 256 code points.
+			for _, r := range f[1] {
+				text = append(text, byte(r))
+			}
+			out = append(out, pngChunk("tEXt", text)...)
+			continue
+		}
+		// iTXt: keyword, no compression, and empty language and translated keyword, then UTF-8.
+		out = append(out, pngChunk("iTXt", []byte(keyword+"\x00\x00\x00\x00\x00"+f[1]))...)
+	}
+	return append(out, data[ihdrEnd:]...)
+}
+
+// readPNGText returns the zxtex fields recorded in the text chunks of a PNG file, without their
+// prefix; it is empty for PNGs zxtex did not write.
+func readPNGText(data []byte) map[string]string {
+	fields := map[string]string{}
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return fields
+	}
+	for pos := 8; pos+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[pos:]))
+		if n < 0 || pos+12+n > len(data) {
+			break
+		}
+		kind, chunk := string(data[pos+4:pos+8]), data[pos+8:pos+8+n]
+		pos += 12 + n
+		keyword, text, ok := bytes.Cut(chunk, []byte{0})
+		if !ok || !strings.HasPrefix(string(keyword), pngTextPrefix) {
+			continue
+		}
+		key := strings.TrimPrefix(string(keyword), pngTextPrefix)
+		switch kind {
+		case "tEXt":
+			var sb strings.Builder
+			for _, b := range text {
+				sb.WriteRune(rune(b))
+			}
+			fields[key] = sb.String()
+		case "iTXt":
+			// Skip the compression flag and method, language tag and translated keyword.
+			if len(text) < 2 || text[0] != 0 {
+				continue
+			}
+			rest := text[2:]
+			for i := 0; i < 2; i++ {
+				if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok {
+					break
+				}
+			}
+			if ok && utf8.Valid(rest) {
+				fields[key] = string(rest)
+			}
+		}
+	}
+	return fields
+}
+
+// applyPNGText restores the metadata a PNG made by zxtex records into a source's header fields,
+// and warns when it was made with a different palette, whose colours then read back differently.
+func applyPNGText(data []byte, meta map[string]string, input string) (chunky bool) {
+	fields := readPNGText(data)
+	if file := fields["file"]; file != "" {
+		meta["file"] = file
+	}
+	if pal := fields["palette"]; pal != "" && pal != recordedName(paletteName) {
+		if input == "" {
+			input = "standard input"
+		}
+		fmt.Fprintf(os.Stderr, "Warning: %s was made with --palette %s; reading its colours with %s\n", input, pal, recordedName(paletteName))
+	}
+	return strings.EqualFold(fields["mode"], "chunky")
+}
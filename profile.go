@@ -0,0 +1,92 @@
+//go:build !js
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// Profiling: --cpuprofile, --memprofile and --trace record how a conversion spends its time and
+// memory, for "go tool pprof" and "go tool trace", so performance work can be measured on real
+// asset sets rather than on synthetic ones.
+
+// Profile output files; empty for none.
+var (
+	cpuProfile string
+	memProfile string
+	traceFile  string
+)
+
+// profileFiles holds the files being written by the CPU profiler and the tracer.
+var profileFiles []*os.File
+
+// startProfiling starts the CPU profiler and the tracer, as requested.
+func startProfiling() error {
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return fmt.Errorf("creating CPU profile: %w", err)
+		}
+		profileFiles = append(profileFiles, f)
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("starting CPU profile: %w", err)
+		}
+	}
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			return fmt.Errorf("creating trace: %w", err)
+		}
+		profileFiles = append(profileFiles, f)
+		if err := trace.Start(f); err != nil {
+			return fmt.Errorf("starting trace: %w", err)
+		}
+	}
+	return nil
+}
+
+// stopProfiling stops the CPU profiler and the tracer and writes the memory profile. It may be
+// called more than once; only the first call has an effect.
+func stopProfiling() {
+	if cpuProfile != "" {
+		pprof.StopCPUProfile()
+	}
+	if traceFile != "" {
+		trace.Stop()
+	}
+	for _, f := range profileFiles {
+		if err := f.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: writing profile: %v\n", err)
+		}
+	}
+	if memProfile != "" {
+		if err := writeMemProfile(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
+	cpuProfile, traceFile, memProfile, profileFiles = "", "", "", nil
+}
+
+// writeMemProfile writes a heap profile of the memory allocated so far.
+func writeMemProfile() error {
+	f, err := os.Create(memProfile)
+	if err != nil {
+		return fmt.Errorf("creating memory profile: %w", err)
+	}
+	defer f.Close()
+	runtime.GC() // Bring the statistics up to date.
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		return fmt.Errorf("writing memory profile: %w", err)
+	}
+	return nil
+}
+
+// exit stops any profiling, so the profiles are complete, and exits with the given status.
+func exit(code int) {
+	stopProfiling()
+	os.Exit(code)
+}
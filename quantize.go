@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Attribute-aware quantization: rather than mapping every pixel to its nearest colour and
+// resolving attribute clash afterwards, each 8×8 cell is fitted directly to whichever INK, PAPER
+// and BRIGHT combination reproduces it with the least colour error. The result always displays
+// as converted. Within a cell, pixels can be dithered between the two colours, with a Bayer or
+// blue-noise threshold mask or by error diffusion that only ever picks one of the cell's colours.
+
+// Quantization settings.
+var (
+	quantizeMode = "nearest" // Colour mapping: "nearest" or "cell".
+	ditherMode   = "none"    // Dithering inside attribute cells: "none", "ordered", "blue-noise" or "floyd-steinberg".
+	serpentine   = false     // Scan alternate rows in opposite directions when diffusing error.
+	ditherAmount = 1.0       // Dither strength, from 0 (none) to 1 (full).
+)
+
+// checkQuantizeSettings validates the quantization settings.
+func checkQuantizeSettings() error {
+	switch quantizeMode {
+	case "nearest", "cell":
+	default:
+		return fmt.Errorf("unknown quantize mode %q (expected nearest or cell)", quantizeMode)
+	}
+	switch ditherMode {
+	case "none", "ordered", "blue-noise", "floyd-steinberg":
+	default:
+		return fmt.Errorf("unknown dither mode %q (expected none, ordered, blue-noise or floyd-steinberg)", ditherMode)
+	}
+	if kmeansColours < 0 || kmeansColours == 1 {
+		return fmt.Errorf("invalid k-means colour count %d (expected 2 or more, or 0 for none)", kmeansColours)
+	}
+	if ditherAmount < 0 || ditherAmount > 1 {
+		return fmt.Errorf("invalid dither strength %g (expected 0 to 1)", ditherAmount)
+	}
+	if ditherAmount != 1 && ditherMode == "none" {
+		return fmt.Errorf("--dither-strength needs --dither")
+	}
+	if serpentine && ditherMode != "floyd-steinberg" {
+		return fmt.Errorf("--serpentine needs an error-diffusion dither")
+	}
+	if ditherMode != "none" && quantizeMode != "cell" {
+		return fmt.Errorf("--dither needs --quantize cell")
+	}
+	if quantizeMode == "cell" && chunkyMode {
+		return fmt.Errorf("--quantize cell cannot be combined with --chunky")
+	}
+	if fitScreen && chunkyMode {
+		return fmt.Errorf("--fit-screen cannot be combined with --chunky")
+	}
+	return nil
+}
+
+// blueNoise16 is a 16×16 blue-noise threshold mask, ranking every position from 0 to 255. It was
+// generated once with the void-and-cluster method (Gaussian sigma 1.5, wrapping at the edges), so
+// thresholds that are close in rank are spread evenly apart rather than in a regular grid.
+var blueNoise16 = [16][16]int{
+	{137, 235, 63, 20, 47, 209, 89, 164, 25, 103, 154, 248, 92, 46, 189, 18},
+	{170, 95, 186, 151, 250, 173, 127, 68, 244, 197, 8, 66, 168, 230, 119, 252},
+	{50, 9, 222, 77, 114, 3, 224, 35, 146, 52, 129, 211, 22, 143, 34, 85},
+	{213, 122, 141, 37, 203, 60, 90, 183, 110, 236, 83, 184, 106, 69, 205, 157},
+	{178, 65, 247, 100, 159, 241, 131, 215, 10, 162, 38, 228, 153, 243, 1, 101},
+	{233, 28, 169, 11, 190, 49, 24, 152, 64, 204, 97, 17, 53, 118, 194, 44},
+	{86, 112, 207, 78, 136, 102, 199, 82, 254, 123, 175, 139, 218, 75, 165, 135},
+	{216, 148, 55, 226, 30, 234, 172, 113, 27, 42, 231, 88, 180, 31, 253, 21},
+	{188, 5, 177, 120, 155, 58, 0, 219, 147, 192, 61, 6, 111, 201, 96, 62},
+	{239, 104, 41, 246, 91, 202, 132, 71, 98, 245, 163, 130, 238, 51, 149, 126},
+	{79, 161, 206, 73, 16, 166, 240, 36, 185, 15, 80, 212, 23, 171, 227, 13},
+	{214, 134, 26, 144, 191, 48, 109, 210, 150, 121, 45, 142, 105, 70, 193, 43},
+	{181, 59, 255, 99, 225, 128, 84, 19, 67, 229, 200, 167, 251, 29, 124, 94},
+	{2, 116, 174, 40, 7, 182, 158, 249, 176, 93, 4, 57, 87, 208, 145, 242},
+	{223, 81, 156, 217, 76, 237, 56, 115, 39, 138, 232, 117, 179, 12, 160, 54},
+	{196, 32, 125, 198, 107, 140, 14, 195, 220, 72, 187, 33, 133, 221, 74, 108},
+}
+
+// ditherThreshold returns the mix amount above which the pixel at (x, y) takes the second of its
+// cell's colours, for the ordered and blue-noise dithers. Weaker dithering pulls the thresholds
+// towards the midpoint.
+func ditherThreshold(x, y int) float64 {
+	t := (float64(blueNoise16[y%16][x%16]) + 0.5) / 256
+	if ditherMode == "ordered" {
+		t = (float64(bayer4[y%4][x%4]) + 0.5) / 16
+	}
+	return 0.5 + (t-0.5)*ditherAmount
+}
+
+// cellIndex returns the palette index of a cell colour. Black is the same either way, so it is
+// always index 0.
+func cellIndex(colour int, bright bool) int {
+	if bright && colour != 0 {
+		return colour | 8
+	}
+	return colour
+}
+
+// rgbDistance returns the squared distance between a pixel and a palette colour.
+func rgbDistance(p [3]float64, c color.RGBA) float64 {
+	dr, dg, db := p[0]-float64(c.R), p[1]-float64(c.G), p[2]-float64(c.B)
+	return dr*dr + dg*dg + db*db
+}
+
+// mixAmount returns how far a pixel lies along the line from colour a to colour b, from 0 at a to
+// 1 at b.
+func mixAmount(p [3]float64, a, b color.RGBA) float64 {
+	ab := [3]float64{float64(b.R) - float64(a.R), float64(b.G) - float64(a.G), float64(b.B) - float64(a.B)}
+	length := ab[0]*ab[0] + ab[1]*ab[1] + ab[2]*ab[2]
+	if length == 0 {
+		return 0
+	}
+	t := ((p[0]-float64(a.R))*ab[0] + (p[1]-float64(a.G))*ab[1] + (p[2]-float64(a.B))*ab[2]) / length
+	return min(max(t, 0), 1)
+}
+
+// pairError returns the colour error of showing pixels with only colours a and b: the distance
+// to the nearer colour, or, when dithering, to the nearest mix of the two.
+func pairError(pixels [][3]float64, a, b color.RGBA) float64 {
+	total := 0.0
+	for _, p := range pixels {
+		if ditherMode == "none" {
+			total += min(rgbDistance(p, a), rgbDistance(p, b))
+			continue
+		}
+		t := mixAmount(p, a, b)
+		mix := color.RGBA{
+			R: uint8(float64(a.R) + t*(float64(b.R)-float64(a.R)) + 0.5),
+			G: uint8(float64(a.G) + t*(float64(b.G)-float64(a.G)) + 0.5),
+			B: uint8(float64(a.B) + t*(float64(b.B)-float64(a.B)) + 0.5),
+		}
+		total += rgbDistance(p, mix)
+	}
+	return total
+}
+
+// bestCellColours searches every INK, PAPER and BRIGHT combination for the one that shows a
+// cell's pixels with the least colour error, among those with a colour in allowed; a colour not in
+// allowed is never shown, so the pair is judged by the other alone. Ties go to BRIGHT off, then to
+// the lower colours.
+func bestCellColours(pixels [][3]float64, allowed uint16) (a, b int, bright bool) {
+	bestErr := -1.0
+	for _, br := range []bool{false, true} {
+		for c1 := 0; c1 < 8; c1++ {
+			for c2 := c1 + 1; c2 < 8; c2++ {
+				i1, i2 := cellIndex(c1, br), cellIndex(c2, br)
+				switch {
+				case !allows(allowed, i1) && !allows(allowed, i2):
+					continue
+				case !allows(allowed, i1):
+					i1 = i2
+				case !allows(allowed, i2):
+					i2 = i1
+				}
+				e := pairError(pixels, ZXPalette[i1], ZXPalette[i2])
+				if bestErr < 0 || e < bestErr {
+					a, b, bright, bestErr = c1, c2, br, e
+				}
+			}
+		}
+	}
+	return a, b, bright
+}
+
+// rgbImage is an image being quantized, with full-precision channels so that resampling and
+// diffused error are never clipped to 8 bits along the way.
+type rgbImage struct {
+	width, height int
+	pix           [][3]float64 // Channels 0-255, row by row; transparent pixels hold the PAPER colour.
+	opaque        []bool       // False for pixels the transparency settings make transparent.
+}
+
+// newRGBImage converts an image for quantization, honouring the transparency settings.
+// Transparent pixels take the PAPER colour they will be shown in.
+func newRGBImage(img image.Image) *rgbImage {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	w, h := bounds.Dx(), bounds.Dy()
+	f := &rgbImage{width: w, height: h, pix: make([][3]float64, w*h), opaque: make([]bool, w*h)}
+	paper := ZXPalette[paperColour]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, a := rgba.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			if shouldBeTransparent(r, g, b, a) {
+				f.pix[y*w+x] = [3]float64{float64(paper.R), float64(paper.G), float64(paper.B)}
+				continue
+			}
+			f.pix[y*w+x] = [3]float64{float64(r >> 8), float64(g >> 8), float64(b >> 8)}
+			f.opaque[y*w+x] = true
+		}
+	}
+	return f
+}
+
+// quantizeRGB maps an image to palette indices according to the quantize mode.
+func quantizeRGB(ctx context.Context, f *rgbImage) (*indexedImage, error) {
+	if err := checkConstraintSize(f.width, f.height); err != nil {
+		return nil, err
+	}
+	if quantizeMode == "cell" {
+		return quantizeCells(ctx, f)
+	}
+	m := newIndexedImage(f.width, f.height)
+	for i, p := range f.pix {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !f.opaque[i] {
+			continue
+		}
+		best, allowed := -1, allowedAt(i%f.width, i/f.width)
+		for idx, c := range ZXPalette {
+			if allows(allowed, idx) && (best < 0 || rgbDistance(p, c) < rgbDistance(p, ZXPalette[best])) {
+				best = idx
+			}
+		}
+		m.pix[i] = best
+	}
+	return m, nil
+}
+
+// quantizeCells maps an image to palette indices one 8×8 cell at a time, giving each cell the
+// two colours that show it best. Transparent pixels count as the PAPER colour they will be shown
+// in. It stops early, returning the context's error, if ctx is cancelled.
+func quantizeCells(ctx context.Context, f *rgbImage) (*indexedImage, error) {
+	w, h := f.width, f.height
+	pix := make([][3]float64, len(f.pix))
+	copy(pix, f.pix)
+	opaque := f.opaque
+
+	// Choose the two colours of every cell from the original pixels.
+	cols := (w + 7) / 8
+	pairs := make([][2]int, cols*((h+7)/8))
+	for cy := 0; cy < h; cy += 8 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for cx := 0; cx < w; cx += 8 {
+			var pixels [][3]float64
+			// The cell may use the colours all its pixels permit, or failing that any of them.
+			allowed, permitted := allColours, uint16(0)
+			for y := cy; y < cy+8 && y < h; y++ {
+				for x := cx; x < cx+8 && x < w; x++ {
+					pixels = append(pixels, pix[y*w+x])
+					if opaque[y*w+x] {
+						allowed &= allowedAt(x, y)
+						permitted |= allowedAt(x, y)
+					}
+				}
+			}
+			if allowed == 0 {
+				allowed = permitted
+			}
+			c1, c2, bright := bestCellColours(pixels, allowed)
+			pairs[(cy/8)*cols+cx/8] = [2]int{cellIndex(c1, bright), cellIndex(c2, bright)}
+		}
+	}
+
+	m := newIndexedImage(w, h)
+	for y := 0; y < h; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// Serpentine scanning runs odd rows right to left, diffusing the other way.
+		dir := 1
+		if serpentine && y%2 == 1 {
+			dir = -1
+		}
+		for i := 0; i < w; i++ {
+			x := i
+			if dir < 0 {
+				x = w - 1 - i
+			}
+			pair := pairs[(y/8)*cols+x/8]
+			a, b := ZXPalette[pair[0]], ZXPalette[pair[1]]
+			p := pix[y*w+x]
+			idx := pair[0]
+			switch ditherMode {
+			case "ordered", "blue-noise":
+				if mixAmount(p, a, b) > ditherThreshold(x, y) {
+					idx = pair[1]
+				}
+			default:
+				if rgbDistance(p, b) < rgbDistance(p, a) {
+					idx = pair[1]
+				}
+			}
+			// A pixel only takes a colour its region does not permit when the other is not permitted either.
+			if allowed := allowedAt(x, y); !allows(allowed, idx) {
+				other := pair[0]
+				if idx == pair[0] {
+					other = pair[1]
+				}
+				if allows(allowed, other) {
+					idx = other
+				}
+			}
+			if ditherMode == "floyd-steinberg" {
+				// Spread what the chosen colour misses to the pixels not yet visited.
+				c := ZXPalette[idx]
+				diff := [3]float64{p[0] - float64(c.R), p[1] - float64(c.G), p[2] - float64(c.B)}
+				for i := range diff {
+					diff[i] *= ditherAmount
+				}
+				diffuse(pix, w, h, x+dir, y, diff, 7.0/16)
+				diffuse(pix, w, h, x-dir, y+1, diff, 3.0/16)
+				diffuse(pix, w, h, x, y+1, diff, 5.0/16)
+				diffuse(pix, w, h, x+dir, y+1, diff, 1.0/16)
+			}
+			if opaque[y*w+x] {
+				m.set(x, y, idx)
+			}
+		}
+	}
+	return m, nil
+}
+
+// diffuse adds a share of a quantization error to the pixel at (x, y), if it is inside the image.
+// Channels are clamped to the colour range, so error a cell's colours cannot show does not pile up
+// and smear into the cells after it.
+func diffuse(pix [][3]float64, w, h, x, y int, diff [3]float64, share float64) {
+	if x < 0 || y < 0 || x >= w || y >= h {
+		return
+	}
+	for i := range diff {
+		pix[y*w+x][i] = min(max(pix[y*w+x][i]+diff[i]*share, 0), 255)
+	}
+}
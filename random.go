@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Random images, generated from a seed so every image can be reproduced exactly: placeholder
+// sprites, and attribute-correct noise for stress testing sprite engines and converters.
+
+// randomStyles lists the styles of random image that can be generated.
+var randomStyles = []string{"sprite", "noise"}
+
+// randomImage generates a random image from a seed:
+//   - sprite: a left-right symmetric shape in one INK colour on a transparent background, in the
+//     manner of the classic invader generators.
+//   - noise: random pixels in every 8×8 cell, each cell with its own INK, PAPER and BRIGHT.
+func randomImage(style string, w, h int, seed int64) (*indexedImage, error) {
+	r := rand.New(rand.NewSource(seed))
+	m := newIndexedImage(w, h)
+	switch style {
+	case "sprite":
+		ink := 1 + r.Intn(15)
+		if ink == 8 {
+			ink = 15 // Bright black would not show up.
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < (w+1)/2; x++ {
+				if r.Intn(2) == 1 {
+					m.set(x, y, ink)
+					m.set(w-1-x, y, ink)
+				}
+			}
+		}
+	case "noise":
+		for cy := 0; cy < h; cy += 8 {
+			for cx := 0; cx < w; cx += 8 {
+				bright := r.Intn(2) * 8
+				ink, paper := r.Intn(8)+bright, r.Intn(8)+bright
+				for y := cy; y < cy+8 && y < h; y++ {
+					for x := cx; x < cx+8 && x < w; x++ {
+						if r.Intn(2) == 1 {
+							m.set(x, y, ink)
+						} else {
+							m.set(x, y, paper)
+						}
+					}
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown random style %q (expected sprite or noise)", style)
+	}
+	return m, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// Raw pixel input: with --raw-input (--type raw), inputs are headerless dumps of pixels, as pulled
+// out of emulators or written by custom tools, row by row from the top left. Their size and pixel
+// format cannot be told from the data, so --size and --pixfmt give them.
+
+var (
+	rawSize        string    // --size, WxH.
+	rawPixelFormat = "rgb24" // --pixfmt: rgb24 or rgba32.
+	rawWidth       int       // Parsed from rawSize.
+	rawHeight      int       // Parsed from rawSize.
+)
+
+// rawPixelSizes gives the bytes per pixel of each --pixfmt.
+var rawPixelSizes = map[string]int{"rgb24": 3, "rgba32": 4}
+
+// checkRawSettings validates --size and --pixfmt, which only apply to raw input.
+func checkRawSettings() error {
+	if _, ok := rawPixelSizes[rawPixelFormat]; !ok {
+		return fmt.Errorf("unknown pixel format %q (expected rgb24 or rgba32)", rawPixelFormat)
+	}
+	if inputType != "raw" {
+		if rawSize != "" {
+			return fmt.Errorf("--size is only used with --raw-input")
+		}
+		return nil
+	}
+	if rawSize == "" {
+		return fmt.Errorf("--raw-input needs the image size, given as --size WxH")
+	}
+	var err error
+	rawWidth, rawHeight, err = parseSize(rawSize)
+	return err
+}
+
+// decodeRawPixels reads a raw pixel dump of the size and format given by --size and --pixfmt.
+func decodeRawPixels(data []byte) (image.Image, error) {
+	size := rawPixelSizes[rawPixelFormat]
+	if want := rawWidth * rawHeight * size; len(data) != want {
+		return nil, fmt.Errorf("%w: raw input has %d bytes, but %dx%d %s pixels take %d", ErrUnsupportedFormat, len(data), rawWidth, rawHeight, rawPixelFormat, want)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, rawWidth, rawHeight))
+	for i := 0; i < rawWidth*rawHeight; i++ {
+		p := data[i*size:]
+		img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2], img.Pix[4*i+3] = p[0], p[1], p[2], 0xff
+		if size == 4 {
+			img.Pix[4*i+3] = p[3]
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Build recipes: a file listing many conversions, each an asset with its input and the flags to
+// convert it with, plus defaults shared by all of them. Recipes are written in a small subset of
+// YAML (block mappings and sequences of plain or quoted scalars, with # comments), or as JSON:
+//
+//	defaults:
+//	  paper: 0
+//	assets:
+//	  - input: title.png
+//	    format: scr
+//	    quantize: cell
+//	  - input: [sprites.png]
+//	    format:
+//	      - asm
+//	      - png
+//
+// Every key but input names a conversion flag. A list value is joined with commas, except for
+// input, where it gives several inputs.
+
+// yamlLine is a line of a recipe with its indentation and without comments.
+type yamlLine struct {
+	indent int
+	text   string
+	num    int
+}
+
+// recipeLines splits a recipe into its meaningful lines.
+func recipeLines(data []byte) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimRight(stripComment(raw), " \t\r")
+		text := strings.TrimLeft(raw, " ")
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, not tabs", i+1)
+		}
+		lines = append(lines, yamlLine{indent: len(raw) - len(text), text: text, num: i + 1})
+	}
+	return lines, nil
+}
+
+// stripComment removes a # comment from a line, unless the # is inside quotes or part of a word.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// isSequenceItem reports whether a line starts a sequence item.
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits a "key: value" line, reporting false when the line is not a mapping entry.
+func splitKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'") {
+		return "", "", false
+	}
+	key, value := text, ""
+	if i := strings.Index(text, ": "); i >= 0 {
+		key, value = text[:i], strings.TrimSpace(text[i+2:])
+	} else if strings.HasSuffix(text, ":") {
+		key = text[:len(text)-1]
+	} else {
+		return "", "", false
+	}
+	key = strings.TrimSpace(key)
+	return key, value, key != ""
+}
+
+// yamlScalar decodes a plain, quoted or bracketed flow-list scalar.
+func yamlScalar(text string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "\""):
+		return strconv.Unquote(text)
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("unterminated string %s", text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated list %s", text)
+		}
+		var list []interface{}
+		if inner := strings.TrimSpace(text[1 : len(text)-1]); inner != "" {
+			for _, item := range strings.Split(inner, ",") {
+				v, err := yamlScalar(strings.TrimSpace(item))
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+		}
+		return list, nil
+	}
+	return text, nil
+}
+
+// parseYAMLBlock parses the mapping or sequence whose lines start at lines[i] with the given
+// indentation, returning it and the index of the first line after it.
+func parseYAMLBlock(lines []yamlLine, i, indent int) (interface{}, int, error) {
+	if isSequenceItem(lines[i].text) {
+		var seq []interface{}
+		for i < len(lines) && lines[i].indent == indent && isSequenceItem(lines[i].text) {
+			rest := strings.TrimLeft(lines[i].text[1:], " ")
+			var v interface{}
+			var err error
+			switch _, _, isEntry := splitKey(rest); {
+			case rest == "":
+				v, i = "", i+1
+				if i < len(lines) && lines[i].indent > indent {
+					v, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+				}
+			case isEntry:
+				// The item is a mapping whose first entry shares the line with the dash.
+				lines[i] = yamlLine{indent: indent + len(lines[i].text) - len(rest), text: rest, num: lines[i].num}
+				v, i, err = parseYAMLBlock(lines, i, lines[i].indent)
+			default:
+				if v, err = yamlScalar(rest); err != nil {
+					err = fmt.Errorf("line %d: %w", lines[i].num, err)
+				}
+				i++
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+			seq = append(seq, v)
+		}
+		if i < len(lines) && lines[i].indent > indent {
+			return nil, 0, fmt.Errorf("line %d: unexpected indentation", lines[i].num)
+		}
+		return seq, i, nil
+	}
+
+	m := map[string]interface{}{}
+	for i < len(lines) && lines[i].indent == indent {
+		line := lines[i]
+		key, value, ok := splitKey(line.text)
+		if !ok {
+			return nil, 0, fmt.Errorf("line %d: expected \"key: value\"", line.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, 0, fmt.Errorf("line %d: %s is given twice", line.num, key)
+		}
+		i++
+		var v interface{} = ""
+		var err error
+		switch {
+		case value != "":
+			if v, err = yamlScalar(value); err != nil {
+				return nil, 0, fmt.Errorf("line %d: %w", line.num, err)
+			}
+		case i < len(lines) && (lines[i].indent > indent || lines[i].indent == indent && isSequenceItem(lines[i].text)):
+			if v, i, err = parseYAMLBlock(lines, i, lines[i].indent); err != nil {
+				return nil, 0, err
+			}
+		}
+		m[key] = v
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return nil, 0, fmt.Errorf("line %d: unexpected indentation", lines[i].num)
+	}
+	return m, i, nil
+}
+
+// parseRecipeData decodes a recipe file, as JSON when it starts with a brace and as YAML otherwise.
+func parseRecipeData(data []byte) (interface{}, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		var v interface{}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	lines, err := recipeLines(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%w: the recipe is empty", ErrEmptyData)
+	}
+	v, end, err := parseYAMLBlock(lines, 0, lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if end < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[end].num)
+	}
+	return v, nil
+}
+
+// recipeValue formats a recipe value as a flag value.
+func recipeValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := recipeValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("expected a value or a list, not a mapping")
+}
+
+// recipeAsset is one conversion of a recipe.
+type recipeAsset struct {
+	inputs []string
+	args   []string // Command line arguments for the conversion: flags, then "--" and the inputs.
+}
+
+// parseRecipe returns the conversions a recipe declares.
+func parseRecipe(data []byte) ([]recipeAsset, error) {
+	v, err := parseRecipeData(data)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("a recipe must be a mapping with defaults and assets")
+	}
+	for key := range root {
+		if key != "defaults" && key != "assets" {
+			return nil, fmt.Errorf("unknown recipe section %q (expected defaults or assets)", key)
+		}
+	}
+	defaults := map[string]interface{}{}
+	if d, ok := root["defaults"]; ok && d != "" {
+		if defaults, ok = d.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("defaults must be a mapping of flags")
+		}
+	}
+	list, ok := root["assets"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%w: the recipe lists no assets", ErrEmptyData)
+	}
+
+	var assets []recipeAsset
+	for n, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("asset %d must be a mapping of flags", n+1)
+		}
+		merged := map[string]interface{}{}
+		for key, value := range defaults {
+			merged[key] = value
+		}
+		for key, value := range entry {
+			merged[key] = value
+		}
+		var asset recipeAsset
+		switch input := merged["input"].(type) {
+		case string:
+			asset.inputs = []string{input}
+		case []interface{}:
+			for _, item := range input {
+				s, err := recipeValue(item)
+				if err != nil {
+					return nil, fmt.Errorf("asset %d: input: %w", n+1, err)
+				}
+				asset.inputs = append(asset.inputs, s)
+			}
+		}
+		if len(asset.inputs) == 0 || asset.inputs[0] == "" {
+			return nil, fmt.Errorf("asset %d has no input", n+1)
+		}
+		delete(merged, "input")
+		keys := make([]string, 0, len(merged))
+		for key := range merged {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value, err := recipeValue(merged[key])
+			if err != nil {
+				return nil, fmt.Errorf("asset %d: %s: %w", n+1, key, err)
+			}
+			if value == "" {
+				return nil, fmt.Errorf("asset %d: %s has no value", n+1, key)
+			}
+			asset.args = append(asset.args, "--"+strings.TrimLeft(key, "-")+"="+value)
+		}
+		asset.args = append(append(asset.args, "--"), asset.inputs...)
+		assets = append(assets, asset)
+	}
+	return assets, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import "fmt"
+
+// SCR files: a raw dump of Spectrum display memory, the 6144-byte bitmap in screen order followed
+// by 768 attribute bytes. Most Spectrum art tools can export one.
+
+const (
+	scrWidth      = 256
+	scrHeight     = 192
+	scrBitmapSize = 6144
+	scrSize       = 6912
+)
+
+// imageToScr converts a 256×192 indexed image into an SCR file.
+func imageToScr(m *indexedImage) ([]byte, error) {
+	if m.width != scrWidth || m.height != scrHeight {
+		return nil, fmt.Errorf("%w: SCR files are %dx%d, image is %dx%d", ErrWidthMismatch, scrWidth, scrHeight, m.width, m.height)
+	}
+	// The display file always has the leftmost pixel in bit 7, whatever --bitorder says.
+	bitmap, bytesPerRow := packBitmapBits(m, false)
+	data, err := orderBytes(bitmap, bytesPerRow, "screen")
+	if err != nil {
+		return nil, err
+	}
+	attrs, _ := attributeBytes(m)
+	return append(data, attrs...), nil
+}
+
+// scrToIndexed decodes an SCR file into a 256×192 indexed image. Each pixel takes its cell's INK
+// or PAPER, in the bright half of the palette when the cell has BRIGHT set; FLASH is ignored.
+func scrToIndexed(data []byte) (*indexedImage, error) {
+	if len(data) != scrSize {
+		return nil, fmt.Errorf("%w: SCR files are %d bytes, got %d", ErrUnsupportedFormat, scrSize, len(data))
+	}
+	m := newIndexedImage(scrWidth, scrHeight)
+	for y := 0; y < scrHeight; y++ {
+		line := data[screenLineOffset(y) : screenLineOffset(y)+scrWidth/8]
+		for x := 0; x < scrWidth; x++ {
+			attr := data[scrBitmapSize+(y/8)*(scrWidth/8)+x/8]
+			bright := int(attr>>6&1) * 8
+			if line[x/8]&(0x80>>uint(x%8)) != 0 {
+				m.set(x, y, int(attr&7)+bright)
+			} else {
+				m.set(x, y, int(attr>>3&7)+bright)
+			}
+		}
+	}
+	return m, nil
+}
+
+// flashPhaseDuration is how long each FLASH phase lasts on real hardware, in milliseconds: the
+// ULA swaps INK and PAPER every 16 frames at 50 frames per second.
+const flashPhaseDuration = 320
+
+// animateFlash decodes SCR files with FLASH cells as a two-frame animation.
+var animateFlash bool
+
+// scrFlashAnimation decodes an SCR file as the two phases of its FLASH cycle: as drawn, then with
+// INK and PAPER swapped in every cell that has FLASH set.
+func scrFlashAnimation(data []byte) (*animation, error) {
+	m, err := scrToIndexed(data)
+	if err != nil {
+		return nil, err
+	}
+	swapped := newIndexedImage(scrWidth, scrHeight)
+	copy(swapped.pix, m.pix)
+	for y := 0; y < scrHeight; y++ {
+		for x := 0; x < scrWidth; x++ {
+			attr := data[scrBitmapSize+(y/8)*(scrWidth/8)+x/8]
+			if attr&0x80 == 0 {
+				continue
+			}
+			bright := int(attr>>6&1) * 8
+			if m.at(x, y) == int(attr&7)+bright {
+				swapped.set(x, y, int(attr>>3&7)+bright)
+			} else {
+				swapped.set(x, y, int(attr&7)+bright)
+			}
+		}
+	}
+	return &animation{frames: []*indexedImage{m, swapped}, meta: map[string]string{}, duration: flashPhaseDuration}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Slices: sheets that are not laid out on a regular grid can be cut up by a JSON file naming
+// rectangles within them, such as
+//
+//	{"slices": [{"name": "player", "x": 0, "y": 0, "width": 16, "height": 24}, ...]}
+//
+// With --slices, each rectangle is written as a sprite of its own, named after the output with
+// the slice's name as a suffix (sheet_player.hex), so its labels in source exports follow too.
+
+// sliceFile is the --slices definition file; slices are read from it.
+var (
+	sliceFile string
+	slices    []slice
+)
+
+// slice is one named rectangle of a sheet.
+type slice struct {
+	Name   string `json:"name"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// checkSliceSettings reads and checks the slice definitions.
+func checkSliceSettings() error {
+	slices = nil
+	if sliceFile == "" {
+		return nil
+	}
+	if splitIslands || splitScreens {
+		return fmt.Errorf("--slices cannot be combined with --islands or --split-screens")
+	}
+	data, err := ioutil.ReadFile(sliceFile)
+	if err != nil {
+		return err
+	}
+	var defs struct {
+		Slices []slice `json:"slices"`
+	}
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("reading slices from %s: %w", sliceFile, err)
+	}
+	if len(defs.Slices) == 0 {
+		return fmt.Errorf("%s defines no slices", sliceFile)
+	}
+	seen := map[string]bool{}
+	for i, s := range defs.Slices {
+		switch {
+		case s.Name == "" || strings.ContainsAny(s.Name, `/\:*?"<>|`):
+			return fmt.Errorf("slice %d in %s needs a name usable in file names", i, sliceFile)
+		case seen[s.Name]:
+			return fmt.Errorf("%s defines slice %q twice", sliceFile, s.Name)
+		case s.X < 0 || s.Y < 0 || s.Width < 1 || s.Height < 1:
+			return fmt.Errorf("slice %q in %s has an invalid rectangle", s.Name, sliceFile)
+		}
+		seen[s.Name] = true
+	}
+	slices = defs.Slices
+	return nil
+}
+
+// writeSlices writes every slice of an image to its own file, named after output (or the default
+// output name) with the slice's name as a suffix.
+func writeSlices(src *source, m *indexedImage, format, output, outDir string) error {
+	if output == "" {
+		output = filepath.Join(outDir, defaultOutputName(src, formatExtensions[format]))
+	}
+	for _, s := range slices {
+		if s.X+s.Width > m.width || s.Y+s.Height > m.height {
+			return fmt.Errorf("slice %q lies outside the %dx%d image", s.Name, m.width, m.height)
+		}
+	}
+	for _, s := range slices {
+		suffix := "_" + s.Name
+		sprite := cropIndexed(m, s.X, s.Y, s.Width, s.Height)
+		if err := writeFormat(suffixedSource(src, suffix), sprite, format, withSuffix(output, suffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
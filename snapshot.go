@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+)
+
+// Snapshots: a converted screen can be dropped into the display memory of an existing .sna or
+// .z80 snapshot, so that loading the snapshot in an emulator or on real hardware shows the artwork
+// at once. Everything else in the template, registers and program included, is kept.
+
+// snapshotTemplate is the snapshot the sna and z80 formats copy, with the screen replaced.
+var snapshotTemplate string
+
+// SNA layout: a 27-byte register header, then memory from 16384, so the screen comes first. 128K
+// snapshots continue with the other banks, but start the same way.
+const snaHeaderSize = 27
+
+// snaSizes lists the lengths of valid SNA files: 48K, and 128K with five or six extra banks.
+var snaSizes = map[int]bool{49179: true, 131103: true, 147487: true}
+
+// z80ScreenPage is the memory page holding the screen in version 2 and 3 .z80 files, in both 48K
+// and 128K mode.
+const z80ScreenPage = 8
+
+// injectSNA returns a copy of an SNA snapshot with its screen replaced, and its border colour
+// too unless border is -1.
+func injectSNA(template, scr []byte, border int) ([]byte, error) {
+	if !snaSizes[len(template)] {
+		return nil, fmt.Errorf("%w: %d bytes is not the size of an SNA snapshot", ErrUnsupportedFormat, len(template))
+	}
+	out := append([]byte(nil), template...)
+	copy(out[snaHeaderSize:], scr)
+	if border >= 0 {
+		out[snaHeaderSize-1] = byte(border)
+	}
+	return out, nil
+}
+
+// z80Decompress expands .z80 memory compression, where ED ED n b stands for n copies of b, until
+// size bytes have been produced. It returns the memory and the number of input bytes used.
+func z80Decompress(data []byte, size int) ([]byte, int, error) {
+	out := make([]byte, 0, size)
+	i := 0
+	for len(out) < size && i < len(data) {
+		if i+3 < len(data) && data[i] == 0xED && data[i+1] == 0xED {
+			for n := 0; n < int(data[i+2]); n++ {
+				out = append(out, data[i+3])
+			}
+			i += 4
+			continue
+		}
+		out = append(out, data[i])
+		i++
+	}
+	if len(out) != size {
+		return nil, 0, fmt.Errorf("%w: Z80 snapshot memory is truncated", ErrUnsupportedFormat)
+	}
+	return out, i, nil
+}
+
+// z80Border sets the border colour in the flags byte of a .z80 header, unless border is -1.
+func z80Border(flags byte, border int) byte {
+	if border < 0 {
+		return flags
+	}
+	if flags == 0xFF {
+		flags = 1
+	}
+	return flags&^0x0E | byte(border)<<1
+}
+
+// injectZ80 returns a copy of a .z80 snapshot with its screen replaced, and its border colour
+// too unless border is -1. The replaced memory is stored uncompressed; the rest of the snapshot
+// is copied as it is.
+func injectZ80(template, scr []byte, border int) ([]byte, error) {
+	if len(template) < 30 {
+		return nil, fmt.Errorf("%w: Z80 snapshot is too short", ErrUnsupportedFormat)
+	}
+	// Version 1 files have a non-zero PC in the header and hold 48K of memory straight after it.
+	if binary.LittleEndian.Uint16(template[6:]) != 0 {
+		flags := template[12]
+		if flags == 0xFF {
+			flags = 1 // As the format's own documentation asks.
+		}
+		mem := template[30:]
+		if flags&0x20 != 0 {
+			var err error
+			if mem, _, err = z80Decompress(mem, 0xC000); err != nil {
+				return nil, err
+			}
+		} else if len(mem) < 0xC000 {
+			return nil, fmt.Errorf("%w: Z80 snapshot memory is truncated", ErrUnsupportedFormat)
+		}
+		out := append([]byte(nil), template[:30]...)
+		out[12] = z80Border(flags&^0x20, border)
+		out = append(out, mem[:0xC000]...)
+		copy(out[30:], scr)
+		return out, nil
+	}
+
+	// Versions 2 and 3 have an extended header, then memory pages: a length (0xFFFF for an
+	// uncompressed page), a page number, and the data.
+	if len(template) < 32 {
+		return nil, fmt.Errorf("%w: Z80 snapshot is too short", ErrUnsupportedFormat)
+	}
+	pos := 32 + int(binary.LittleEndian.Uint16(template[30:]))
+	if pos > len(template) {
+		return nil, fmt.Errorf("%w: Z80 snapshot header is truncated", ErrUnsupportedFormat)
+	}
+	out := append([]byte(nil), template[:pos]...)
+	out[12] = z80Border(out[12], border)
+	found := false
+	for pos < len(template) {
+		if pos+3 > len(template) {
+			return nil, fmt.Errorf("%w: Z80 snapshot page is truncated", ErrUnsupportedFormat)
+		}
+		n, page := int(binary.LittleEndian.Uint16(template[pos:])), template[pos+2]
+		stored := n
+		if n == 0xFFFF {
+			stored = 0x4000
+		}
+		body := template[pos+3:]
+		if stored > len(body) {
+			return nil, fmt.Errorf("%w: Z80 snapshot page %d is truncated", ErrUnsupportedFormat, page)
+		}
+		body = body[:stored]
+		pos += 3 + stored
+		if page != z80ScreenPage {
+			out = append(out, template[pos-3-stored:pos]...)
+			continue
+		}
+		mem := body
+		if n != 0xFFFF {
+			var err error
+			if mem, _, err = z80Decompress(body, 0x4000); err != nil {
+				return nil, err
+			}
+		}
+		mem = append([]byte(nil), mem...)
+		copy(mem, scr)
+		out = append(out, 0xFF, 0xFF, page)
+		out = append(out, mem...)
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: Z80 snapshot has no screen page", ErrUnsupportedFormat)
+	}
+	return out, nil
+}
+
+// snapshotWithScreen reads the snapshot template and returns it, as the given format, with the
+// screen replaced, and the border colour unless border is -1.
+func snapshotWithScreen(format string, scr []byte, border int) ([]byte, error) {
+	if snapshotTemplate == "" {
+		return nil, fmt.Errorf("the %s format needs a template snapshot (--snapshot file)", format)
+	}
+	template, err := ioutil.ReadFile(snapshotTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot template: %w", err)
+	}
+	if format == "sna" {
+		return injectSNA(template, scr, border)
+	}
+	return injectZ80(template, scr, border)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Splitting oversized images: an image larger than the Spectrum screen is cut into screen-sized
+// tiles, each written as its own output with an _rNcM suffix, and a JSON manifest records where
+// every tile belongs. Useful for multi-screen title sequences and maps.
+
+// splitScreens enables tiling of images larger than a screen.
+var splitScreens bool
+
+// screenLayout is the manifest written alongside split screens.
+type screenLayout struct {
+	Source     string       `json:"source"`
+	Width      int          `json:"width"`
+	Height     int          `json:"height"`
+	TileWidth  int          `json:"tile_width"`
+	TileHeight int          `json:"tile_height"`
+	Columns    int          `json:"columns"`
+	Rows       int          `json:"rows"`
+	Tiles      []screenTile `json:"tiles"`
+	Generator  string       `json:"generator"`
+}
+
+// screenTile describes one tile of a split image.
+type screenTile struct {
+	Row    int    `json:"row"`
+	Column int    `json:"column"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	File   string `json:"file"`
+}
+
+// screenTileSize returns the size of a screen in the pixels of the image being written: chunky
+// hex data has one pixel per 2×2 block.
+func screenTileSize(src *source, format string) (int, int) {
+	if src.chunky && format == "hex" {
+		return scrWidth / chunkySize, scrHeight / chunkySize
+	}
+	return scrWidth, scrHeight
+}
+
+// withSuffix inserts a suffix before a filename's extension.
+func withSuffix(filename, suffix string) string {
+	if filename == "" {
+		return ""
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + suffix + ext
+}
+
+// suffixedSource returns a copy of a source named, and labelled, as if it came from its own file
+// with the given suffix. The copy is a single image, even when the source is an animation.
+func suffixedSource(src *source, suffix string) *source {
+	out := *src
+	out.anim = nil
+	out.name = withSuffix(src.name, suffix)
+	out.meta = map[string]string{}
+	for k, v := range src.meta {
+		out.meta[k] = v
+	}
+	if f := src.meta["file"]; f != "" {
+		out.meta["file"] = withSuffix(f, suffix)
+	}
+	return &out
+}
+
+// cropIndexed returns the w×h area of an image at (x, y); pixels outside the image are transparent.
+func cropIndexed(m *indexedImage, x, y, w, h int) *indexedImage {
+	out := newIndexedImage(w, h)
+	for ty := 0; ty < h && y+ty < m.height; ty++ {
+		for tx := 0; tx < w && x+tx < m.width; tx++ {
+			out.set(tx, ty, m.at(x+tx, y+ty))
+		}
+	}
+	return out
+}
+
+// splitIntoScreens writes every screen-sized tile of an image to its own file, named after output
+// (or the default output name) with an _rNcM suffix, then writes the layout manifest. Tiles on the
+// right and bottom edges are padded with transparent pixels to a full screen.
+func splitIntoScreens(src *source, m *indexedImage, format, output, outDir string) error {
+	tw, th := screenTileSize(src, format)
+	if output == "" {
+		output = filepath.Join(outDir, defaultOutputName(src, formatExtensions[format]))
+	}
+	layout := screenLayout{
+		Source:     recordedName(sourceFileName(src)),
+		Width:      m.width,
+		Height:     m.height,
+		TileWidth:  tw,
+		TileHeight: th,
+		Columns:    (m.width + tw - 1) / tw,
+		Rows:       (m.height + th - 1) / th,
+		Generator:  "zxtex",
+	}
+	for row := 0; row < layout.Rows; row++ {
+		for col := 0; col < layout.Columns; col++ {
+			suffix := fmt.Sprintf("_r%dc%d", row, col)
+			tileOutput := withSuffix(output, suffix)
+			if err := writeFormat(suffixedSource(src, suffix), cropIndexed(m, col*tw, row*th, tw, th), format, tileOutput); err != nil {
+				return err
+			}
+			layout.Tiles = append(layout.Tiles, screenTile{
+				Row:    row,
+				Column: col,
+				X:      col * tw,
+				Y:      row * th,
+				File:   filepath.Base(tileOutput),
+			})
+		}
+	}
+	data, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifest := strings.TrimSuffix(output, filepath.Ext(output)) + "_layout.json"
+	if err := writeOutputFile(manifest, append(data, '\n')); err != nil {
+		return fmt.Errorf("writing layout: %w", err)
+	}
+	statusf("Layout written to %s\n", manifest)
+	return nil
+}
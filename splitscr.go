@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Split screens: many tools save a Spectrum screen as two files, the 6144-byte bitmap and the
+// 768 bytes of attributes that follow it in display memory. With --attr, each input is read as
+// such a bitmap, in display memory order, and joined with the attribute file into a full screen,
+// which then converts like any SCR input, --animate-flash included.
+
+// attrFile is the attribute file given with --attr; empty when inputs are read on their own.
+var attrFile string
+
+// scrAttrSize is the size of the attribute area of a Spectrum screen.
+const scrAttrSize = scrSize - scrBitmapSize
+
+// checkAttrSettings validates --attr, which pairs binary bitmap inputs with an attribute file.
+func checkAttrSettings() error {
+	if attrFile == "" {
+		return nil
+	}
+	if inputType != "auto" && inputType != "scr" {
+		return fmt.Errorf("--attr joins bitmap dumps into screens, so it cannot be used with --type %s", inputType)
+	}
+	if attrFile == stdinName {
+		return fmt.Errorf("--attr needs an attribute file, not standard input")
+	}
+	return nil
+}
+
+// mergeScreen joins a bitmap dump with the attribute file into a 6912-byte screen.
+func mergeScreen(bitmap []byte) ([]byte, error) {
+	attrs, err := readInput(attrFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(bitmap) != scrBitmapSize {
+		return nil, fmt.Errorf("%w: bitmap for --attr has %d bytes, not %d", ErrUnsupportedFormat, len(bitmap), scrBitmapSize)
+	}
+	if len(attrs) != scrAttrSize {
+		return nil, fmt.Errorf("%w: attribute file %s has %d bytes, not %d", ErrUnsupportedFormat, attrFile, len(attrs), scrAttrSize)
+	}
+	screen := make([]byte, 0, scrSize)
+	screen = append(screen, bitmap...)
+	return append(screen, attrs...), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Scroll strips: a long image is cut into chunks a whole number of cells wide (or high, for
+// vertical scrolling) and emitted in the order a scrolling engine draws them in, with an index
+// table locating each chunk.
+
+// Scroll strip settings.
+var (
+	scrollDirection string // Direction the screen scrolls in: "left", "right", "up" or "down"; empty to disable.
+	chunkCells      = 1    // Width (or height) of each chunk, in 8-pixel cells.
+)
+
+// checkScrollSettings validates the scroll strip settings.
+func checkScrollSettings() error {
+	switch scrollDirection {
+	case "", "left", "right", "up", "down":
+	default:
+		return fmt.Errorf("unknown scroll direction %q (expected left, right, up or down)", scrollDirection)
+	}
+	if chunkCells < 1 {
+		return fmt.Errorf("chunk size must be at least one cell")
+	}
+	return nil
+}
+
+// stripChunks cuts an image into chunks in scroll order. Scrolling left brings new columns in on
+// the right, so chunks run left to right; scrolling up brings new rows in at the bottom, so they
+// run top to bottom; right and down run the other way. The last chunk is padded with
+// transparent pixels.
+func stripChunks(m *indexedImage) []*indexedImage {
+	size := chunkCells * 8
+	var chunks []*indexedImage
+	switch scrollDirection {
+	case "left", "right":
+		for x := 0; x < m.width; x += size {
+			chunks = append(chunks, cropIndexed(m, x, 0, size, m.height))
+		}
+	default:
+		for y := 0; y < m.height; y += size {
+			chunks = append(chunks, cropIndexed(m, 0, y, m.width, size))
+		}
+	}
+	if scrollDirection == "right" || scrollDirection == "down" {
+		for i, j := 0, len(chunks)-1; i < j; i, j = i+1, j-1 {
+			chunks[i], chunks[j] = chunks[j], chunks[i]
+		}
+	}
+	return chunks
+}
+
+// writeStrip exports an image as scroll strip chunks in a bitmap format (bin, asm or c). Source
+// formats label every chunk and end with a table of their addresses; binary output writes the
+// chunks back to back and a separate _index file of 16-bit little-endian offsets.
+func writeStrip(src *source, m *indexedImage, format, output string) error {
+	chunks := stripChunks(m)
+	var data [][]byte
+	lineLen := 0
+	for i, chunk := range chunks {
+		bytes, n, err := exportBitmap(chunk)
+		if err != nil {
+			return fmt.Errorf("exporting chunk %d: %w", i, err)
+		}
+		data = append(data, bytes)
+		lineLen = n
+	}
+	header := []string{
+		fmt.Sprintf("width: %d", m.width),
+		fmt.Sprintf("height: %d", m.height),
+		"scroll: " + scrollDirection,
+		fmt.Sprintf("chunk: %d cells", chunkCells),
+		fmt.Sprintf("chunks: %d", len(chunks)),
+		"order: " + byteOrder,
+		"bitorder: " + bitOrder,
+		"generator: zxtex",
+	}
+	label := sourceLabel(src)
+	switch format {
+	case "asm":
+		var sb strings.Builder
+		for i, chunk := range data {
+			var h []string
+			if i == 0 {
+				h = header
+			}
+			sb.WriteString(bytesToAsm(chunk, fmt.Sprintf("%s_%d", label, i), lineLen, h))
+		}
+		sb.WriteString(label + "_index:\n")
+		for i := range data {
+			sb.WriteString(fmt.Sprintf("\tdefw %s_%d\n", label, i))
+		}
+		if err := writeTextOutput(sb.String(), output, "Assembly"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	case "c":
+		var sb strings.Builder
+		var names []string
+		for i, chunk := range data {
+			var h []string
+			if i == 0 {
+				h = header
+			}
+			name := fmt.Sprintf("%s_%d", label, i)
+			names = append(names, name)
+			sb.WriteString(bytesToC(chunk, name, lineLen, h))
+		}
+		sb.WriteString(fmt.Sprintf("const unsigned char * const %s_index[%d] = {\n\t%s\n};\n", label, len(names), strings.Join(names, ", ")))
+		if err := writeTextOutput(sb.String(), output, "C source"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	case "bin":
+		if output == stdoutName {
+			return fmt.Errorf("binary scroll strips are written as two files and cannot go to standard output")
+		}
+		var all, index []byte
+		for _, chunk := range data {
+			index = binary.LittleEndian.AppendUint16(index, uint16(len(all)))
+			all = append(all, chunk...)
+		}
+		if len(all) > 0xFFFF {
+			return fmt.Errorf("%d bytes of chunks is too much for a 16-bit index", len(all))
+		}
+		if err := writeBinaryOutput(all, output, format, "Strip data"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+		if err := writeBinaryOutput(index, withSuffix(output, "_index"), format, "Strip index"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	default:
+		return fmt.Errorf("%w: scroll strips can be written as bin, asm or c, not %s", ErrUnsupportedFormat, format)
+	}
+	return nil
+}
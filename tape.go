@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Tape images: a .tap file is the sequence of blocks the ROM saves, each stored as a two-byte
+// length followed by the block itself: a flag byte (0 for headers, 255 for data), the bytes, and
+// an XOR checksum. A .tzx file describes the signal too, in blocks of many kinds; its standard,
+// turbo and pure data blocks carry the same bytes. Screens are ripped from tapes by decoding a
+// 6912-byte data block as an SCR, and binary outputs can be added to a .tap as CODE files.
+
+// tapImage is the .tap file binary outputs are added to instead of being written as files.
+var tapImage string
+
+// tapeLoaderName is the name of the loader program written to tapes with --loader.
+const tapeLoaderName = "loader"
+
+// tapeBlockSelector picks the tape block to decode: a block number, a header name, or empty for
+// the first screen-sized block.
+var tapeBlockSelector string
+
+// tapeHeaderSize is the length of the body of a ROM header block, without flag and checksum.
+const tapeHeaderSize = 17
+
+// tapeBlock is one block of a tape image.
+type tapeBlock struct {
+	flag       byte   // 0 for headers, 255 for data.
+	data       []byte // The block without its flag and checksum.
+	checksumOK bool
+	speed      string // The kind of TZX block it came from: "turbo" or "pure data"; empty for standard blocks.
+	bare       bool   // A custom-loader block of exactly one screen, with no flag or checksum.
+}
+
+// tapeHeader is the content of a ROM header block.
+type tapeHeader struct {
+	fileType       byte
+	name           string
+	length         int
+	param1, param2 int // Load address or autostart line, and the program length.
+}
+
+// tapeTypeNames names the file types of ROM headers.
+var tapeTypeNames = []string{"Program", "Number array", "Character array", "Bytes"}
+
+// parseTAP splits a .tap file into its blocks.
+func parseTAP(data []byte) ([]tapeBlock, error) {
+	var blocks []tapeBlock
+	for pos := 0; pos < len(data); {
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("%w: TAP file truncated at offset %d", ErrUnsupportedFormat, pos)
+		}
+		n := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		if n < 2 || pos+n > len(data) {
+			return nil, fmt.Errorf("%w: TAP block %d at offset %d is truncated", ErrUnsupportedFormat, len(blocks), pos-2)
+		}
+		blocks = append(blocks, newTapeBlock(data[pos:pos+n]))
+		pos += n
+	}
+	return blocks, nil
+}
+
+// newTapeBlock makes a tape block from its raw bytes: flag, data and checksum.
+func newTapeBlock(raw []byte) tapeBlock {
+	var sum byte
+	for _, b := range raw {
+		sum ^= b
+	}
+	return tapeBlock{flag: raw[0], data: raw[1 : len(raw)-1], checksumOK: sum == 0}
+}
+
+// looksLikeTAP reports whether data is a .tap file: a whole number of blocks, starting with a
+// valid ROM header.
+func looksLikeTAP(data []byte) bool {
+	blocks, err := parseTAP(data)
+	if err != nil || len(blocks) == 0 {
+		return false
+	}
+	_, ok := blocks[0].header()
+	return ok && blocks[0].checksumOK
+}
+
+// header decodes a block as a ROM header, reporting false when it is not one.
+func (b tapeBlock) header() (tapeHeader, bool) {
+	if b.flag != 0 || len(b.data) != tapeHeaderSize || b.data[0] > 3 {
+		return tapeHeader{}, false
+	}
+	return tapeHeader{
+		fileType: b.data[0],
+		name:     strings.TrimRight(string(b.data[1:11]), " "),
+		length:   int(binary.LittleEndian.Uint16(b.data[11:])),
+		param1:   int(binary.LittleEndian.Uint16(b.data[13:])),
+		param2:   int(binary.LittleEndian.Uint16(b.data[15:])),
+	}, true
+}
+
+// tapeListing describes every block of a tape, one line each.
+func tapeListing(blocks []tapeBlock) string {
+	var sb strings.Builder
+	for i, b := range blocks {
+		var desc string
+		if h, ok := b.header(); ok {
+			desc = fmt.Sprintf("header  %s %q, %d bytes", tapeTypeNames[h.fileType], h.name, h.length)
+			switch h.fileType {
+			case fileTypeProgram:
+				if h.param1 < 32768 {
+					desc += fmt.Sprintf(", autostart %d", h.param1)
+				}
+			case fileTypeCode:
+				desc += fmt.Sprintf(", address %d", h.param1)
+			}
+		} else {
+			desc = fmt.Sprintf("data    %d bytes, flag %d", len(b.data), b.flag)
+			if b.bare {
+				desc = fmt.Sprintf("data    %d bytes, no flag", len(b.data))
+			}
+			if b.speed != "" {
+				desc += ", " + b.speed
+			}
+			if len(b.data) == scrSize {
+				desc += " (screen)"
+			}
+		}
+		if !b.checksumOK {
+			desc += ", bad checksum"
+		}
+		sb.WriteString(fmt.Sprintf("%3d  %s\n", i, desc))
+	}
+	return sb.String()
+}
+
+// tapeScreen returns the screen stored on a tape: the block chosen by the block selector, or the
+// data block after the header of that name, or by default the first 6912-byte data block.
+func tapeScreen(blocks []tapeBlock) ([]byte, error) {
+	index := -1
+	switch n, err := strconv.Atoi(tapeBlockSelector); {
+	case tapeBlockSelector == "":
+		for i, b := range blocks {
+			if _, isHeader := b.header(); !isHeader && len(b.data) == scrSize {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%w: no 6912-byte screen block on the tape", ErrUnsupportedFormat)
+		}
+	case err == nil:
+		if n < 0 || n >= len(blocks) {
+			return nil, fmt.Errorf("tape block %d out of range (the tape has %d blocks)", n, len(blocks))
+		}
+		index = n
+	default:
+		for i, b := range blocks {
+			if h, ok := b.header(); ok && h.name == tapeBlockSelector && i+1 < len(blocks) {
+				index = i + 1
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("no file named %q on the tape", tapeBlockSelector)
+		}
+	}
+	if len(blocks[index].data) != scrSize {
+		return nil, fmt.Errorf("%w: tape block %d is %d bytes, not a %d-byte screen", ErrUnsupportedFormat, index, len(blocks[index].data), scrSize)
+	}
+	return blocks[index].data, nil
+}
+
+// tzxSignature starts every .tzx file, followed by the major and minor version.
+const tzxSignature = "ZXTape!\x1a"
+
+// parseTape splits a .tap or .tzx file into its data blocks.
+func parseTape(data []byte) ([]tapeBlock, error) {
+	if strings.HasPrefix(string(data), tzxSignature) {
+		return parseTZX(data)
+	}
+	return parseTAP(data)
+}
+
+// tzxBlockLengths gives the length of every TZX block that carries no data, after its ID, as a
+// fixed size plus a count of the given width (in bytes) times a unit length.
+var tzxBlockLengths = map[byte]struct{ fixed, countSize, unit int }{
+	0x12: {4, 0, 0},  // Pure tone.
+	0x13: {1, 1, 2},  // Pulse sequence.
+	0x15: {8, 3, 1},  // Direct recording.
+	0x18: {4, 4, 1},  // CSW recording.
+	0x19: {4, 4, 1},  // Generalized data.
+	0x20: {2, 0, 0},  // Pause.
+	0x21: {1, 1, 1},  // Group start.
+	0x22: {0, 0, 0},  // Group end.
+	0x23: {2, 0, 0},  // Jump.
+	0x24: {2, 0, 0},  // Loop start.
+	0x25: {0, 0, 0},  // Loop end.
+	0x26: {2, 2, 2},  // Call sequence.
+	0x27: {0, 0, 0},  // Return from sequence.
+	0x28: {2, 2, 1},  // Select block.
+	0x2A: {4, 0, 0},  // Stop the tape in 48K mode.
+	0x2B: {5, 0, 0},  // Set signal level.
+	0x30: {1, 1, 1},  // Text description.
+	0x31: {2, 1, 1},  // Message.
+	0x32: {2, 2, 1},  // Archive info.
+	0x33: {1, 1, 3},  // Hardware type.
+	0x35: {20, 4, 1}, // Custom info.
+	0x5A: {9, 0, 0},  // Glue.
+}
+
+// parseTZX extracts the data blocks of a .tzx file: standard speed, turbo speed and pure data
+// blocks. Blocks that only shape the signal, or hold descriptions, are skipped.
+func parseTZX(data []byte) ([]tapeBlock, error) {
+	var blocks []tapeBlock
+	pos := len(tzxSignature) + 2
+	if len(data) < pos {
+		return nil, fmt.Errorf("%w: TZX file truncated", ErrUnsupportedFormat)
+	}
+	// need reports whether n more bytes are available at pos.
+	need := func(n int) bool { return pos+n <= len(data) }
+	for pos < len(data) {
+		id := data[pos]
+		pos++
+		var start, length int
+		speed := ""
+		switch id {
+		case 0x10: // Standard speed data: pause, length, data.
+			if !need(4) {
+				return nil, fmt.Errorf("%w: TZX block at offset %d is truncated", ErrUnsupportedFormat, pos-1)
+			}
+			start, length = pos+4, int(binary.LittleEndian.Uint16(data[pos+2:]))
+		case 0x11: // Turbo speed data: timings, pause, 24-bit length, data.
+			if !need(18) {
+				return nil, fmt.Errorf("%w: TZX block at offset %d is truncated", ErrUnsupportedFormat, pos-1)
+			}
+			start, length, speed = pos+18, uint24(data[pos+15:]), "turbo"
+		case 0x14: // Pure data: timings, pause, 24-bit length, data.
+			if !need(10) {
+				return nil, fmt.Errorf("%w: TZX block at offset %d is truncated", ErrUnsupportedFormat, pos-1)
+			}
+			start, length, speed = pos+10, uint24(data[pos+7:]), "pure data"
+		default:
+			l, ok := tzxBlockLengths[id]
+			if !ok {
+				return nil, fmt.Errorf("%w: unknown TZX block type 0x%02X at offset %d", ErrUnsupportedFormat, id, pos-1)
+			}
+			if !need(l.fixed) {
+				return nil, fmt.Errorf("%w: TZX block at offset %d is truncated", ErrUnsupportedFormat, pos-1)
+			}
+			// The count, when there is one, is the last field of the fixed part.
+			n := 0
+			for i := 0; i < l.countSize; i++ {
+				n |= int(data[pos+l.fixed-l.countSize+i]) << (8 * i)
+			}
+			pos += l.fixed + n*l.unit
+			continue
+		}
+		if start+length > len(data) {
+			return nil, fmt.Errorf("%w: TZX block at offset %d is truncated", ErrUnsupportedFormat, pos-1)
+		}
+		raw := data[start : start+length]
+		pos = start + length
+		switch {
+		case speed != "" && length == scrSize:
+			blocks = append(blocks, tapeBlock{flag: 0xFF, data: raw, checksumOK: true, speed: speed, bare: true})
+		case length >= 2:
+			b := newTapeBlock(raw)
+			b.speed = speed
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks, nil
+}
+
+// uint24 decodes a little-endian 24-bit number.
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// checkTAPSettings rejects combinations of tape settings that cannot be honoured together.
+func checkTAPSettings() error {
+	if tapImage != "" && (trdImage != "" || dskImage != "" || hobetaOutput || plus3Header) {
+		return fmt.Errorf("--tap cannot be combined with --trd, --dsk, --hobeta or --plus3dos")
+	}
+	return nil
+}
+
+// tapeName converts a filename into a 10-character, space-padded tape file name.
+func tapeName(filename string) string {
+	name := filepath.Base(filename)
+	if len(name) > 10 {
+		name = name[:10]
+	}
+	return fmt.Sprintf("%-10s", name)
+}
+
+// tapeHeaderBlock returns a ROM header block.
+func tapeHeaderBlock(fileType byte, name string, length, param1, param2 int) []byte {
+	h := make([]byte, 1+tapeHeaderSize)
+	h[1] = fileType
+	copy(h[2:12], tapeName(name))
+	binary.LittleEndian.PutUint16(h[12:], uint16(length))
+	binary.LittleEndian.PutUint16(h[14:], uint16(param1))
+	binary.LittleEndian.PutUint16(h[16:], uint16(param2))
+	return h
+}
+
+// appendTAPBlock appends a block (flag and data) to a .tap file, with its length and checksum.
+func appendTAPBlock(tap, block []byte) []byte {
+	var sum byte
+	for _, b := range block {
+		sum ^= b
+	}
+	tap = binary.LittleEndian.AppendUint16(tap, uint16(len(block)+1))
+	tap = append(tap, block...)
+	return append(tap, sum)
+}
+
+// appendTAPFile appends a header and data block pair to a .tap file.
+func appendTAPFile(tap, header, data []byte) []byte {
+	tap = appendTAPBlock(tap, header)
+	return appendTAPBlock(tap, append([]byte{0xFF}, data...))
+}
+
+// addToTAP adds data to a .tap file as a CODE file named after filename, creating the file when it
+// does not exist yet. With --loader, the tape starts with a loader program that loads every CODE
+// file on it; an earlier loader is replaced.
+func addToTAP(tapeFile, filename string, data []byte, addr int) error {
+	var blocks []tapeBlock
+	if fileExists(tapeFile) {
+		existing, err := ioutil.ReadFile(tapeFile)
+		if err != nil {
+			return err
+		}
+		if blocks, err = parseTAP(existing); err != nil {
+			return fmt.Errorf("%s: %w", tapeFile, err)
+		}
+	}
+	if len(data) > 0xFFFF-2 {
+		return fmt.Errorf("%s is too long for a tape file (%d bytes)", filename, len(data))
+	}
+	name := strings.TrimRight(tapeName(filename), " ")
+	var tap []byte
+	var codeFiles []string
+	for i := 0; i < len(blocks); i++ {
+		b := blocks[i]
+		h, isHeader := b.header()
+		if isHeader && h.name == name {
+			return fmt.Errorf("%s is already on the tape", name)
+		}
+		if isHeader && h.fileType == fileTypeProgram && h.name == tapeLoaderName && writeLoader {
+			i++ // Drop the old loader and its data block; a new one is written below.
+			continue
+		}
+		if isHeader && h.fileType == fileTypeCode {
+			codeFiles = append(codeFiles, h.name)
+		}
+		tap = appendTAPBlock(tap, append([]byte{b.flag}, b.data...))
+	}
+	tap = appendTAPFile(tap, tapeHeaderBlock(fileTypeCode, name, len(data), addr, 0x8000), data)
+	if writeLoader {
+		prog := loaderProgram(append(codeFiles, name))
+		loader := appendTAPFile(nil, tapeHeaderBlock(fileTypeProgram, tapeLoaderName, len(prog), 10, len(prog)), prog)
+		tap = append(loader, tap...)
+	}
+	return writeFileAtomic(tapeFile, tap)
+}
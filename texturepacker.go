@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TexturePacker atlases: TexturePacker, free-tex-packer and most engine tools describe a packed
+// sheet in JSON, with the frames listed either as an object keyed by name (the "hash" layout) or
+// as an array of objects with a "filename" (the "array" layout), and the sheet image named under
+// "meta". "zxtex unpack" reads such an atlas and converts every frame into a sprite of its own,
+// named after the frame. Frames the packer rotated a quarter turn clockwise are turned back, and
+// the trimming of each frame is kept as header fields: "trim: X,Y" is where the sprite sits in
+// its untrimmed frame, and "source-size: WxH" the size of that frame. "zxtex atlas" writes the
+// same format, in the hash layout, so engine importers that read TexturePacker atlases can read
+// zxtex sheets too.
+
+// tpRect is a rectangle in TexturePacker JSON.
+type tpRect struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// tpSize is a size in TexturePacker JSON.
+type tpSize struct {
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// tpFrame is one frame of a TexturePacker atlas.
+type tpFrame struct {
+	Filename         string `json:"filename,omitempty"` // Array layout only; the hash layout keys frames by name.
+	Frame            tpRect `json:"frame"`
+	Rotated          bool   `json:"rotated"`
+	Trimmed          bool   `json:"trimmed"`
+	SpriteSourceSize tpRect `json:"spriteSourceSize"`
+	SourceSize       tpSize `json:"sourceSize"`
+}
+
+// tpMeta is the "meta" object of a TexturePacker atlas.
+type tpMeta struct {
+	App     string `json:"app,omitempty"`
+	Version string `json:"version,omitempty"`
+	Image   string `json:"image"`
+	Format  string `json:"format,omitempty"`
+	Size    tpSize `json:"size"`
+	Scale   string `json:"scale,omitempty"`
+}
+
+// tpAtlas is a TexturePacker atlas, with its frames in order and the path of its sheet image.
+type tpAtlas struct {
+	image  string
+	frames []tpFrame
+}
+
+// readTexturePacker reads a TexturePacker JSON atlas in either layout. Frames of the hash layout,
+// whose order JSON does not keep, are sorted by name.
+func readTexturePacker(filename string) (*tpAtlas, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Frames json.RawMessage `json:"frames"`
+		Meta   tpMeta          `json:"meta"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("reading atlas %s: %w", filename, err)
+	}
+	if doc.Meta.Image == "" {
+		return nil, fmt.Errorf("atlas %s does not name its sheet image", filename)
+	}
+	atlas := &tpAtlas{image: filepath.Join(filepath.Dir(filename), filepath.FromSlash(doc.Meta.Image))}
+	if err := json.Unmarshal(doc.Frames, &atlas.frames); err != nil {
+		byName := map[string]tpFrame{}
+		if err := json.Unmarshal(doc.Frames, &byName); err != nil {
+			return nil, fmt.Errorf("reading atlas %s: frames are neither a list nor keyed by name", filename)
+		}
+		for name, f := range byName {
+			f.Filename = name
+			atlas.frames = append(atlas.frames, f)
+		}
+		sort.Slice(atlas.frames, func(i, j int) bool { return atlas.frames[i].Filename < atlas.frames[j].Filename })
+	}
+	if len(atlas.frames) == 0 {
+		return nil, fmt.Errorf("%w: atlas %s has no frames", ErrEmptyData, filename)
+	}
+	for _, f := range atlas.frames {
+		if f.Filename == "" || f.Frame.W < 1 || f.Frame.H < 1 || f.Frame.X < 0 || f.Frame.Y < 0 {
+			return nil, fmt.Errorf("atlas %s has a frame without a name or a valid rectangle", filename)
+		}
+	}
+	return atlas, nil
+}
+
+// cut returns a frame's sprite from the sheet, turned back if the packer rotated it.
+func (f tpFrame) cut(sheet *indexedImage) (*indexedImage, error) {
+	// A rotated frame gives its size as drawn, but lies on the sheet turned on its side.
+	w, h := f.Frame.W, f.Frame.H
+	if f.Rotated {
+		w, h = h, w
+	}
+	if f.Frame.X+w > sheet.width || f.Frame.Y+h > sheet.height {
+		return nil, fmt.Errorf("frame %q lies outside the %dx%d sheet", f.Filename, sheet.width, sheet.height)
+	}
+	m := cropIndexed(sheet, f.Frame.X, f.Frame.Y, w, h)
+	if f.Rotated {
+		// Three clockwise quarter turns undo the packer's one.
+		m = rotateIndexed(rotateIndexed(rotateIndexed(m)))
+	}
+	return m, nil
+}
+
+// name returns the frame's name as a file name: folders in it become part of the name.
+func (f tpFrame) name() string {
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(f.Filename)
+}
+
+// header returns the trim fields of a frame, for hex headers; none when it was not trimmed.
+func (f tpFrame) header() []string {
+	if !f.Trimmed {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("trim: %d,%d", f.SpriteSourceSize.X, f.SpriteSourceSize.Y),
+		fmt.Sprintf("source-size: %dx%d", f.SourceSize.W, f.SourceSize.H),
+	}
+}
+
+// texturePackerJSON describes a packed atlas in the TexturePacker hash layout, for the sheet image
+// of the given name. zxtex packs sprites whole and upright, so no frame is trimmed or rotated.
+func texturePackerJSON(manifest atlasManifest, image string) ([]byte, error) {
+	frames := map[string]tpFrame{}
+	for _, e := range manifest.Sprites {
+		frames[e.Name] = tpFrame{
+			Frame:            tpRect{e.X, e.Y, e.Width, e.Height},
+			SpriteSourceSize: tpRect{0, 0, e.Width, e.Height},
+			SourceSize:       tpSize{e.Width, e.Height},
+		}
+	}
+	doc := struct {
+		Frames map[string]tpFrame `json:"frames"`
+		Meta   tpMeta             `json:"meta"`
+	}{frames, tpMeta{App: "zxtex", Version: "1.0", Image: image, Format: "RGBA8888", Size: tpSize{manifest.Width, manifest.Height}, Scale: "1"}}
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// TGA images: Truevision Targa files are still written by sprite tools and game engines. An
+// 18-byte header gives the image type, size and pixel depth, and is followed by an optional image
+// ID, an optional colour map and the pixels, stored as they are or run-length encoded, bottom row
+// first unless the header says otherwise. zxtex reads colour-mapped, true-colour and greyscale
+// images of both kinds, with 15-, 16-, 24- and 32-bit colours. An alpha channel is kept when the
+// header declares one, unless it is zero for every pixel, in which case it is unused and the image
+// is opaque, as with BMPs.
+
+// tgaHeaderSize is the size of the TGA file header.
+const tgaHeaderSize = 18
+
+// tgaFooter ends TGA 2.0 files.
+var tgaFooter = []byte("TRUEVISION-XFILE.\x00")
+
+// tgaHeader holds the fields of a TGA header.
+type tgaHeader struct {
+	imageType     int
+	rle           bool
+	mapFirst      int // Index of the first colour map entry.
+	mapLength     int
+	mapDepth      int
+	width, height int
+	depth         int
+	alphaBits     int
+	rightToLeft   bool
+	topDown       bool
+	pixels        int // Offset of the pixel data.
+}
+
+// parseTGAHeader reads and checks a TGA header. TGA has no signature, so every field is checked
+// for a value a Targa file could hold.
+func parseTGAHeader(data []byte) (*tgaHeader, error) {
+	bad := fmt.Errorf("%w: not a TGA file", ErrUnsupportedFormat)
+	if len(data) < tgaHeaderSize {
+		return nil, bad
+	}
+	le := binary.LittleEndian
+	h := &tgaHeader{
+		imageType:   int(data[2]) &^ 8,
+		rle:         data[2]&8 != 0,
+		mapFirst:    int(le.Uint16(data[3:])),
+		mapLength:   int(le.Uint16(data[5:])),
+		mapDepth:    int(data[7]),
+		width:       int(le.Uint16(data[12:])),
+		height:      int(le.Uint16(data[14:])),
+		depth:       int(data[16]),
+		alphaBits:   int(data[17] & 0x0f),
+		rightToLeft: data[17]&0x10 != 0,
+		topDown:     data[17]&0x20 != 0,
+	}
+	hasMap := data[1]
+	if hasMap > 1 || h.imageType < 1 || h.imageType > 3 || data[2]&^0x0b != 0 || h.width == 0 || h.height == 0 || data[17]&0xc0 != 0 {
+		return nil, bad
+	}
+	switch {
+	case h.imageType == 1 && (hasMap != 1 || h.depth != 8 && h.depth != 16):
+		return nil, bad
+	case h.imageType == 2 && h.depth != 15 && h.depth != 16 && h.depth != 24 && h.depth != 32:
+		return nil, bad
+	case h.imageType == 3 && h.depth != 8:
+		return nil, bad
+	}
+	mapSize := 0
+	if hasMap == 1 {
+		switch h.mapDepth {
+		case 15, 16, 24, 32:
+		default:
+			return nil, bad
+		}
+		mapSize = h.mapLength * ((h.mapDepth + 7) / 8)
+	}
+	if err := checkImageSize("TGA", h.width, h.height); err != nil {
+		return nil, err
+	}
+	h.pixels = tgaHeaderSize + int(data[0]) + mapSize
+	if h.pixels > len(data) || !h.rle && h.pixels+h.width*h.height*((h.depth+7)/8) > len(data) {
+		return nil, bad
+	}
+	return h, nil
+}
+
+// isTGA reports whether data is a TGA image: a file with the TGA 2.0 footer, or one whose header
+// checks out and whose pixels decode.
+func isTGA(data []byte) bool {
+	if _, err := parseTGAHeader(data); err != nil {
+		return false
+	}
+	if bytes.HasSuffix(data, tgaFooter) {
+		return true
+	}
+	_, err := decodeTGA(data)
+	return err == nil
+}
+
+// tgaColour decodes a colour of the given depth, stored little-endian in BGR(A) order.
+func tgaColour(p []byte, depth int) [4]uint8 {
+	switch depth {
+	case 15, 16:
+		v := binary.LittleEndian.Uint16(p)
+		r, g, b := uint8(v>>10&31), uint8(v>>5&31), uint8(v&31)
+		a := uint8(0)
+		if v&0x8000 != 0 {
+			a = 0xff
+		}
+		return [4]uint8{r<<3 | r>>2, g<<3 | g>>2, b<<3 | b>>2, a}
+	case 24:
+		return [4]uint8{p[2], p[1], p[0], 0}
+	}
+	return [4]uint8{p[2], p[1], p[0], p[3]}
+}
+
+// decodeTGA decodes a TGA image.
+func decodeTGA(data []byte) (image.Image, error) {
+	h, err := parseTGAHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	size := (h.depth + 7) / 8
+	n := h.width * h.height
+	// Unpack the pixels first, whether stored as they are or in run-length packets.
+	pixels := data[h.pixels:]
+	if h.rle {
+		// A packet of one pixel and its count byte expands to 128 pixels at most, so an image larger
+		// than the data allows is truncated, and is rejected before anything is allocated.
+		if n > (len(data)-h.pixels+size)/(1+size)*128 {
+			return nil, fmt.Errorf("%w: truncated TGA image data", ErrUnsupportedFormat)
+		}
+		var unpacked []byte
+		for i := h.pixels; len(unpacked) < n*size; {
+			if i >= len(data) {
+				return nil, fmt.Errorf("%w: truncated TGA image data", ErrUnsupportedFormat)
+			}
+			packet := data[i]
+			count := int(packet&0x7f) + 1
+			i++
+			if packet&0x80 != 0 {
+				if i+size > len(data) {
+					return nil, fmt.Errorf("%w: truncated TGA image data", ErrUnsupportedFormat)
+				}
+				for k := 0; k < count; k++ {
+					unpacked = append(unpacked, data[i:i+size]...)
+				}
+				i += size
+			} else {
+				if i+count*size > len(data) {
+					return nil, fmt.Errorf("%w: truncated TGA image data", ErrUnsupportedFormat)
+				}
+				unpacked = append(unpacked, data[i:i+count*size]...)
+				i += count * size
+			}
+		}
+		pixels = unpacked[:n*size]
+	}
+
+	var palette [][4]uint8
+	if h.imageType == 1 {
+		entry := (h.mapDepth + 7) / 8
+		start := h.pixels - h.mapLength*entry
+		for i := 0; i < h.mapLength; i++ {
+			palette = append(palette, tgaColour(data[start+i*entry:], h.mapDepth))
+		}
+	}
+	alphaDepth := h.depth
+	if h.imageType == 1 {
+		alphaDepth = h.mapDepth
+	}
+	// Only 32-bit colours with alpha bits, or 16-bit ones with an attribute bit, carry alpha.
+	useAlpha := h.alphaBits > 0 && (alphaDepth == 32 || alphaDepth == 16)
+
+	img := image.NewNRGBA(image.Rect(0, 0, h.width, h.height))
+	hasAlpha := false
+	for i := 0; i < n; i++ {
+		x, y := i%h.width, i/h.width
+		if h.rightToLeft {
+			x = h.width - 1 - x
+		}
+		if !h.topDown {
+			y = h.height - 1 - y
+		}
+		p := pixels[i*size:]
+		var c [4]uint8
+		switch h.imageType {
+		case 1:
+			idx := int(p[0])
+			if size == 2 {
+				idx = int(binary.LittleEndian.Uint16(p))
+			}
+			if idx -= h.mapFirst; idx >= 0 && idx < len(palette) {
+				c = palette[idx]
+			}
+		case 2:
+			c = tgaColour(p, h.depth)
+		case 3:
+			c = [4]uint8{p[0], p[0], p[0], 0}
+		}
+		if !useAlpha {
+			c[3] = 0xff
+		}
+		hasAlpha = hasAlpha || c[3] != 0
+		copy(img.Pix[y*img.Stride+4*x:], c[:])
+	}
+	if !hasAlpha {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xff
+		}
+	}
+	return img, nil
+}
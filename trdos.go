@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// TR-DOS outputs for the Beta Disk interface and Pentagon clones: Hobeta files (a single disk file
+// with a 17-byte header, as used by emulators and file managers) and direct insertion into .trd
+// disk images.
+
+// Settings for TR-DOS outputs.
+var (
+	hobetaOutput bool   // Wrap binary outputs in a Hobeta header.
+	trdImage     string // Add binary outputs to this .trd disk image instead of writing files.
+)
+
+const (
+	trdSectorSize  = 256
+	trdSectors     = 16                                     // Sectors per logical track.
+	trdTracks      = 160                                    // 80 cylinders, two sides.
+	trdImageSize   = trdTracks * trdSectors * trdSectorSize // 640K.
+	trdMaxFiles    = 128
+	trdInfo        = 8 * trdSectorSize // Disk information sector, after the eight catalogue sectors.
+	trdosID        = 0x10
+	trdDiskDS80    = 0x16 // Disk type: 80 tracks, double sided.
+	hobetaHeader   = 17
+	trdosMaxLength = 0xFF * trdSectorSize
+)
+
+// checkTRDOSSettings rejects combinations of container settings that cannot be honoured together.
+func checkTRDOSSettings() error {
+	if hobetaOutput && plus3Header {
+		return fmt.Errorf("--hobeta and --plus3dos cannot be used together")
+	}
+	if trdImage != "" && (hobetaOutput || plus3Header) {
+		return fmt.Errorf("--trd stores plain files; it cannot be combined with --hobeta or --plus3dos")
+	}
+	return nil
+}
+
+// trdosName converts a filename into an 8-character, space-padded TR-DOS name.
+func trdosName(filename string) []byte {
+	base := filepath.Base(filename)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	name := []byte("        ")
+	for i := 0; i < len(base) && i < len(name); i++ {
+		if c := base[i]; c >= 0x20 && c < 0x7F {
+			name[i] = c
+		} else {
+			name[i] = '_'
+		}
+	}
+	return name
+}
+
+// trdosSectorCount returns the number of sectors a file of the given length occupies.
+func trdosSectorCount(length int) int {
+	return (length + trdSectorSize - 1) / trdSectorSize
+}
+
+// hobetaFile wraps data as a Hobeta CODE file named after filename, loading at addr. The data is
+// padded to whole sectors, as it would be on disk.
+func hobetaFile(data []byte, filename string, addr int) ([]byte, error) {
+	if len(data) > trdosMaxLength {
+		return nil, fmt.Errorf("%d bytes is too long for a TR-DOS file", len(data))
+	}
+	sectors := trdosSectorCount(len(data))
+	out := make([]byte, hobetaHeader+sectors*trdSectorSize)
+	copy(out, trdosName(filename))
+	out[8] = 'C'
+	binary.LittleEndian.PutUint16(out[9:], uint16(addr))
+	binary.LittleEndian.PutUint16(out[11:], uint16(len(data)))
+	out[13] = 0
+	out[14] = byte(sectors)
+	var sum int
+	for i := 0; i < 15; i++ {
+		sum += 257*int(out[i]) + i
+	}
+	binary.LittleEndian.PutUint16(out[15:], uint16(sum))
+	copy(out[hobetaHeader:], data)
+	return out, nil
+}
+
+// newTRDImage returns a freshly formatted, empty 640K disk image with the given label.
+func newTRDImage(label string) []byte {
+	disk := make([]byte, trdImageSize)
+	info := disk[trdInfo:]
+	info[0xE1] = 0 // First free sector.
+	info[0xE2] = 1 // First free track: track 0 holds the catalogue.
+	info[0xE3] = trdDiskDS80
+	info[0xE4] = 0 // Files.
+	binary.LittleEndian.PutUint16(info[0xE5:], uint16((trdTracks-1)*trdSectors))
+	info[0xE7] = trdosID
+	for i := 0xEA; i <= 0xF2; i++ {
+		info[i] = ' '
+	}
+	info[0xF4] = 0 // Deleted files.
+	copy(info[0xF5:0xFD], trdosName(label))
+	return disk
+}
+
+// trdInsert stores data as a CODE file in a disk image, after the files already on it.
+func trdInsert(disk []byte, filename string, data []byte, addr int) error {
+	if len(disk) < trdInfo+trdSectorSize || disk[trdInfo+0xE7] != trdosID {
+		return fmt.Errorf("%w: not a TR-DOS disk image", ErrUnsupportedFormat)
+	}
+	if len(data) > trdosMaxLength {
+		return fmt.Errorf("%d bytes is too long for a TR-DOS file", len(data))
+	}
+	info := disk[trdInfo:]
+	files := int(info[0xE4])
+	if files >= trdMaxFiles {
+		return fmt.Errorf("disk catalogue is full")
+	}
+	name := trdosName(filename)
+	for i := 0; i < files; i++ {
+		entry := disk[i*16 : i*16+16]
+		if entry[0] != 0x01 && string(entry[:8]) == string(name) && entry[8] == 'C' {
+			return fmt.Errorf("%s.C is already on the disk", strings.TrimRight(string(name), " "))
+		}
+	}
+	sectors := trdosSectorCount(len(data))
+	free := int(binary.LittleEndian.Uint16(info[0xE5:]))
+	sector, track := int(info[0xE1]), int(info[0xE2])
+	start := (track*trdSectors + sector) * trdSectorSize
+	if sectors > free || start+sectors*trdSectorSize > len(disk) {
+		return fmt.Errorf("not enough free space on the disk (%d sectors needed, %d free)", sectors, free)
+	}
+	copy(disk[start:], data)
+
+	entry := disk[files*16 : files*16+16]
+	copy(entry, name)
+	entry[8] = 'C'
+	binary.LittleEndian.PutUint16(entry[9:], uint16(addr))
+	binary.LittleEndian.PutUint16(entry[11:], uint16(len(data)))
+	entry[13] = byte(sectors)
+	entry[14] = byte(sector)
+	entry[15] = byte(track)
+
+	next := track*trdSectors + sector + sectors
+	info[0xE1] = byte(next % trdSectors)
+	info[0xE2] = byte(next / trdSectors)
+	info[0xE4] = byte(files + 1)
+	binary.LittleEndian.PutUint16(info[0xE5:], uint16(free-sectors))
+	return nil
+}
+
+// addToTRD adds data to a disk image file as a CODE file named after filename, creating a new
+// formatted image when the file does not exist yet.
+func addToTRD(diskFile, filename string, data []byte, addr int) error {
+	var disk []byte
+	if fileExists(diskFile) {
+		var err error
+		if disk, err = ioutil.ReadFile(diskFile); err != nil {
+			return err
+		}
+	} else {
+		disk = newTRDImage(diskFile)
+	}
+	if err := trdInsert(disk, filename, data, addr); err != nil {
+		return fmt.Errorf("%s: %w", diskFile, err)
+	}
+	return writeFileAtomic(diskFile, disk)
+}
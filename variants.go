@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Orientation variants: sprite engines without runtime rotation need every orientation of a
+// sprite pre-baked. A variant set is written either as one file per variant, with a suffix naming
+// its orientation, or as a single strip of frames, left to right.
+
+// Variant settings.
+var (
+	variantSet    string    // Variants to write: "4dir", "8dir" or "mirror"; empty to disable.
+	variantLayout = "files" // "files" for one output per variant, "strip" for a single strip.
+)
+
+// checkVariantSettings validates the variant settings.
+func checkVariantSettings() error {
+	switch variantSet {
+	case "", "4dir", "8dir", "mirror":
+	default:
+		return fmt.Errorf("unknown variant set %q (expected 4dir, 8dir or mirror)", variantSet)
+	}
+	if variantLayout != "files" && variantLayout != "strip" {
+		return fmt.Errorf("unknown variant layout %q (expected files or strip)", variantLayout)
+	}
+	return nil
+}
+
+// rotateIndexed returns an image rotated a quarter turn clockwise.
+func rotateIndexed(m *indexedImage) *indexedImage {
+	out := newIndexedImage(m.height, m.width)
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			out.set(m.height-1-y, x, m.at(x, y))
+		}
+	}
+	return out
+}
+
+// mirrorIndexed returns an image mirrored left to right.
+func mirrorIndexed(m *indexedImage) *indexedImage {
+	out := newIndexedImage(m.width, m.height)
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			out.set(m.width-1-x, y, m.at(x, y))
+		}
+	}
+	return out
+}
+
+// variant is one orientation of a sprite.
+type variant struct {
+	suffix string // Filename suffix: _rN for a rotation of N degrees clockwise, _mN when mirrored first.
+	image  *indexedImage
+}
+
+// spriteVariants returns the orientations in a variant set: the four rotations for 4dir, the
+// original and its mirror image for mirror, and the rotations of both for 8dir.
+func spriteVariants(m *indexedImage) []variant {
+	rotations := func(m *indexedImage, prefix string) []variant {
+		var vs []variant
+		for angle := 0; angle < 360; angle += 90 {
+			vs = append(vs, variant{fmt.Sprintf("_%s%d", prefix, angle), m})
+			m = rotateIndexed(m)
+		}
+		return vs
+	}
+	switch variantSet {
+	case "mirror":
+		return []variant{{"_r0", m}, {"_m0", mirrorIndexed(m)}}
+	case "8dir":
+		return append(rotations(m, "r"), rotations(mirrorIndexed(m), "m")...)
+	}
+	return rotations(m, "r")
+}
+
+// variantStrip lays the variants of a sprite out side by side as frames of a single image.
+// Rotated frames are only the same size as the original when the sprite is square.
+func variantStrip(m *indexedImage) (*indexedImage, error) {
+	if variantSet != "mirror" && m.width != m.height {
+		return nil, fmt.Errorf("%w: rotated variants of a %dx%d sprite cannot share a strip; the sprite must be square", ErrWidthMismatch, m.width, m.height)
+	}
+	vs := spriteVariants(m)
+	out := newIndexedImage(m.width*len(vs), m.height)
+	for i, v := range vs {
+		for y := 0; y < m.height; y++ {
+			for x := 0; x < m.width; x++ {
+				out.set(i*m.width+x, y, v.image.at(x, y))
+			}
+		}
+	}
+	return out, nil
+}
+
+// writeVariants writes every variant of a sprite to its own file, named after output (or the
+// default output name) with the variant's suffix.
+func writeVariants(src *source, m *indexedImage, format, output, outDir string) error {
+	if output == stdoutName {
+		return fmt.Errorf("variants are written as separate files and cannot go to standard output; use --variant-layout strip")
+	}
+	if output == "" {
+		output = filepath.Join(outDir, defaultOutputName(src, formatExtensions[format]))
+	}
+	for _, v := range spriteVariants(m) {
+		if err := writeFormat(suffixedSource(src, v.suffix), v.image, format, withSuffix(output, v.suffix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image/color"
+)
+
+// Round-trip verification: with --verify, every hex, png, png-preview and scr file written is
+// read back and decoded the way zxtex decodes its inputs, and compared pixel for pixel with the
+// image it was encoded from. Any difference fails the conversion, so a regression in an encoder,
+// or artwork the screen format cannot hold (such as a cell with three colours), never goes
+// unnoticed.
+
+// verifyOutput enables round-trip verification of the files written.
+var verifyOutput bool
+
+// verifiedFormats are the output formats that can be decoded again.
+var verifiedFormats = map[string]bool{"hex": true, "png": true, "png-preview": true, "scr": true}
+
+// checkVerifySettings rejects --verify with options that write files zxtex cannot read back
+// as they are.
+func checkVerifySettings() error {
+	if !verifyOutput {
+		return nil
+	}
+	switch {
+	case outputToStdout:
+		return fmt.Errorf("--verify needs an output file; it cannot be used with --output -")
+	case crtPreview || palBleed > 0:
+		return fmt.Errorf("--verify cannot check png previews filtered with --crt or --pal-bleed")
+	case plus3Header || hobetaOutput || trdImage != "" || dskImage != "" || tapImage != "":
+		return fmt.Errorf("--verify cannot check outputs wrapped with --plus3dos, --hobeta, --trd, --dsk or --tap")
+	case splitBytes > 0 || alignBytes > 0:
+		return fmt.Errorf("--verify cannot check outputs written with --split-bytes or --align")
+	}
+	return nil
+}
+
+// sameColour reports whether two palette indices show the same colour; black, for one, is both
+// index 0 and its BRIGHT twin 8.
+func sameColour(a, b int) bool {
+	if a == b {
+		return true
+	}
+	if a == transparentIndex || b == transparentIndex {
+		return false
+	}
+	return ZXPalette[a] == ZXPalette[b]
+}
+
+// decodeOutput reads back a file written in one of the verified formats.
+func decodeOutput(format, output string, width int) (*indexedImage, error) {
+	data, err := readOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "scr":
+		return scrToIndexed(data)
+	case "png", "png-preview":
+		img, err := decodeImage(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		b := img.Bounds()
+		m := newIndexedImage(b.Dx(), b.Dy())
+		for y := 0; y < m.height; y++ {
+			for x := 0; x < m.width; x++ {
+				c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+				if c.A == 0 {
+					continue
+				}
+				r, g, bl, _ := c.RGBA()
+				idx := nearestColor(r, g, bl)
+				if ZXPalette[idx] != c {
+					return nil, fmt.Errorf("pixel (%d,%d) is #%02x%02x%02x, which is not in the palette", x, y, c.R, c.G, c.B)
+				}
+				m.set(x, y, idx)
+			}
+		}
+		return m, nil
+	}
+	if hasFrames(string(data)) {
+		anim, err := parseAnimation(context.Background(), string(data))
+		if err != nil {
+			return nil, err
+		}
+		return stackFrames(anim.frames), nil
+	}
+	hexData, fileWidth, _, err := parseHexText(context.Background(), string(data))
+	if err != nil {
+		return nil, err
+	}
+	if fileWidth > 0 && !bareOutput {
+		width = fileWidth
+	}
+	return hexToIndexed(context.Background(), hexData, width)
+}
+
+// verifyFile decodes a file just written and compares it with the image it was encoded from.
+// Pixels that were transparent in an scr output only need to show PAPER, which the screen has no
+// way to tell apart from them.
+func verifyFile(src *source, m *indexedImage, format, output string) error {
+	if !verifiedFormats[format] {
+		statusf("%s is not verified: only hex, png, png-preview and scr outputs can be read back\n", output)
+		return nil
+	}
+	if format == "hex" && src.anim != nil && !rawOutput {
+		m = stackFrames(src.anim.frames) // Animations are written frame by frame, not as m.
+	}
+	got, err := decodeOutput(format, output, m.width)
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", output, err)
+	}
+	if got.width != m.width || got.height != m.height {
+		return fmt.Errorf("verifying %s: decoded as %d×%d, expected %d×%d", output, got.width, got.height, m.width, m.height)
+	}
+	mismatches, firstX, firstY := 0, 0, 0
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			want := m.at(x, y)
+			if format == "scr" && want == transparentIndex {
+				continue
+			}
+			if !sameColour(want, got.at(x, y)) {
+				if mismatches == 0 {
+					firstX, firstY = x, y
+				}
+				mismatches++
+			}
+		}
+	}
+	if mismatches > 0 {
+		hint := ""
+		if format == "scr" {
+			hint = " (see --clash-report for cells with more than two colours)"
+		}
+		return fmt.Errorf("verifying %s: %d pixels differ from the encoded image, the first at (%d,%d)%s", output, mismatches, firstX, firstY, hint)
+	}
+	statusf("Verified %s\n", output)
+	return nil
+}
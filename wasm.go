@@ -0,0 +1,117 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"strings"
+	"syscall/js"
+)
+
+// WebAssembly build: instead of the command line, zxtex exposes a global "zxtex" object so
+// browser-based sprite editors can convert client-side:
+//
+//	zxtex.imageToHex(bytes, {name, raw, bare, chunky}) -> {hex} or {error}
+//	zxtex.hexToPNG(text, {width, chunky}) -> {png} or {error}
+//
+// bytes is a Uint8Array holding a PNG, GIF, BMP, PCX, IFF or TGA file; text is the contents of a
+// hex file, or a direct hex string on one line, with rows split by "/" and "0x" and raw size
+// prefixes read as on the command line; png is a Uint8Array.
+
+// jsOption reads a property of an optional options object, returning undefined when it is absent.
+func jsOption(args []js.Value, name string) js.Value {
+	if len(args) < 2 || args[1].Type() != js.TypeObject {
+		return js.Undefined()
+	}
+	return args[1].Get(name)
+}
+
+// jsError wraps an error message in a result object.
+func jsError(err error) js.Value {
+	return js.ValueOf(map[string]interface{}{"error": err.Error()})
+}
+
+// jsImageToHex converts image file bytes into hex text.
+func jsImageToHex(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 {
+		return jsError(ErrEmptyData)
+	}
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+	name := "image"
+	if v := jsOption(args, "name"); v.Type() == js.TypeString {
+		name = v.String()
+	}
+	// Images are decoded and quantized as on the command line.
+	img, err := decodeImageData(data, name)
+	if err != nil {
+		return jsError(err)
+	}
+	chunky := jsOption(args, "chunky").Truthy()
+	m, _, err := quantizeSource(context.Background(), img, chunky)
+	if err != nil {
+		return jsError(err)
+	}
+	if jsOption(args, "raw").Truthy() {
+		return js.ValueOf(map[string]interface{}{"hex": indexedToRawHex(m, jsOption(args, "bare").Truthy())})
+	}
+	var extra []string
+	if chunky {
+		extra = append(extra, "mode: chunky")
+	}
+	return js.ValueOf(map[string]interface{}{"hex": indexedToHex(m, name, extra...)})
+}
+
+// jsHexToPNG converts hex text into PNG file bytes.
+func jsHexToPNG(this js.Value, args []js.Value) interface{} {
+	if len(args) < 1 || args[0].Type() != js.TypeString {
+		return jsError(ErrEmptyData)
+	}
+	ctx := context.Background()
+	text := args[0].String()
+	width := 0
+	if v := jsOption(args, "width"); v.Type() == js.TypeNumber {
+		width = v.Int()
+	}
+	// A single line without a header is a direct hex string, as on the command line.
+	var hexData string
+	var meta map[string]string
+	var err error
+	if t := strings.TrimSpace(text); !strings.ContainsAny(t, "\n#") {
+		hexData, width, err = parseHexString(t, width)
+		meta = map[string]string{}
+	} else {
+		var fileWidth int
+		if hexData, fileWidth, meta, err = parseHexText(ctx, text); width == 0 {
+			width = fileWidth
+		}
+	}
+	if err != nil {
+		return jsError(err)
+	}
+	m, err := hexToIndexed(ctx, hexData, width)
+	if err != nil {
+		return jsError(err)
+	}
+	if jsOption(args, "chunky").Truthy() || strings.EqualFold(meta["mode"], "chunky") {
+		m = chunkyToScreen(m)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, renderIndexed(m)); err != nil {
+		return jsError(err)
+	}
+	out := js.Global().Get("Uint8Array").New(buf.Len())
+	js.CopyBytesToJS(out, buf.Bytes())
+	return js.ValueOf(map[string]interface{}{"png": out})
+}
+
+func main() {
+	js.Global().Set("zxtex", js.ValueOf(map[string]interface{}{
+		"imageToHex": js.FuncOf(jsImageToHex),
+		"hexToPNG":   js.FuncOf(jsHexToPNG),
+	}))
+	// Keep the Go runtime alive so the functions stay callable.
+	select {}
+}
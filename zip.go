@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Zip archives: a .zip among the inputs is converted as a batch of the images and hex files it
+// holds, read straight from the archive, and with --zip every output file goes into one archive
+// instead of the filesystem. Both suit web workflows, and keep conversions of thousands of
+// sprites to a single file at either end.
+
+// archiveMember is a file read from a zip archive given as input.
+type archiveMember struct {
+	archive string
+	data    []byte
+}
+
+// archiveMembers holds the members of input archives, named as paths inside their archive, such
+// as sprites.zip/walk/01.png.
+var archiveMembers = map[string]archiveMember{}
+
+// isZip reports whether the path names a .zip file.
+func isZip(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".zip") && fileExists(path) && !isDir(path)
+}
+
+// inputExists reports whether an input names a file or an archive member, rather than being a
+// direct hex string.
+func inputExists(input string) bool {
+	_, ok := archiveMembers[input]
+	return ok || fileExists(input)
+}
+
+// readArchive loads the convertible members of a zip archive, returning their names in order.
+func readArchive(filename string) ([]string, error) {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filename, err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !batchExtensions[strings.ToLower(path.Ext(f.Name))] {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s: %w", filename, f.Name, err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %s: %w", filename, f.Name, err)
+		}
+		name := filepath.Join(filename, filepath.FromSlash(f.Name))
+		archiveMembers[name] = archiveMember{archive: filename, data: data}
+		names = append(names, name)
+	}
+	// Archives list their members in the order they were added; sort them, as directories are.
+	sort.Strings(names)
+	return names, nil
+}
+
+// zipOutput is the archive every output file is written into; empty to write files.
+var zipOutput string
+
+// zipEpoch is the date of the members of output archives: the first day of the MS-DOS calendar
+// zip timestamps use.
+var zipEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// zipEntry is a file written into the output archive.
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+// zipEntries are the files written into the output archive so far, in the order written.
+var zipEntries []zipEntry
+
+// checkZipSettings rejects --zip with options that need the outputs as files.
+func checkZipSettings() error {
+	if zipOutput == "" {
+		return nil
+	}
+	switch {
+	case outputToStdout:
+		return fmt.Errorf("--zip cannot be combined with --output -")
+	case trdImage != "" || dskImage != "" || tapImage != "":
+		return fmt.Errorf("--zip cannot be combined with --trd, --dsk or --tap, which write their own images")
+	case postHook != "" || depsFile != "":
+		return fmt.Errorf("--zip cannot be combined with --post-hook or --deps, which need files")
+	case duplicateMode == "link":
+		return fmt.Errorf("--zip cannot be combined with --duplicates link; use --duplicates report")
+	}
+	return nil
+}
+
+// zipName turns an output filename into an archive member name: a relative, slash-separated
+// path, or the base name for files outside the current directory.
+func zipName(filename string) string {
+	name := filepath.ToSlash(filepath.Clean(filename))
+	if filepath.IsAbs(filename) || name == ".." || strings.HasPrefix(name, "../") {
+		return filepath.Base(filename)
+	}
+	return name
+}
+
+// addToZip stores an output file in the archive, replacing a file of the same name.
+func addToZip(filename string, data []byte) {
+	name := zipName(filename)
+	for i := range zipEntries {
+		if zipEntries[i].name == name {
+			zipEntries[i].data = data
+			return
+		}
+	}
+	zipEntries = append(zipEntries, zipEntry{name: name, data: data})
+}
+
+// readOutput reads back an output file, from the archive when writing one.
+func readOutput(filename string) ([]byte, error) {
+	if zipOutput != "" {
+		name := zipName(filename)
+		for _, e := range zipEntries {
+			if e.name == name {
+				return e.data, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+	}
+	return os.ReadFile(filename)
+}
+
+// writeZip writes the output archive. Every member is dated at the earliest time zip can record,
+// so the archive is the same on every run.
+func writeZip() error {
+	if zipOutput == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range zipEntries {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: zipEpoch})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(e.data); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := checkClobber(zipOutput); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(zipOutput, buf.Bytes()); err != nil {
+		return fmt.Errorf("writing archive: %w", err)
+	}
+	noun := "files"
+	if len(zipEntries) == 1 {
+		noun = "file"
+	}
+	statusf("Archive of %d %s written to %s\n", len(zipEntries), noun, zipOutput)
+	return nil
+}
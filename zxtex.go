@@ -2,15 +2,17 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
-	"flag"
 	"fmt"
+	_ "golang.org/x/image/bmp" // register BMP format
 	"image"
 	"image/color"
 	"image/draw"
+	_ "image/gif" // register GIF format
 	"image/png"
-	_ "golang.org/x/image/bmp" // register BMP format
-	_ "image/gif"              // register GIF format
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
@@ -42,7 +44,7 @@ var ZXPalette = []color.RGBA{
 
 // Global flags for transparency override.
 var transpColorStr string
-var transpIndex int
+var transpIndex = -1
 
 // parseWebColor parses a web-format color string (e.g. "#aabbcc") and returns a color.RGBA.
 func parseWebColor(s string) (color.RGBA, error) {
@@ -67,16 +69,25 @@ func parseWebColor(s string) (color.RGBA, error) {
 }
 
 // nearestColor returns the index of the nearest ZX Spectrum palette color for the given color.
+// Distances are computed with integers so results are identical on every platform.
 func nearestColor(r, g, b uint32) int {
+	return nearestAllowed(r, g, b, allColours)
+}
+
+// nearestAllowed is nearestColor limited to the palette indices in allowed.
+func nearestAllowed(r, g, b uint32, allowed uint16) int {
 	bestIndex := 0
-	bestDist := math.MaxFloat64
-	cr := float64(r >> 8)
-	cg := float64(g >> 8)
-	cb := float64(b >> 8)
+	bestDist := math.MaxInt
+	cr := int(r >> 8)
+	cg := int(g >> 8)
+	cb := int(b >> 8)
 	for i, pal := range ZXPalette {
-		dr := cr - float64(pal.R)
-		dg := cg - float64(pal.G)
-		db := cb - float64(pal.B)
+		if !allows(allowed, i) {
+			continue
+		}
+		dr := cr - int(pal.R)
+		dg := cg - int(pal.G)
+		db := cb - int(pal.B)
 		dist := dr*dr + dg*dg + db*db
 		if dist < bestDist {
 			bestDist = dist
@@ -86,6 +97,14 @@ func nearestColor(r, g, b uint32) int {
 	return bestIndex
 }
 
+// colourDistance returns the squared RGB distance between two colours.
+func colourDistance(a, b color.RGBA) int {
+	dr := int(a.R) - int(b.R)
+	dg := int(a.G) - int(b.G)
+	db := int(a.B) - int(b.B)
+	return dr*dr + dg*dg + db*db
+}
+
 // shouldBeTransparent returns true if the pixel should be treated as transparent.
 // It checks if alpha is 0 or if it matches the user-specified transparent color or palette index.
 func shouldBeTransparent(r, g, b, a uint32) bool {
@@ -119,81 +138,259 @@ func shouldBeTransparent(r, g, b, a uint32) bool {
 	return false
 }
 
-// imageToHex converts an image file into a hex string with header metadata and one line per row.
-func imageToHex(filename string) (string, error) {
-	f, err := os.Open(filename)
+// transparentIndex marks a transparent pixel in an indexed image.
+const transparentIndex = -1
+
+// indexedImage holds one palette index per pixel, or transparentIndex for transparent pixels.
+type indexedImage struct {
+	width, height int
+	pix           []int
+}
+
+// newIndexedImage returns a fully transparent indexed image of the given size.
+func newIndexedImage(width, height int) *indexedImage {
+	m := &indexedImage{width: width, height: height, pix: make([]int, width*height)}
+	for i := range m.pix {
+		m.pix[i] = transparentIndex
+	}
+	return m
+}
+
+func (m *indexedImage) at(x, y int) int {
+	return m.pix[y*m.width+x]
+}
+
+func (m *indexedImage) set(x, y, idx int) {
+	m.pix[y*m.width+x] = idx
+}
+
+// decodeImage decodes a PNG, GIF, BMP, PCX, IFF or TGA image, rejecting other formats. A GIF gives its
+// first frame composed on the logical screen, and a 32-bit BMP keeps its alpha channel.
+func decodeImage(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		return decodeGIF(data)
+	}
+	if isAlphaBMP(data) {
+		return decodeAlphaBMP(data)
+	}
+	if isPCX(data) {
+		return decodePCX(data)
+	}
+	if isIFF(data) {
+		return decodeIFF(data)
+	}
+	// No other supported format has a header TGA's checks accept.
+	if _, err := parseTGAHeader(data); err == nil {
+		return decodeTGA(data)
+	}
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
 	}
-	defer f.Close()
-	img, format, err := image.Decode(f)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if format != "png" && format != "gif" && format != "bmp" {
-		return "", fmt.Errorf("unsupported image format: %s (only PNG, GIF, and BMP are supported)", format)
+		return nil, fmt.Errorf("%w: %s image (only PNG, GIF, BMP, PCX, IFF and TGA are supported)", ErrUnsupportedFormat, format)
 	}
+	return img, nil
+}
+
+// maxImagePixels bounds the images zxtex decodes itself, so that a corrupt header cannot make it
+// allocate gigabytes before any pixel data is read. It allows 8192×4096, far beyond any sprite
+// sheet.
+const maxImagePixels = 1 << 25
+
+// checkImageSize rejects image dimensions from a file header that are not positive or exceed
+// maxImagePixels, without overflowing.
+func checkImageSize(format string, width, height int) error {
+	if width <= 0 || height <= 0 || width > maxImagePixels/height {
+		return fmt.Errorf("%w: %s image of %dx%d pixels", ErrUnsupportedFormat, format, width, height)
+	}
+	return nil
+}
+
+// decodeImageFile opens and decodes an image file, rejecting formats other than PNG, GIF, BMP,
+// PCX, IFF and TGA.
+func decodeImageFile(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeImage(f)
+}
+
+// quantizeImage maps every pixel of an image to its nearest palette index, honouring the transparency
+// settings and colour constraints.
+// It stops early, returning the context's error, if ctx is cancelled.
+func quantizeImage(ctx context.Context, img image.Image) (*indexedImage, error) {
 	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
 	rgba := image.NewRGBA(bounds)
 	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	if err := checkConstraintSize(bounds.Dx(), bounds.Dy()); err != nil {
+		return nil, err
+	}
+	m := newIndexedImage(bounds.Dx(), bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := rgba.At(x, y).RGBA()
+			if !shouldBeTransparent(r, g, b, a) {
+				m.set(x-bounds.Min.X, y-bounds.Min.Y, nearestAllowed(r, g, b, allowedAt(x-bounds.Min.X, y-bounds.Min.Y)))
+			}
+		}
+	}
+	return m, nil
+}
+
+// hexDigit returns the hex format character for a palette index.
+func hexDigit(idx int) string {
+	if idx == transparentIndex {
+		return "."
+	}
+	if lowercaseHex {
+		return strconv.FormatInt(int64(idx), 16)
+	}
+	return strings.ToUpper(strconv.FormatInt(int64(idx), 16))
+}
+
+// Hex output layout settings.
+var (
+	annotateHex  bool // Add a column ruler and row numbers, as comments.
+	hexGroup     int  // Insert a space every hexGroup digits of each row; 0 for none.
+	lowercaseHex bool // Write hex digits in lowercase.
+)
+
+// groupDigits inserts a space after every n characters of a row, when n is positive.
+func groupDigits(row string, n int) string {
+	if n <= 0 || len(row) <= n {
+		return row
+	}
+	var sb strings.Builder
+	for i := 0; i < len(row); i += n {
+		if i > 0 {
+			sb.WriteRune(' ')
+		}
+		end := i + n
+		if end > len(row) {
+			end = len(row)
+		}
+		sb.WriteString(row[i:end])
+	}
+	return sb.String()
+}
+
+// hexRuler returns comment lines numbering the columns of a hex row indented by two spaces:
+// a line of tens (when the row is wider than ten pixels) and a line of units, grouped like the rows.
+func hexRuler(width int) []string {
+	var tens, units strings.Builder
+	for x := 0; x < width; x++ {
+		if x%10 == 0 && x > 0 {
+			tens.WriteString(strconv.Itoa(x / 10 % 10))
+		} else {
+			tens.WriteRune(' ')
+		}
+		units.WriteString(strconv.Itoa(x % 10))
+	}
+	var lines []string
+	if width > 10 {
+		lines = append(lines, strings.TrimRight("# "+groupDigits(tens.String(), hexGroup), " "))
+	}
+	return append(lines, "# "+groupDigits(units.String(), hexGroup))
+}
+
+// indexedToHex formats an indexed image as header metadata followed by one line per row.
+// Extra header lines (without the leading "# ") are written after the dimensions. When
+// annotating, a column ruler follows the header and every row is indented to line up with it
+// and ends with a "# row NN" comment; the parser ignores both.
+func indexedToHex(m *indexedImage, filename string, extra ...string) string {
+	return hexHeader(m, filename, extra...) + hexRows(m)
+}
 
+// hexHeader formats the header metadata of a hex file, followed by the column ruler when
+// annotating.
+func hexHeader(m *indexedImage, filename string, extra ...string) string {
 	var sb strings.Builder
-	// Header metadata.
 	sb.WriteString(fmt.Sprintf("# file: %s\n", filename))
-	sb.WriteString(fmt.Sprintf("# width: %d\n", width))
-	sb.WriteString(fmt.Sprintf("# height: %d\n", height))
+	sb.WriteString(fmt.Sprintf("# width: %d\n", m.width))
+	sb.WriteString(fmt.Sprintf("# height: %d\n", m.height))
+	for _, line := range extra {
+		sb.WriteString("# " + line + "\n")
+	}
 	sb.WriteString("# generator: zxtex\n")
-	// One line per row.
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+	if annotateHex {
+		for _, line := range hexRuler(m.width) {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// hexRows formats an indexed image as one line of hex digits per row.
+func hexRows(m *indexedImage) string {
+	var sb strings.Builder
+	rowDigits := len(strconv.Itoa(m.height - 1))
+	for y := 0; y < m.height; y++ {
 		var rowBuilder strings.Builder
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := rgba.At(x, y).RGBA()
-			if shouldBeTransparent(r, g, b, a) {
-				rowBuilder.WriteRune('.')
-			} else {
-				idx := nearestColor(r, g, b)
-				rowBuilder.WriteString(strings.ToUpper(strconv.FormatInt(int64(idx), 16)))
-			}
+		for x := 0; x < m.width; x++ {
+			rowBuilder.WriteString(hexDigit(m.at(x, y)))
+		}
+		row := groupDigits(rowBuilder.String(), hexGroup)
+		if annotateHex {
+			sb.WriteString("  " + row + fmt.Sprintf("  # row %0*d", rowDigits, y))
+		} else {
+			sb.WriteString(row)
 		}
-		sb.WriteString(rowBuilder.String())
 		sb.WriteRune('\n')
 	}
-	return sb.String(), nil
+	return sb.String()
 }
 
-// imageToRawHex converts an image file into a single continuous hex string (no header, no newlines).
-func imageToRawHex(filename string) (string, error) {
-	f, err := os.Open(filename)
+// indexedToRawHex formats an indexed image as a single continuous hex string (no header, no newlines),
+// prefixed with its size as in "16x8:" unless bare is set.
+func indexedToRawHex(m *indexedImage, bare bool) string {
+	var sb strings.Builder
+	if !bare {
+		sb.WriteString(fmt.Sprintf("%dx%d:", m.width, m.height))
+	}
+	for _, idx := range m.pix {
+		sb.WriteString(hexDigit(idx))
+	}
+	sb.WriteRune('\n') // Append a newline at the end.
+	return sb.String()
+}
+
+// imageToHex converts an image file into a hex string with header metadata and one line per row.
+func imageToHex(ctx context.Context, filename string) (string, error) {
+	img, err := decodeImageFile(filename)
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
-	img, format, err := image.Decode(f)
+	m, err := quantizeImage(ctx, img)
 	if err != nil {
 		return "", err
 	}
-	if format != "png" && format != "gif" && format != "bmp" {
-		return "", fmt.Errorf("unsupported image format: %s (only PNG, GIF, and BMP are supported)", format)
+	return indexedToHex(m, filename), nil
+}
+
+// imageToRawHex converts an image file into a single continuous hex string (no header, no newlines).
+func imageToRawHex(ctx context.Context, filename string) (string, error) {
+	img, err := decodeImageFile(filename)
+	if err != nil {
+		return "", err
 	}
-	bounds := img.Bounds()
-	rgba := image.NewRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
-	var sb strings.Builder
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, a := rgba.At(x, y).RGBA()
-			if shouldBeTransparent(r, g, b, a) {
-				sb.WriteRune('.')
-			} else {
-				idx := nearestColor(r, g, b)
-				sb.WriteString(strings.ToUpper(strconv.FormatInt(int64(idx), 16)))
-			}
-		}
+	m, err := quantizeImage(ctx, img)
+	if err != nil {
+		return "", err
 	}
-	sb.WriteRune('\n') // Append a newline at the end.
-	return sb.String(), nil
+	return indexedToRawHex(m, bareOutput), nil
 }
 
 // filterHexLine removes spaces and tabs from a line, but keeps the dot.
@@ -217,28 +414,78 @@ func filterHexString(input string) string {
 	return sb.String()
 }
 
+// parseRawPrefix splits the "WxH:" size prefix of raw hex output from the digits after it.
+func parseRawPrefix(s string) (w, h int, rest string, ok bool) {
+	size, rest, found := strings.Cut(s, ":")
+	if !found || strings.ContainsAny(size, "+- ") {
+		return 0, 0, s, false
+	}
+	ws, hs, found := strings.Cut(size, "x")
+	w, werr := strconv.Atoi(ws)
+	h, herr := strconv.Atoi(hs)
+	if !found || werr != nil || herr != nil || w < 1 || h < 1 {
+		return 0, 0, s, false
+	}
+	return w, h, rest, true
+}
+
+// checkRawLength checks that raw hex digits fill the size their prefix gives.
+func checkRawLength(digits string, w, h int) error {
+	if len(digits) != w*h {
+		return fmt.Errorf("%w: raw data holds %d pixels, but its %dx%d prefix gives %d", ErrWidthMismatch, len(digits), w, h, w*h)
+	}
+	return nil
+}
+
 // readHexFromTextFile reads a text file (which may include header comments) and returns a continuous hex string,
-// the width (from the first non-empty line), and the original filename from the header (if any).
-func readHexFromTextFile(filename string) (string, int, string, error) {
-	bytes, err := ioutil.ReadFile(filename)
+// the width (from the first non-empty line), and the header metadata keyed by lowercase field name
+// (e.g. "file" for the original filename in a header like "# file: invader.png").
+func readHexFromTextFile(ctx context.Context, filename string) (string, int, map[string]string, error) {
+	bytes, err := readInput(filename)
 	if err != nil {
-		return "", 0, "", err
+		return "", 0, nil, err
+	}
+	return parseHexText(ctx, string(bytes))
+}
+
+// headerField splits a "# key: value" header line into its lowercase key and its value.
+func headerField(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, "#") {
+		return "", "", false
 	}
-	content := string(bytes)
+	key, value, ok := strings.Cut(strings.TrimPrefix(line, "#"), ":")
+	key = strings.ToLower(strings.TrimSpace(key))
+	return key, strings.TrimSpace(value), ok && key != ""
+}
+
+// hexScanner returns a scanner over the lines of hex text. Raw output puts a whole image on one
+// line, far beyond the default token size, so lines may be as long as the text itself.
+func hexScanner(content string) *bufio.Scanner {
 	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	return scanner
+}
+
+// parseHexText parses the contents of a hex text file; see readHexFromTextFile.
+func parseHexText(ctx context.Context, content string) (string, int, map[string]string, error) {
+	scanner := hexScanner(content)
 	var filteredLines []string
 	width := 0
-	origFileName := ""
+	lineNo := 0
+	meta := make(map[string]string)
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return "", 0, nil, err
+		}
+		lineNo++
 		line := scanner.Text()
 		line = strings.TrimRight(line, "\r")
 		// Check for header lines.
 		if strings.HasPrefix(line, "#") {
-			// Look for the original filename in a header like "# file: invader.png"
-			if strings.HasPrefix(strings.ToLower(line), "# file:") {
-				parts := strings.SplitN(line, ":", 2)
-				if len(parts) == 2 {
-					origFileName = strings.TrimSpace(parts[1])
+			// Collect "# key: value" fields, keeping the first occurrence of each key.
+			if key, value, ok := headerField(line); ok {
+				if _, seen := meta[key]; !seen {
+					meta[key] = value
 				}
 			}
 			continue
@@ -247,6 +494,19 @@ func readHexFromTextFile(filename string) (string, int, string, error) {
 		if idx := strings.Index(line, "#"); idx != -1 {
 			line = line[:idx]
 		}
+		// A raw line gives the size of the image it holds.
+		if w, h, rest, ok := parseRawPrefix(strings.TrimSpace(line)); ok && width == 0 {
+			filtered := filterHexLine(rest)
+			if err := checkRawLength(filtered, w, h); err != nil {
+				return "", 0, nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if _, seen := meta["width"]; !seen {
+				meta["width"], meta["height"] = strconv.Itoa(w), strconv.Itoa(h)
+			}
+			width = w
+			filteredLines = append(filteredLines, filtered)
+			continue
+		}
 		filtered := filterHexLine(line)
 		if len(filtered) > 0 {
 			if width == 0 {
@@ -256,53 +516,141 @@ func readHexFromTextFile(filename string) (string, int, string, error) {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		return "", 0, "", err
+		return "", 0, nil, err
+	}
+	// A single line of digits with no header width is headerless data of unknown width.
+	if _, ok := meta["width"]; !ok && len(filteredLines) == 1 {
+		width = 0
 	}
 	joined := strings.Join(filteredLines, "")
 	joined = filterHexString(joined)
-	return joined, width, origFileName, nil
+	return joined, width, meta, nil
 }
 
-// hexToImage converts a continuous hex string into an image.
-func hexToImage(hexData string, width int) (image.Image, error) {
+// rowSeparator marks row breaks in direct hex strings.
+var rowSeparator = "/"
+
+// splitHexRows joins the rows of a direct hex string separated by the row separator, checking
+// that they all have the same width (and match width, when it is given). Rows are numbered from 1
+// in errors.
+func splitHexRows(hexStr string, width int) (string, int, error) {
+	var rows []string
+	for i, row := range strings.Split(hexStr, rowSeparator) {
+		row = filterHexString(row)
+		if row == "" {
+			continue // Allow a trailing separator.
+		}
+		if width == 0 {
+			width = len(row)
+		} else if len(row) != width {
+			return "", 0, &WidthError{Line: i + 1, Width: len(row), Expected: width}
+		}
+		rows = append(rows, row)
+	}
+	return strings.Join(rows, ""), width, nil
+}
+
+// parseHexString reads a direct hex string: continuous digits, optionally after "0x", rows
+// split by the row separator, or raw output with its size prefix. It returns the digits and the
+// width, which is width itself unless the string gives one.
+func parseHexString(input string, width int) (string, int, error) {
+	hexStr := strings.TrimSpace(input)
+	if strings.HasPrefix(hexStr, "0x") || strings.HasPrefix(hexStr, "0X") {
+		hexStr = hexStr[2:]
+	}
+	if w, h, rest, ok := parseRawPrefix(hexStr); ok {
+		if width > 0 && width != w {
+			return "", 0, fmt.Errorf("%w: --width %d, but the raw prefix gives %d", ErrWidthMismatch, width, w)
+		}
+		hexStr = filterHexString(rest)
+		if err := checkRawLength(hexStr, w, h); err != nil {
+			return "", 0, err
+		}
+		return hexStr, w, nil
+	}
+	if strings.Contains(hexStr, rowSeparator) {
+		return splitHexRows(hexStr, width)
+	}
+	return filterHexString(hexStr), width, nil
+}
+
+// hexToIndexed converts a continuous hex string into an indexed image.
+func hexToIndexed(ctx context.Context, hexData string, width int) (*indexedImage, error) {
 	total := len(hexData)
 	if total == 0 {
-		return nil, errors.New("empty hex data")
+		return nil, ErrEmptyData
 	}
 	if width == 0 {
-		sq := int(math.Sqrt(float64(total)))
-		if sq*sq == total {
-			width = sq
-		} else {
-			width = total // single row.
-		}
+		width = guessWidth(total)
 	}
 	height := int(math.Ceil(float64(total) / float64(width)))
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	m := newIndexedImage(width, height)
 	for i, ch := range hexData {
-		x := i % width
-		y := i / width
+		if i%width == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		if ch == '.' {
-			img.Set(x, y, color.RGBA{0, 0, 0, 0})
-		} else {
-			idx, err := strconv.ParseUint(string(ch), 16, 8)
-			if err != nil {
-				return nil, fmt.Errorf("invalid hex digit '%c': %v", ch, err)
+			continue
+		}
+		idx, err := strconv.ParseUint(string(ch), 16, 8)
+		if err != nil {
+			return nil, &HexDigitError{Digit: ch, Offset: i}
+		}
+		m.pix[i] = int(idx)
+	}
+	return m, nil
+}
+
+// renderIndexed draws an indexed image using the ZX Spectrum palette, leaving transparent pixels clear.
+func renderIndexed(m *indexedImage) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, m.width, m.height))
+	for y := 0; y < m.height; y++ {
+		for x := 0; x < m.width; x++ {
+			if idx := m.at(x, y); idx != transparentIndex {
+				img.Set(x, y, ZXPalette[idx])
 			}
-			col := ZXPalette[idx]
-			img.Set(x, y, col)
 		}
 	}
-	return img, nil
+	return img
 }
 
-func saveImage(img image.Image, filename string) error {
-	out, err := os.Create(filename)
+// hexToImage converts a continuous hex string into an image.
+func hexToImage(ctx context.Context, hexData string, width int) (image.Image, error) {
+	m, err := hexToIndexed(ctx, hexData, width)
 	if err != nil {
+		return nil, err
+	}
+	return renderIndexed(m), nil
+}
+
+// scaleIndexed enlarges an indexed image by an integer factor using nearest-neighbour sampling.
+func scaleIndexed(m *indexedImage, factor int) *indexedImage {
+	out := newIndexedImage(m.width*factor, m.height*factor)
+	for y := 0; y < out.height; y++ {
+		for x := 0; x < out.width; x++ {
+			out.set(x, y, m.at(x/factor, y/factor))
+		}
+	}
+	return out
+}
+
+func saveImage(img image.Image, filename string) error {
+	return saveImageText(img, filename, nil)
+}
+
+// saveImageText saves an image as a PNG with the given fields in its text chunks.
+func saveImageText(img image.Image, filename string, fields [][2]string) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
 		return err
 	}
-	defer out.Close()
-	return png.Encode(out, img)
+	data := buf.Bytes()
+	if fields != nil {
+		data = addPNGText(data, fields)
+	}
+	return writeOutputFile(filename, data)
 }
 
 func fileExists(filename string) bool {
@@ -310,127 +658,927 @@ func fileExists(filename string) bool {
 	return err == nil
 }
 
-func main() {
-	rawMode := flag.Bool("raw", false, "Output as a single continuous hex string with no header or row breaks")
-	widthFlag := flag.Int("width", 0, "Width for output image when converting from hex data (mandatory in direct string mode)")
-	output := flag.String("output", "", "Output filename")
-	// New flags for transparent colour override.
-	transpColorFlag := flag.String("transpcolor", "", "Transparent color (in web format, e.g. #aabbcc) to use as transparent")
-	transpColourFlag := flag.String("transpcolour", "", "Transparent colour (in web format, e.g. #aabbcc) to use as transparent")
-	transpIndexFlag := flag.Int("transpindex", -1, "Palette index to treat as transparent")
-	flag.Parse()
-
-	// Use either transpcolor or transpcolour if provided.
-	if *transpColorFlag != "" {
-		transpColorStr = *transpColorFlag
-	} else if *transpColourFlag != "" {
-		transpColorStr = *transpColourFlag
-	}
-	transpIndex = *transpIndexFlag
-
-	if flag.NArg() < 1 {
-		fmt.Println("Usage: zxtex <input> [--raw] [--width N] [--output file] [--transpcolor #aabbcc|--transpindex N]")
-		os.Exit(1)
-	}
-
-	input := flag.Arg(0)
-	ext := strings.ToLower(filepath.Ext(input))
-	if fileExists(input) {
-		switch ext {
-		// If input is an image, convert it to hex.
-		case ".png", ".gif", ".bmp":
-			var hexStr string
-			var err error
-			if *rawMode {
-				hexStr, err = imageToRawHex(input)
-			} else {
-				hexStr, err = imageToHex(input)
-			}
+// source is a decoded input, ready to be written out in any format.
+type source struct {
+	name      string            // Input filename; empty in direct string mode.
+	image     *indexedImage     // Palette indices, one per pixel.
+	meta      map[string]string // Header metadata from hex files.
+	fromImage bool              // True when the input was an image file.
+	chunky    bool              // True for chunky low-res pixel data.
+	anim      *animation        // The frames of a multi-frame hex file, whose image stacks them; nil otherwise.
+	rgb       image.Image       // The decoded colours of a single-image input, for full-colour formats; nil otherwise.
+	header    []string          // Further "key: value" fields for the hex header, such as trim offsets.
+}
+
+// decodeImageData decodes the bytes of an image file, named input in warnings, converting it to
+// sRGB by its colour profile and to 8 bits per channel.
+func decodeImageData(data []byte, input string) (image.Image, error) {
+	img, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return reduceDepth(applyColourProfile(data, img, input)), nil
+}
+
+// quantizeSource turns a decoded image into palette indices as the settings ask: --map, then
+// --auto-levels and --kmeans, then chunky pixels, --fit-screen and cell quantization, or the
+// nearest colours. It also returns the colours the indices were chosen from. Still images and
+// every frame of an animation go through it alike.
+func quantizeSource(ctx context.Context, img image.Image, chunky bool) (*indexedImage, image.Image, error) {
+	img, forced := mapColours(img)
+	if autoLevels {
+		img = stretchLevels(img)
+	}
+	var err error
+	if kmeansColours > 0 {
+		if img, err = reduceColours(ctx, img, kmeansColours); err != nil {
+			return nil, nil, err
+		}
+	}
+	var m *indexedImage
+	switch {
+	case chunky:
+		m, err = imageToChunky(ctx, img)
+	case fitScreen || quantizeMode == "cell":
+		f := newRGBImage(img)
+		if fitScreen {
+			f = fitToScreen(f)
+		}
+		m, err = quantizeRGB(ctx, f)
+	default:
+		m, err = quantizeImage(ctx, img)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if !chunky && !fitScreen {
+		forceMapped(m, forced)
+	}
+	return m, img, nil
+}
+
+// loadSource decodes an image file, a hex text file or a direct hex string.
+func loadSource(ctx context.Context, input string, width int, chunky bool) (*source, error) {
+	if input != stdinName && !inputExists(input) {
+		// Direct string mode.
+		if attrFile != "" {
+			return nil, fmt.Errorf("%w: --attr needs bitmap files, not hex strings", ErrUnsupportedFormat)
+		}
+		if animateFlash {
+			return nil, fmt.Errorf("%w: --animate-flash needs an SCR input", ErrUnsupportedFormat)
+		}
+		if cropStr != "" {
+			return nil, fmt.Errorf("%w: --crop applies to image inputs", ErrUnsupportedFormat)
+		}
+		hexStr, width, err := parseHexString(input, width)
+		if err != nil {
+			return nil, fmt.Errorf("converting hex string to image: %w", err)
+		}
+		m, err := hexToIndexed(ctx, hexStr, width)
+		if err != nil {
+			return nil, fmt.Errorf("converting hex string to image: %w", err)
+		}
+		return &source{image: m, meta: map[string]string{}, chunky: chunky}, nil
+	}
+	data, err := readInput(input)
+	if err != nil {
+		return nil, err
+	}
+	kind := "scr"
+	if attrFile != "" {
+		data, err = mergeScreen(data)
+	} else {
+		kind, err = inputKind(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kind == "tap" || kind == "tzx" {
+		blocks, err := parseTape(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = tapeScreen(blocks); err != nil {
+			return nil, err
+		}
+		kind = "scr"
+	}
+	if cropStr != "" && kind != "image" && kind != "raw" {
+		return nil, fmt.Errorf("%w: --crop applies to image inputs", ErrUnsupportedFormat)
+	}
+	if animateFlash && kind != "scr" {
+		return nil, fmt.Errorf("%w: --animate-flash needs an SCR input", ErrUnsupportedFormat)
+	}
+	if input == stdinName {
+		input = ""
+	}
+	switch kind {
+	// If input is an image, quantize it to palette indices.
+	case "image", "raw":
+		if kind == "image" && bytes.HasPrefix(data, []byte("GIF8")) {
+			anim, err := decodeGIFAnimation(ctx, data, chunky)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error converting image: %v\n", err)
-				os.Exit(1)
+				return nil, fmt.Errorf("converting image: %w", err)
 			}
-			if *output != "" {
-				f, err := os.Create(*output)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error creating output file: %v\n", err)
-					os.Exit(1)
+			if anim != nil {
+				if err := applyDurations(anim); err != nil {
+					return nil, err
 				}
-				defer f.Close()
-				writer := bufio.NewWriter(f)
-				_, err = writer.WriteString(hexStr)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error writing to file: %v\n", err)
-					os.Exit(1)
+				if alignPivot {
+					alignPivots(anim)
 				}
-				writer.Flush()
-				fmt.Printf("Hex data written to %s\n", *output)
-			} else {
-				fmt.Print(hexStr)
+				return &source{name: input, image: stackFrames(anim.frames), meta: map[string]string{}, fromImage: true, chunky: chunky, anim: anim}, nil
 			}
-		// If input is a text file, read it and convert to an image.
-		case ".txt", ".hex":
-			hexData, fileWidth, origName, err := readHexFromTextFile(input)
+		}
+		var img image.Image
+		if kind == "raw" {
+			img, err = decodeRawPixels(data)
+		} else {
+			img, err = decodeImageData(data, input)
+		}
+		if err == nil {
+			img, err = cropImage(img)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("converting image: %w", err)
+		}
+		meta := map[string]string{}
+		if kind == "image" {
+			chunky = applyPNGText(data, meta, input) || chunky
+		}
+		src := &source{name: input, meta: meta, fromImage: true, chunky: chunky}
+		if src.image, src.rgb, err = quantizeSource(ctx, img, chunky); err != nil {
+			return nil, err
+		}
+		return src, nil
+	// A Spectrum screen dump decodes straight to palette indices.
+	case "scr":
+		if animateFlash {
+			anim, err := scrFlashAnimation(data)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error reading hex file: %v\n", err)
-				os.Exit(1)
+				return nil, fmt.Errorf("reading screen file: %w", err)
 			}
-			useWidth := *widthFlag
-			if useWidth == 0 && fileWidth > 0 {
-				useWidth = fileWidth
+			if chunky {
+				for i, frame := range anim.frames {
+					if anim.frames[i], err = imageToChunky(ctx, renderIndexed(frame)); err != nil {
+						return nil, err
+					}
+				}
 			}
-			img, err := hexToImage(hexData, useWidth)
+			if err := applyDurations(anim); err != nil {
+				return nil, err
+			}
+			return &source{name: input, image: stackFrames(anim.frames), meta: map[string]string{}, fromImage: true, chunky: chunky, anim: anim}, nil
+		}
+		m, err := scrToIndexed(data)
+		if err != nil {
+			return nil, fmt.Errorf("reading screen file: %w", err)
+		}
+		if chunky {
+			m, err = imageToChunky(ctx, renderIndexed(m))
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error converting hex to image: %v\n", err)
-				os.Exit(1)
+				return nil, err
+			}
+		}
+		return &source{name: input, image: m, meta: map[string]string{}, fromImage: true, chunky: chunky}, nil
+	// If input is a text file, read its hex data.
+	default:
+		return hexSource(ctx, input, data, width, chunky)
+	}
+}
+
+// hexSource reads hex text: a single image, or an animation when it has frame sections. The
+// width, when not 0, overrides the one in the text; input names it in messages.
+func hexSource(ctx context.Context, input string, data []byte, width int, chunky bool) (*source, error) {
+	hexData, fileWidth, meta, err := parseHexText(ctx, string(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading hex file: %w", err)
+	}
+	useWidth := width
+	if useWidth == 0 && fileWidth > 0 {
+		useWidth = fileWidth
+	}
+	if useWidth == 0 {
+		if useWidth = guessWidth(len(hexData)); useWidth > 0 {
+			name := input
+			if name == "" {
+				name = "standard input"
+			}
+			fmt.Fprintf(os.Stderr, "Note: %s has no width; reading it as %dx%d (set one with --width or --aspect)\n", name, useWidth, len(hexData)/useWidth)
+		}
+	}
+	m, err := hexToIndexed(ctx, hexData, useWidth)
+	if err != nil {
+		return nil, fmt.Errorf("converting hex to image: %w", err)
+	}
+	chunky = chunky || strings.EqualFold(meta["mode"], "chunky")
+	src := &source{name: input, image: m, meta: meta, chunky: chunky}
+	if hasFrames(string(data)) {
+		if src.anim, err = parseAnimation(ctx, string(data)); err != nil {
+			return nil, fmt.Errorf("reading animation: %w", err)
+		}
+		if err := applyDurations(src.anim); err != nil {
+			return nil, err
+		}
+		if alignPivot {
+			alignPivots(src.anim)
+			src.image = stackFrames(src.anim.frames)
+		}
+	}
+	return src, nil
+}
+
+// defaultOutputName picks an output filename when none was given: the base name of the original
+// file recorded in the header, else of the input image, else "out", with the given extension.
+func defaultOutputName(src *source, ext string) string {
+	base := ""
+	if origName := src.meta["file"]; origName != "" {
+		base = filepath.Base(origName)
+	} else if src.fromImage {
+		base = filepath.Base(src.name)
+	}
+	nameOnly := strings.TrimSuffix(base, filepath.Ext(base))
+	if nameOnly == "" || nameOnly+ext == src.name {
+		nameOnly = "out"
+	}
+	return nameOnly + ext
+}
+
+// sourceFileName returns the filename recorded for a source: the original file from its header,
+// else the input filename.
+func sourceFileName(src *source) string {
+	if origName := src.meta["file"]; origName != "" {
+		return origName
+	}
+	return src.name
+}
+
+// sourceLabel returns an assembler label for a source.
+func sourceLabel(src *source) string {
+	if name := sourceFileName(src); name != "" {
+		return labelPrefix + asmLabel(name)
+	}
+	return labelPrefix + "sprite"
+}
+
+// writeTextOutput writes text to the output file, or to standard output when no file (or "-") is
+// given.
+func writeTextOutput(text, output, what string) error {
+	if output == "" || output == stdoutName {
+		fmt.Print(text)
+		return nil
+	}
+	if err := writeOutputFile(output, []byte(text)); err != nil {
+		return err
+	}
+	statusf("%s written to %s\n", what, output)
+	return nil
+}
+
+// writeBinaryOutput writes binary data to the output file, padded to the --align boundary, or in
+// chunks with --split-bytes.
+func writeBinaryOutput(data []byte, output, format, what string) error {
+	data = alignData(data)
+	if byteReport {
+		writeByteReport(os.Stderr, output, data)
+	}
+	if compressMode == "compare" {
+		writeCompressionTable(os.Stderr, output, data)
+	}
+	if splitBytes > 0 {
+		return writeBanks(data, output, format, what)
+	}
+	return writeBinaryFile(data, output, format, what)
+}
+
+// writeBinaryFile writes binary data to the output file, wrapped in a +3DOS or Hobeta header
+// when enabled, or adds it to the disk or tape image given with --trd, --dsk or --tap.
+func writeBinaryFile(data []byte, output, format, what string) error {
+	if tapImage != "" {
+		if err := addToTAP(tapImage, output, data, codeLoadAddress(format)); err != nil {
+			return err
+		}
+		statusf("%s added to %s as %s\n", what, tapImage, strings.TrimRight(tapeName(output), " "))
+		launchFile = tapImage
+		return nil
+	}
+	if dskImage != "" {
+		if err := addToDSK(dskImage, output, data, codeLoadAddress(format)); err != nil {
+			return err
+		}
+		statusf("%s added to %s as %s\n", what, dskImage, displayName(plus3Name(output)))
+		launchFile = dskImage
+		return nil
+	}
+	if trdImage != "" {
+		if err := addToTRD(trdImage, output, data, codeLoadAddress(format)); err != nil {
+			return err
+		}
+		statusf("%s added to %s as %s.C\n", what, trdImage, strings.TrimRight(string(trdosName(output)), " "))
+		launchFile = trdImage
+		return nil
+	}
+	data, err := wrapBinary(data, format)
+	if err != nil {
+		return err
+	}
+	if hobetaOutput {
+		if data, err = hobetaFile(data, output, codeLoadAddress(format)); err != nil {
+			return err
+		}
+	}
+	if err := writeOutputFile(output, data); err != nil {
+		return err
+	}
+	if output != stdoutName {
+		statusf("%s written to %s\n", what, output)
+		// Emulators open plain screens, but not ones wrapped in a header.
+		if format == "scr" && !plus3Header && !hobetaOutput {
+			launchFile = output
+		}
+	}
+	return nil
+}
+
+// Conversion settings.
+var (
+	outputFormat string // Output formats, separated by commas; empty for the default of each input type.
+	rawOutput    bool   // Write hex data as a single continuous string.
+	bareOutput   bool   // Leave the size prefix off raw hex data.
+	hexWidth     int    // Width for hex data that does not define one.
+	chunkyMode   bool   // Chunky low-res mode.
+	brightReport bool   // Report ambiguous BRIGHT choices on standard error.
+	reproducible bool   // Leave environment-dependent details (such as directories) out of the output.
+	launchFile   string // The last screen, snapshot or disk image written, for --run to open.
+)
+
+// formatExtensions maps each output format to the extension used for default output filenames.
+var formatExtensions = map[string]string{
+	"hex":         ".hex",
+	"png":         ".png",
+	"png-preview": "_preview.png",
+	"bin":         ".bin",
+	"asm":         ".asm",
+	"attr":        ".attr",
+	"attr-hex":    "_attr.hex",
+	"attr-asm":    "_attr.asm",
+	"agd-sprite":  ".agd",
+	"agd-block":   "_blocks.agd",
+	"scr":         ".scr",
+	"c":           ".c",
+	"attr-c":      "_attr.c",
+	"attr-grid":   "_attrgrid.png",
+	"gif":         ".gif",
+	"onion":       "_onion.png",
+	"mask":        "_mask.bin",
+	"mask-hex":    "_mask.hex",
+	"mask-asm":    "_mask.asm",
+	"mask-c":      "_mask.c",
+	"bbox":        "_bbox.json",
+	"sna":         ".sna",
+	"z80":         ".z80",
+	"layer2":      ".l2",
+	"if2":         ".rom",
+	"godot":       ".tres",
+	"engine-json": "_engine.json",
+}
+
+// binaryFormats lists the output formats that are always written to a file.
+var binaryFormats = map[string]bool{
+	"png":         true,
+	"png-preview": true,
+	"bin":         true,
+	"attr":        true,
+	"attr-grid":   true,
+	"scr":         true,
+	"gif":         true,
+	"onion":       true,
+	"mask":        true,
+	"sna":         true,
+	"z80":         true,
+	"layer2":      true,
+	"if2":         true,
+}
+
+// ownContainerFormats lists the binary formats that are files of a kind of their own, never
+// wrapped in a Hobeta header.
+var ownContainerFormats = map[string]bool{
+	"gif":    true,
+	"sna":    true,
+	"z80":    true,
+	"layer2": true,
+	"if2":    true,
+}
+
+// outputFormats returns the formats listed in --format, validated; it is empty when none was given.
+func outputFormats() ([]string, error) {
+	if outputFormat == "" {
+		return nil, nil
+	}
+	formats := strings.Split(outputFormat, ",")
+	for i, format := range formats {
+		format = strings.TrimSpace(format)
+		if _, ok := formatExtensions[format]; !ok {
+			return nil, fmt.Errorf("%w: output format %s", ErrUnsupportedFormat, format)
+		}
+		formats[i] = format
+	}
+	return formats, nil
+}
+
+// outputExtension returns the extension given to files written in a format.
+func outputExtension(format string) string {
+	if hobetaOutput && binaryFormats[format] && !strings.HasSuffix(formatExtensions[format], ".png") && !ownContainerFormats[format] {
+		return ".$C"
+	}
+	return formatExtensions[format]
+}
+
+// stdinName is the input name that reads hex text from standard input.
+const stdinName = "-"
+
+// inputType forces how inputs are read: "image", "scr", "tap", "tzx", "hex" or "raw"; "auto" detects it from the content.
+var inputType = "auto"
+
+// readInput reads an input file, or standard input for "-".
+func readInput(filename string) ([]byte, error) {
+	if filename == stdinName {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	if member, ok := archiveMembers[filename]; ok {
+		return member.data, nil
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// Signatures of the image formats zxtex decodes.
+var imageMagic = [][]byte{
+	[]byte("\x89PNG\r\n\x1a\n"),
+	[]byte("GIF87a"),
+	[]byte("GIF89a"),
+	[]byte("BM"),
+}
+
+// looksLikeText reports whether data is plain text: no control characters other than whitespace.
+func looksLikeText(data []byte) bool {
+	for _, b := range data {
+		if b < 0x20 && b != '\n' && b != '\r' && b != '\t' && b != '\f' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkInputType validates the --type setting.
+func checkInputType() error {
+	switch inputType {
+	case "auto", "image", "scr", "tap", "tzx", "hex", "raw":
+		return nil
+	}
+	return fmt.Errorf("unknown input type %q (expected auto, image, scr, tap, tzx, hex or raw)", inputType)
+}
+
+// inputKind tells how an input is read from its content, whatever its name: "image" for PNG, GIF,
+// BMP, PCX, IFF and TGA data, "hex" for text, "scr" for a 6912-byte binary screen dump, and "tap" and "tzx" for
+// tape images. The --type setting overrides the detection.
+func inputKind(data []byte) (string, error) {
+	if inputType != "auto" {
+		return inputType, nil
+	}
+	for _, magic := range imageMagic {
+		if bytes.HasPrefix(data, magic) {
+			return "image", nil
+		}
+	}
+	if isPCX(data) || isIFF(data) {
+		return "image", nil
+	}
+	if looksLikeText(data) {
+		return "hex", nil
+	}
+	if len(data) == scrSize {
+		return "scr", nil
+	}
+	if bytes.HasPrefix(data, []byte(tzxSignature)) {
+		return "tzx", nil
+	}
+	if looksLikeTAP(data) {
+		return "tap", nil
+	}
+	// TGA files have no signature, so they are only looked for once everything else is ruled out.
+	if isTGA(data) {
+		return "image", nil
+	}
+	return "", fmt.Errorf("%w: input is neither a PNG, GIF, BMP, PCX, IFF or TGA image, a screen dump, a tape image nor hex text", ErrUnsupportedFormat)
+}
+
+// checkInput rejects direct strings without a width. Files are checked when they are read.
+func checkInput(input string) error {
+	if input != stdinName && !inputExists(input) {
+		_, _, _, sized := parseRawPrefix(strings.TrimSpace(input))
+		if hexWidth == 0 && !sized && !strings.Contains(input, rowSeparator) {
+			return fmt.Errorf("in direct string mode, you must specify the --width flag or separate rows with %q", rowSeparator)
+		}
+	}
+	return nil
+}
+
+// recordedName returns a filename as it should appear in output metadata: unchanged, or reduced
+// to its base name in reproducible mode so outputs do not depend on where the input was read from.
+func recordedName(filename string) string {
+	if reproducible && filename != "" {
+		return filepath.Base(filepath.ToSlash(filename))
+	}
+	return filename
+}
+
+// convertInput converts one input in each configured output format. Text formats are written to
+// standard output when output is empty; other formats, and all formats when toFile is set or
+// several formats are given, fall back to a default filename inside outDir. Cancelling ctx
+// abandons the conversion.
+func convertInput(ctx context.Context, input, output, outDir string, toFile bool) error {
+	formats, err := outputFormats()
+	if err != nil {
+		return err
+	}
+	if err := checkInput(input); err != nil {
+		return err
+	}
+	src, err := loadSource(ctx, input, hexWidth, chunkyMode)
+	if err != nil {
+		return err
+	}
+	if invertInk {
+		invertSource(src)
+	}
+	if toggleBright || setBright != "" {
+		if err := applyBrightOp(src); err != nil {
+			return err
+		}
+	}
+
+	if brightReport || clashReport {
+		m := src.image
+		if src.chunky {
+			m = chunkyToScreen(m)
+		}
+		if brightReport {
+			writeBrightReport(os.Stderr, m)
+		}
+		if clashReport {
+			writeClashReport(os.Stderr, m)
+		}
+	}
+	return writeSource(src, formats, output, outDir, toFile)
+}
+
+// writeSource writes a loaded source in each of the given formats, or the default format of its
+// input type when formats is empty, following the output naming rules of convertInput.
+func writeSource(src *source, formats []string, output, outDir string, toFile bool) error {
+	if len(formats) == 0 {
+		if src.fromImage {
+			formats = []string{"hex"}
+		} else {
+			formats = []string{"png"}
+		}
+	}
+	if len(formats) == 1 {
+		return convertTo(src, formats[0], output, outDir, toFile)
+	}
+	// Several formats are written from the one decoded image, each to its own file: named after
+	// --output with the format's extension when it is given, or the default output name otherwise.
+	if output == stdoutName {
+		return fmt.Errorf("several output formats cannot all be written to standard output")
+	}
+	for _, format := range formats {
+		target := ""
+		if output != "" {
+			target = strings.TrimSuffix(output, filepath.Ext(output)) + outputExtension(format)
+		}
+		if err := convertTo(src, format, target, outDir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertTo writes a loaded source in one output format. When output is empty, binary formats
+// (and every format, with toFile) are written to the default output name in outDir.
+func convertTo(src *source, format, output, outDir string, toFile bool) error {
+	if output == "" && (toFile || binaryFormats[format]) {
+		output = filepath.Join(outDir, defaultOutputName(src, outputExtension(format)))
+	}
+
+	m := src.image
+	if src.chunky && format != "hex" {
+		m = chunkyToScreen(m)
+	}
+	if variantSet != "" {
+		if variantLayout == "files" {
+			return writeVariants(src, m, format, output, outDir)
+		}
+		strip, err := variantStrip(m)
+		if err != nil {
+			return err
+		}
+		single := *src
+		single.anim = nil
+		src, m = &single, strip
+	}
+	if scrollDirection != "" {
+		return writeStrip(src, m, format, output)
+	}
+	if splitIslands {
+		return writeIslands(src, m, format, output, outDir)
+	}
+	if sliceFile != "" {
+		return writeSlices(src, m, format, output, outDir)
+	}
+	if splitScreens {
+		if tw, th := screenTileSize(src, format); m.width > tw || m.height > th {
+			return splitIntoScreens(src, m, format, output, outDir)
+		}
+	}
+	return writeFormat(src, m, format, output)
+}
+
+// screenFrames returns the frames of an animation source at screen resolution.
+func screenFrames(src *source) []*indexedImage {
+	var frames []*indexedImage
+	for _, frame := range src.anim.frames {
+		if src.chunky {
+			frame = chunkyToScreen(frame)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// writeFormat writes an image in the given output format, to standard output for text formats
+// when output is empty, and reads it back to check it when --verify is set.
+func writeFormat(src *source, m *indexedImage, format, output string) error {
+	if err := encodeFormat(src, m, format, output); err != nil {
+		return err
+	}
+	if !verifyOutput {
+		return nil
+	}
+	if output == "" || output == stdoutName {
+		statusf("%s output to standard output is not verified\n", format)
+		return nil
+	}
+	return verifyFile(src, m, format, output)
+}
+
+// encodeFormat writes an image in the given output format; see writeFormat.
+func encodeFormat(src *source, m *indexedImage, format, output string) error {
+	switch format {
+	case "hex":
+		var hexStr string
+		if rawOutput {
+			hexStr = indexedToRawHex(m, bareOutput)
+		} else {
+			var extra []string
+			if src.chunky {
+				extra = append(extra, "mode: chunky")
+			}
+			if border := sourceBorder(src); border >= 0 {
+				extra = append(extra, fmt.Sprintf("border: %d", border))
 			}
-			outFile := *output
-			if outFile == "" {
-				// If an original filename is available in metadata, use its base name with a .png extension.
-				if origName != "" {
-					base := filepath.Base(origName)
-					ext := filepath.Ext(base)
-					nameOnly := strings.TrimSuffix(base, ext)
-					outFile = nameOnly + ".png"
-				} else {
-					outFile = "out.png"
+			if src.anim != nil {
+				hexStr = animationToHex(src.anim, recordedName(sourceFileName(src)), extra...)
+			} else {
+				if recordBBox {
+					extra = append(extra, bboxField(m))
+				}
+				if recordPivot {
+					extra = append(extra, pivotField(m))
 				}
+				extra = append(extra, src.header...)
+				hexStr = indexedToHex(m, recordedName(sourceFileName(src)), extra...)
 			}
-			err = saveImage(img, outFile)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error saving image: %v\n", err)
-				os.Exit(1)
+		}
+		if err := writeTextOutput(hexStr, output, "Hex data"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	case "png", "png-preview":
+		img := renderIndexed(m)
+		if palBleed > 0 {
+			img = palFilter(img)
+		}
+		if crtPreview {
+			img = crtFilter(img)
+		}
+		if err := saveImageText(img, output, pngTextFields(src, m)); err != nil {
+			return fmt.Errorf("saving image: %w", err)
+		}
+		if output != stdoutName {
+			statusf("Image saved as %s\n", output)
+		}
+	case "gif":
+		frames, durations := []*indexedImage{m}, []int{defaultFrameDuration}
+		if src.anim != nil {
+			frames, durations = screenFrames(src), nil
+			for i := range frames {
+				durations = append(durations, src.anim.frameDuration(i))
+			}
+		}
+		data, err := animationToGIF(frames, durations)
+		if err != nil {
+			return fmt.Errorf("encoding GIF: %w", err)
+		}
+		if err := writeOutputFile(output, data); err != nil {
+			return fmt.Errorf("saving image: %w", err)
+		}
+		if output != stdoutName {
+			statusf("Animation saved as %s\n", output)
+		}
+	case "onion":
+		if src.anim == nil {
+			return fmt.Errorf("%w: onion skins are made from animations", ErrUnsupportedFormat)
+		}
+		if err := saveImage(onionSkin(screenFrames(src)), output); err != nil {
+			return fmt.Errorf("saving image: %w", err)
+		}
+		if output != stdoutName {
+			statusf("Onion skin saved as %s\n", output)
+		}
+	case "bin", "asm", "c":
+		data, lineLen, err := exportBitmap(m)
+		if err != nil {
+			return fmt.Errorf("exporting bitmap: %w", err)
+		}
+		header := []string{
+			fmt.Sprintf("width: %d", m.width),
+			fmt.Sprintf("height: %d", m.height),
+			"order: " + byteOrder,
+			"bitorder: " + bitOrder,
+		}
+		if recordBBox {
+			header = append(header, bboxField(m))
+		}
+		if recordPivot {
+			header = append(header, pivotField(m))
+		}
+		header = append(header, "generator: zxtex")
+		switch format {
+		case "asm":
+			if err := writeTextOutput(bytesToAsm(data, sourceLabel(src), lineLen, header), output, "Assembly"); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
+			return nil
+		case "c":
+			if err := writeTextOutput(bytesToC(data, sourceLabel(src), lineLen, header), output, "C source"); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
+			return nil
+		}
+		if err := writeBinaryOutput(data, output, format, "Binary data"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	case "scr":
+		data, err := imageToScr(m)
+		if err != nil {
+			return fmt.Errorf("exporting screen: %w", err)
+		}
+		if err := writeBinaryOutput(data, output, format, "Screen"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	case "sna", "z80":
+		scr, err := imageToScr(m)
+		if err != nil {
+			return fmt.Errorf("exporting screen: %w", err)
+		}
+		data, err := snapshotWithScreen(format, scr, sourceBorder(src))
+		if err != nil {
+			return err
+		}
+		if err := writeOutputFile(output, data); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+		if output != stdoutName {
+			statusf("Snapshot written to %s\n", output)
+			launchFile = output
+		}
+	case "if2":
+		scr, err := imageToScr(m)
+		if err != nil {
+			return fmt.Errorf("exporting screen: %w", err)
+		}
+		if err := writeOutputFile(output, if2ROM(scr, sourceBorder(src))); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+		if output != stdoutName {
+			statusf("Interface 2 ROM written to %s\n", output)
+			launchFile = output
+		}
+	case "attr", "attr-hex", "attr-asm", "attr-c":
+		m, _, err := padImage(m)
+		if err != nil {
+			return fmt.Errorf("exporting attributes: %w", err)
+		}
+		data, cols := attributeBytes(m)
+		switch format {
+		case "attr-hex":
+			if err := writeTextOutput(attributesToHex(data, cols, recordedName(sourceFileName(src))), output, "Attribute data"); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
+		case "attr-asm", "attr-c":
+			header := []string{
+				fmt.Sprintf("columns: %d", cols),
+				fmt.Sprintf("rows: %d", len(data)/cols),
+				"generator: zxtex",
+			}
+			text, what := bytesToAsm(data, sourceLabel(src)+"_attr", cols, header), "Assembly"
+			if format == "attr-c" {
+				text, what = bytesToC(data, sourceLabel(src)+"_attr", cols, header), "C source"
+			}
+			if err := writeTextOutput(text, output, what); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
 			}
-			fmt.Printf("Image saved as %s\n", outFile)
 		default:
-			fmt.Fprintf(os.Stderr, "Unsupported file type: %s\n", ext)
-			os.Exit(1)
+			if err := writeBinaryOutput(data, output, format, "Attribute data"); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
 		}
-	} else {
-		// Direct string mode.
-		if *widthFlag == 0 {
-			fmt.Fprintln(os.Stderr, "In direct string mode, you must specify the --width flag.")
-			os.Exit(1)
+	case "attr-grid":
+		m, _, err := padImage(m)
+		if err != nil {
+			return fmt.Errorf("exporting attributes: %w", err)
+		}
+		if err := saveImage(renderIndexed(attributeGrid(m)), output); err != nil {
+			return fmt.Errorf("saving image: %w", err)
+		}
+		if output != stdoutName {
+			statusf("Attribute grid saved as %s\n", output)
+		}
+	case "layer2":
+		if err := writeLayer2(src, m, output); err != nil {
+			return err
+		}
+	case "bbox":
+		var frames []*indexedImage
+		if src.anim != nil {
+			frames = screenFrames(src)
 		}
-		hexStr := strings.TrimSpace(input)
-		if strings.HasPrefix(hexStr, "0x") || strings.HasPrefix(hexStr, "0X") {
-			hexStr = hexStr[2:]
+		text, err := bboxJSON(m, frames, recordedName(sourceFileName(src)))
+		if err != nil {
+			return err
+		}
+		if err := writeTextOutput(text, output, "Bounding boxes"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
 		}
-		hexStr = filterHexString(hexStr)
-		img, err := hexToImage(hexStr, *widthFlag)
+	case "godot", "engine-json":
+		text, err := engineText(sourceSheet(src, m, sheetImageName(src, format, output)), format)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error converting hex string to image: %v\n", err)
-			os.Exit(1)
+			return err
+		}
+		if err := writeTextOutput(text, output, "Engine metadata"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
+		}
+	case "mask", "mask-hex", "mask-asm", "mask-c":
+		data, lineLen, w, h, err := collisionMask(m)
+		if err != nil {
+			return fmt.Errorf("exporting mask: %w", err)
+		}
+		header := []string{
+			fmt.Sprintf("width: %d", w),
+			fmt.Sprintf("height: %d", h),
+			"mask: " + maskMode,
+		}
+		switch format {
+		case "mask-hex":
+			if err := writeTextOutput(byteRowsToHex(data, lineLen, recordedName(sourceFileName(src)), header...), output, "Mask data"); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
+		case "mask-asm", "mask-c":
+			header = append(header, "order: "+byteOrder, "bitorder: "+bitOrder, "generator: zxtex")
+			text, what := bytesToAsm(data, sourceLabel(src)+"_mask", lineLen, header), "Assembly"
+			if format == "mask-c" {
+				text, what = bytesToC(data, sourceLabel(src)+"_mask", lineLen, header), "C source"
+			}
+			if err := writeTextOutput(text, output, what); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
+		default:
+			if err := writeBinaryOutput(data, output, format, "Mask data"); err != nil {
+				return fmt.Errorf("writing to file: %w", err)
+			}
 		}
-		outFile := *output
-		if outFile == "" {
-			outFile = "out.png"
+	case "agd-sprite", "agd-block":
+		var text string
+		var err error
+		if format == "agd-sprite" {
+			text, err = agdSprites(m)
+		} else {
+			text, err = agdBlocks(m)
 		}
-		err = saveImage(img, outFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error saving image: %v\n", err)
-			os.Exit(1)
+			return err
+		}
+		if err := writeTextOutput(text, output, "AGD definitions"); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
 		}
-		fmt.Printf("Image saved as %s\n", outFile)
 	}
+	return nil
 }